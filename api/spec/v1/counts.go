@@ -0,0 +1,164 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+// maxCount is the count of as many vGPU devices as fit on a GPU
+const maxCount = "max"
+
+// VGPUDeviceCount is the number of vGPU devices of a type: either a fixed number, or
+// "max" for as many as fit on a GPU, or a percentage of that like "50%"
+type VGPUDeviceCount struct {
+	Count int
+	// Percent of the instances that fit on a GPU, 100 for "max", 0 for a fixed number
+	Percent int
+}
+
+// IsRelative checks if the count depends on the GPU
+func (c VGPUDeviceCount) IsRelative() bool {
+	return c.Percent > 0
+}
+
+// Resolve returns the number of vGPU devices for a GPU on which 'max' instances fit,
+// rounded down
+func (c VGPUDeviceCount) Resolve(max int) int {
+	if !c.IsRelative() {
+		return c.Count
+	}
+	return max * c.Percent / 100
+}
+
+func (c VGPUDeviceCount) String() string {
+	switch {
+	case c.Percent == 100:
+		return maxCount
+	case c.IsRelative():
+		return fmt.Sprintf("%d%%", c.Percent)
+	}
+	return strconv.Itoa(c.Count)
+}
+
+// parseVGPUDeviceCount parses "max", a percentage like "50%" or a number
+func parseVGPUDeviceCount(value string) (VGPUDeviceCount, error) {
+	value = strings.TrimSpace(value)
+	if value == maxCount {
+		return VGPUDeviceCount{Percent: 100}, nil
+	}
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || percent <= 0 || percent > 100 {
+			return VGPUDeviceCount{}, fmt.Errorf("invalid percentage '%s': must be between 1%% and 100%%", value)
+		}
+		return VGPUDeviceCount{Percent: percent}, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return VGPUDeviceCount{}, fmt.Errorf("invalid count '%s': must be a non-negative number, a percentage or '%s'", value, maxCount)
+	}
+	return VGPUDeviceCount{Count: count}, nil
+}
+
+// UnmarshalYAML accepts a number, "max" or a percentage
+func (c *VGPUDeviceCount) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	count, err := parseVGPUDeviceCount(value)
+	if err != nil {
+		return err
+	}
+	*c = count
+	return nil
+}
+
+// MarshalYAML writes fixed numbers as numbers
+func (c VGPUDeviceCount) MarshalYAML() (interface{}, error) {
+	if !c.IsRelative() {
+		return c.Count, nil
+	}
+	return c.String(), nil
+}
+
+// UnmarshalJSON accepts a number, "max" or a percentage
+func (c *VGPUDeviceCount) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		var number int
+		if err := json.Unmarshal(data, &number); err != nil {
+			return fmt.Errorf("invalid count %s: must be a number, a percentage or '%s'", data, maxCount)
+		}
+		value = strconv.Itoa(number)
+	}
+	count, err := parseVGPUDeviceCount(value)
+	if err != nil {
+		return err
+	}
+	*c = count
+	return nil
+}
+
+// MarshalJSON writes fixed numbers as numbers
+func (c VGPUDeviceCount) MarshalJSON() ([]byte, error) {
+	if !c.IsRelative() {
+		return json.Marshal(c.Count)
+	}
+	return json.Marshal(c.String())
+}
+
+// VGPUDeviceCounts are the vGPU devices of a config entry by type
+type VGPUDeviceCounts map[string]VGPUDeviceCount
+
+// IsRelative checks if any count depends on the GPU
+func (c VGPUDeviceCounts) IsRelative() bool {
+	for _, count := range c {
+		if count.IsRelative() {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that relative counts are only used for entries with a single type,
+// as the instances that fit on a GPU are only known for a single type
+func (c VGPUDeviceCounts) Validate() error {
+	if c.IsRelative() && len(c) > 1 {
+		return fmt.Errorf("'%s' and percentages are only supported for a single vGPU type, got: %v", maxCount, c)
+	}
+	return nil
+}
+
+// Resolve returns the 'VGPUConfig' of the counts for a GPU. Relative counts can only be
+// resolved if the GPU has no vGPU devices of other types, 'resolved' is false otherwise.
+func (c VGPUDeviceCounts) Resolve(gpu *types.GPUInventory) (config types.VGPUConfig, resolved bool) {
+	config = types.VGPUConfig{}
+	for mdevType, count := range c {
+		max := 0
+		if count.IsRelative() {
+			var known bool
+			max, known = gpu.GetMaxInstances(mdevType)
+			if !known {
+				return nil, false
+			}
+		}
+		config[mdevType] = count.Resolve(max)
+	}
+	return config, true
+}
+
+// Absolute returns the 'VGPUConfig' of fixed counts, relative counts are left out
+func (c VGPUDeviceCounts) Absolute() types.VGPUConfig {
+	config := types.VGPUConfig{}
+	for mdevType, count := range c {
+		if !count.IsRelative() {
+			config[mdevType] = count.Count
+		}
+	}
+	return config
+}
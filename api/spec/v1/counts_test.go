@@ -0,0 +1,266 @@
+package v1
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+const (
+	type1G = "XGV_V0_1G_1_CORE"
+	type2G = "XGV_V0_2G_1_CORE"
+)
+
+func TestParseVGPUDeviceCount(t *testing.T) {
+	testCases := []struct {
+		description string
+		yaml        string
+		json        string
+		expected    VGPUDeviceCount
+		expectedErr bool
+	}{
+		{
+			description: "number",
+			yaml:        `2`,
+			json:        `2`,
+			expected:    VGPUDeviceCount{Count: 2},
+		},
+		{
+			description: "zero",
+			yaml:        `0`,
+			json:        `0`,
+			expected:    VGPUDeviceCount{},
+		},
+		{
+			description: "max",
+			yaml:        `max`,
+			json:        `"max"`,
+			expected:    VGPUDeviceCount{Percent: 100},
+		},
+		{
+			description: "percentage",
+			yaml:        `50%`,
+			json:        `"50%"`,
+			expected:    VGPUDeviceCount{Percent: 50},
+		},
+		{
+			description: "100 percent",
+			yaml:        `"100%"`,
+			json:        `"100%"`,
+			expected:    VGPUDeviceCount{Percent: 100},
+		},
+		{
+			description: "zero percent",
+			yaml:        `0%`,
+			json:        `"0%"`,
+			expectedErr: true,
+		},
+		{
+			description: "more than 100 percent",
+			yaml:        `150%`,
+			json:        `"150%"`,
+			expectedErr: true,
+		},
+		{
+			description: "negative number",
+			yaml:        `-1`,
+			json:        `-1`,
+			expectedErr: true,
+		},
+		{
+			description: "max with a number",
+			yaml:        `max2`,
+			json:        `"max2"`,
+			expectedErr: true,
+		},
+		{
+			description: "fraction",
+			yaml:        `1.5`,
+			json:        `1.5`,
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			var fromYAML VGPUDeviceCount
+			err := yaml.Unmarshal([]byte(tc.yaml), &fromYAML)
+			if tc.expectedErr && err == nil {
+				t.Errorf("expected error unmarshalling YAML %s, got %v", tc.yaml, fromYAML)
+			}
+			if !tc.expectedErr && err != nil {
+				t.Errorf("unexpected error unmarshalling YAML %s: %v", tc.yaml, err)
+			}
+			if !tc.expectedErr && fromYAML != tc.expected {
+				t.Errorf("expected %v from YAML, got %v", tc.expected, fromYAML)
+			}
+
+			var fromJSON VGPUDeviceCount
+			err = json.Unmarshal([]byte(tc.json), &fromJSON)
+			if tc.expectedErr && err == nil {
+				t.Errorf("expected error unmarshalling JSON %s, got %v", tc.json, fromJSON)
+			}
+			if !tc.expectedErr && err != nil {
+				t.Errorf("unexpected error unmarshalling JSON %s: %v", tc.json, err)
+			}
+			if !tc.expectedErr && fromJSON != tc.expected {
+				t.Errorf("expected %v from JSON, got %v", tc.expected, fromJSON)
+			}
+		})
+	}
+}
+
+func TestVGPUDeviceCountsRoundTrip(t *testing.T) {
+	testCases := []struct {
+		description  string
+		counts       VGPUDeviceCounts
+		expectedYAML string
+		expectedJSON string
+	}{
+		{
+			description:  "fixed numbers",
+			counts:       VGPUDeviceCounts{type1G: {Count: 2}, type2G: {Count: 0}},
+			expectedYAML: "XGV_V0_1G_1_CORE: 2\nXGV_V0_2G_1_CORE: 0\n",
+			expectedJSON: `{"XGV_V0_1G_1_CORE":2,"XGV_V0_2G_1_CORE":0}`,
+		},
+		{
+			description:  "max",
+			counts:       VGPUDeviceCounts{type1G: {Percent: 100}},
+			expectedYAML: "XGV_V0_1G_1_CORE: max\n",
+			expectedJSON: `{"XGV_V0_1G_1_CORE":"max"}`,
+		},
+		{
+			description:  "percentage",
+			counts:       VGPUDeviceCounts{type1G: {Percent: 50}},
+			expectedYAML: "XGV_V0_1G_1_CORE: 50%\n",
+			expectedJSON: `{"XGV_V0_1G_1_CORE":"50%"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			data, err := yaml.Marshal(tc.counts)
+			if err != nil {
+				t.Fatalf("unexpected error marshalling YAML: %v", err)
+			}
+			if string(data) != tc.expectedYAML {
+				t.Errorf("expected YAML %q, got %q", tc.expectedYAML, data)
+			}
+			var fromYAML VGPUDeviceCounts
+			if err := yaml.Unmarshal(data, &fromYAML); err != nil {
+				t.Fatalf("unexpected error unmarshalling YAML: %v", err)
+			}
+			checkVGPUDeviceCounts(t, tc.counts, fromYAML)
+
+			data, err = json.Marshal(tc.counts)
+			if err != nil {
+				t.Fatalf("unexpected error marshalling JSON: %v", err)
+			}
+			if string(data) != tc.expectedJSON {
+				t.Errorf("expected JSON %s, got %s", tc.expectedJSON, data)
+			}
+			var fromJSON VGPUDeviceCounts
+			if err := json.Unmarshal(data, &fromJSON); err != nil {
+				t.Fatalf("unexpected error unmarshalling JSON: %v", err)
+			}
+			checkVGPUDeviceCounts(t, tc.counts, fromJSON)
+		})
+	}
+}
+
+func checkVGPUDeviceCounts(t *testing.T, expected VGPUDeviceCounts, actual VGPUDeviceCounts) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+		return
+	}
+	for mdevType, count := range expected {
+		if actual[mdevType] != count {
+			t.Errorf("expected %v, got %v", expected, actual)
+			return
+		}
+	}
+}
+
+func TestVGPUDeviceCountResolve(t *testing.T) {
+	testCases := []struct {
+		count    VGPUDeviceCount
+		max      int
+		expected int
+	}{
+		{VGPUDeviceCount{Count: 2}, 8, 2},
+		// Fixed numbers are not capped, the layout check rejects them
+		{VGPUDeviceCount{Count: 10}, 8, 10},
+		{VGPUDeviceCount{Percent: 100}, 7, 7},
+		{VGPUDeviceCount{Percent: 50}, 8, 4},
+		// Rounded down
+		{VGPUDeviceCount{Percent: 50}, 3, 1},
+		{VGPUDeviceCount{Percent: 33}, 10, 3},
+		{VGPUDeviceCount{Percent: 99}, 10, 9},
+		{VGPUDeviceCount{Percent: 1}, 50, 0},
+		{VGPUDeviceCount{Percent: 50}, 0, 0},
+	}
+
+	for _, tc := range testCases {
+		if resolved := tc.count.Resolve(tc.max); resolved != tc.expected {
+			t.Errorf("expected %v of %d to resolve to %d, got %d", tc.count, tc.max, tc.expected, resolved)
+		}
+	}
+}
+
+func TestVGPUDeviceCountsResolve(t *testing.T) {
+	gpu := &types.GPUInventory{
+		MDEVTypes: []types.MDEVTypeInventory{
+			{Name: type1G, AvailableInstances: 3},
+			{Name: type2G, AvailableInstances: 1},
+		},
+		VGPUDevices: []types.VGPUDevice{
+			{Type: type1G},
+		},
+	}
+
+	testCases := []struct {
+		description      string
+		counts           VGPUDeviceCounts
+		expected         types.VGPUConfig
+		expectedResolved bool
+	}{
+		{
+			description:      "fixed numbers",
+			counts:           VGPUDeviceCounts{type1G: {Count: 1}, type2G: {Count: 1}},
+			expected:         types.VGPUConfig{type1G: 1, type2G: 1},
+			expectedResolved: true,
+		},
+		{
+			description:      "existing devices of the type count as available",
+			counts:           VGPUDeviceCounts{type1G: {Percent: 100}},
+			expected:         types.VGPUConfig{type1G: 4},
+			expectedResolved: true,
+		},
+		{
+			description:      "percentage rounded down",
+			counts:           VGPUDeviceCounts{type1G: {Percent: 60}},
+			expected:         types.VGPUConfig{type1G: 2},
+			expectedResolved: true,
+		},
+		{
+			description: "existing devices of another type",
+			counts:      VGPUDeviceCounts{type2G: {Percent: 100}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			config, resolved := tc.counts.Resolve(gpu)
+			if resolved != tc.expectedResolved {
+				t.Fatalf("expected resolved %v, got %v", tc.expectedResolved, resolved)
+			}
+			if resolved && !config.Equals(tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, config)
+			}
+		})
+	}
+}
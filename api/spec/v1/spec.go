@@ -0,0 +1,223 @@
+package v1
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/uuid"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+type Spec struct {
+	Version string `json:"version" yaml:"version"`
+	// Include lists other config files whose vgpu-configs are added to this one,
+	// relative to the directory of this file
+	Include     Includes                       `json:"include,omitempty" yaml:"include,omitempty"`
+	VGPUConfigs map[string]VGPUConfigSpecSlice `json:"vgpu-configs,omitempty" yaml:"vgpu-configs,omitempty"`
+}
+
+// Includes is a list of config files, it can be given as a single file as well
+type Includes []string
+
+// UnmarshalYAML accepts a single file or a list of files
+func (i *Includes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var file string
+	if err := unmarshal(&file); err == nil {
+		*i = Includes{file}
+		return nil
+	}
+	var files []string
+	if err := unmarshal(&files); err != nil {
+		return fmt.Errorf("include must be a file or a list of files: %v", err)
+	}
+	*i = files
+	return nil
+}
+
+// VGPUConfigSpec is an entry of a named config. An entry with 'extends' set stands for all
+// entries of the named config it references. Entries take precedence over the entries before
+// them for the GPUs they match, so entries after an 'extends' override the inherited ones.
+type VGPUConfigSpec struct {
+	Extends      string           `json:"extends,omitempty" yaml:"extends,omitempty"`
+	DeviceFilter interface{}      `json:"device-filter,omitempty" yaml:"device-filter,omitempty"`
+	Devices      interface{}      `json:"devices" yaml:"devices,flow"`
+	VGPUDevices  VGPUDeviceCounts `json:"vgpu-devices" yaml:"vgpu-devices"`
+	// VGPUDeviceUUIDs pins the UUIDs of the vGPU devices of each type, in creation order
+	VGPUDeviceUUIDs map[string][]string `json:"vgpu-device-uuids,omitempty" yaml:"vgpu-device-uuids,omitempty"`
+}
+
+type VGPUConfigSpecSlice []VGPUConfigSpec
+
+// deviceFilter returns the device IDs of the device-filter of the entry, nil if it has none
+func (vc *VGPUConfigSpec) deviceFilter() ([]types.DeviceID, error) {
+	var filters []string
+	switch filter := vc.DeviceFilter.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		filters = []string{filter}
+	case []interface{}:
+		for _, f := range filter {
+			str, ok := f.(string)
+			if !ok {
+				return nil, fmt.Errorf("device-filter must be a device ID or a list of device IDs, got: %v", vc.DeviceFilter)
+			}
+			filters = append(filters, str)
+		}
+	default:
+		return nil, fmt.Errorf("device-filter must be a device ID or a list of device IDs, got: %v", vc.DeviceFilter)
+	}
+
+	var deviceIDs []types.DeviceID
+	for _, f := range filters {
+		deviceID, err := types.NewDeviceIDFromString(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device-filter: %v", err)
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	return deviceIDs, nil
+}
+
+// ValidateDeviceFilter checks that the device-filter of the entry holds valid device IDs
+func (vc *VGPUConfigSpec) ValidateDeviceFilter() error {
+	_, err := vc.deviceFilter()
+	return err
+}
+
+// MatchDeviceFilter checks if 'deviceID' is one of the device IDs of the device-filter of
+// the entry. Entries without a device-filter match every device, entries with an invalid
+// one match none.
+func (vc *VGPUConfigSpec) MatchDeviceFilter(deviceID types.DeviceID) bool {
+	if vc.DeviceFilter == nil {
+		return true
+	}
+	deviceIDs, err := vc.deviceFilter()
+	if err != nil {
+		return false
+	}
+	for _, id := range deviceIDs {
+		if id == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+func (vc *VGPUConfigSpec) MatchAllDevices() bool {
+	switch devices := vc.Devices.(type) {
+	case string:
+		return devices == "all"
+	}
+	return false
+}
+
+func (vc *VGPUConfigSpec) MatchDevices(index int) bool {
+	switch devices := vc.Devices.(type) {
+	case []interface{}:
+		for _, d := range devices {
+			if i, ok := deviceIndex(d); ok && i == index {
+				return true
+			}
+		}
+	}
+	return vc.MatchAllDevices()
+}
+
+// deviceIndex returns the GPU index an item of 'devices' stands for. Indices decoded
+// from JSON into an interface{}, e.g. those of a 'VGPUNodeConfig', are float64.
+func deviceIndex(d interface{}) (int, bool) {
+	switch d := d.(type) {
+	case int:
+		return d, true
+	case float64:
+		if d == math.Trunc(d) {
+			return int(d), true
+		}
+	}
+	return 0, false
+}
+
+// ValidateUUIDs checks that the pinned UUIDs are valid, unique and match the vGPU devices.
+// Pinned UUIDs are only allowed on entries selecting a single device, since the same UUID
+// cannot be used on several GPUs.
+func (vc *VGPUConfigSpec) ValidateUUIDs() error {
+	if len(vc.VGPUDeviceUUIDs) == 0 {
+		return nil
+	}
+	devices, isList := vc.Devices.([]interface{})
+	if !isList || len(devices) != 1 {
+		return fmt.Errorf("vgpu-device-uuids requires devices to select a single GPU, got: %v", vc.Devices)
+	}
+
+	seen := make(map[string]bool)
+	for mdevType, uuids := range vc.VGPUDeviceUUIDs {
+		count := vc.VGPUDevices[mdevType]
+		if !count.IsRelative() && len(uuids) > count.Count {
+			return fmt.Errorf("%d UUIDs pinned for %d %s vGPU devices", len(uuids), count.Count, mdevType)
+		}
+		for _, u := range uuids {
+			if _, err := uuid.Parse(u); err != nil {
+				return fmt.Errorf("invalid UUID %s for %s: %v", u, mdevType, err)
+			}
+			if seen[u] {
+				return fmt.Errorf("duplicate UUID %s", u)
+			}
+			seen[u] = true
+		}
+	}
+	return nil
+}
+
+// ComposeVGPUConfig composes the effective config of a node with 'numGPUs' GPUs: GPUs with an
+// entry in 'gpuConfigs' get the entries of the named config matching them, all other GPUs get
+// the entries of the 'base' config. An empty 'base' leaves the other GPUs untouched.
+func (s *Spec) ComposeVGPUConfig(base string, gpuConfigs map[int]string, numGPUs int) (VGPUConfigSpecSlice, error) {
+	for index, name := range gpuConfigs {
+		if index < 0 || index >= numGPUs {
+			return nil, fmt.Errorf("invalid GPU index %d for vgpu-config %s: node has %d GPUs", index, name, numGPUs)
+		}
+		if _, exists := s.VGPUConfigs[name]; !exists {
+			return nil, fmt.Errorf("vgpu-config not present for GPU %d: %s", index, name)
+		}
+	}
+	if base != "" {
+		if _, exists := s.VGPUConfigs[base]; !exists {
+			return nil, fmt.Errorf("vgpu-config not present: %s", base)
+		}
+	}
+
+	var composed VGPUConfigSpecSlice
+	for _, vc := range s.VGPUConfigs[base] {
+		var devices []interface{}
+		for i := 0; i < numGPUs; i++ {
+			if _, overridden := gpuConfigs[i]; !overridden && vc.MatchDevices(i) {
+				devices = append(devices, i)
+			}
+		}
+		if len(devices) > 0 {
+			vc.Devices = devices
+			composed = append(composed, vc)
+		}
+	}
+
+	for i := 0; i < numGPUs; i++ {
+		name, overridden := gpuConfigs[i]
+		if !overridden {
+			continue
+		}
+		matched := false
+		for _, vc := range s.VGPUConfigs[name] {
+			if vc.MatchDevices(i) {
+				vc.Devices = []interface{}{i}
+				composed = append(composed, vc)
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("vgpu-config %s has no entry for GPU %d", name, i)
+		}
+	}
+	return composed, nil
+}
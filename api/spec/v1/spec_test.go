@@ -0,0 +1,131 @@
+package v1
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestComposeVGPUConfig(t *testing.T) {
+	spec := &Spec{
+		Version: "v1",
+		VGPUConfigs: map[string]VGPUConfigSpecSlice{
+			"all-1G": {
+				{Devices: "all", VGPUDevices: VGPUDeviceCounts{type1G: {Count: 2}}},
+			},
+			"all-2G": {
+				{Devices: "all", VGPUDevices: VGPUDeviceCounts{type2G: {Count: 1}}},
+			},
+			"mixed": {
+				{Devices: []interface{}{0, 1}, VGPUDevices: VGPUDeviceCounts{type1G: {Count: 2}}},
+				{Devices: []interface{}{2}, VGPUDevices: VGPUDeviceCounts{type2G: {Count: 1}}},
+			},
+			"gpu-0-only": {
+				{Devices: []interface{}{0}, VGPUDevices: VGPUDeviceCounts{type2G: {Count: 1}}},
+			},
+		},
+	}
+
+	testCases := []struct {
+		description string
+		base        string
+		gpuConfigs  map[int]string
+		expected    VGPUConfigSpecSlice
+		expectedErr bool
+	}{
+		{
+			description: "base only",
+			base:        "all-1G",
+			expected: VGPUConfigSpecSlice{
+				{Devices: []interface{}{0, 1, 2}, VGPUDevices: VGPUDeviceCounts{type1G: {Count: 2}}},
+			},
+		},
+		{
+			description: "base 'devices: all' narrowed to the GPUs not overridden",
+			base:        "all-1G",
+			gpuConfigs:  map[int]string{1: "all-2G"},
+			expected: VGPUConfigSpecSlice{
+				{Devices: []interface{}{0, 2}, VGPUDevices: VGPUDeviceCounts{type1G: {Count: 2}}},
+				{Devices: []interface{}{1}, VGPUDevices: VGPUDeviceCounts{type2G: {Count: 1}}},
+			},
+		},
+		{
+			description: "base entries without remaining GPUs are dropped",
+			base:        "mixed",
+			gpuConfigs:  map[int]string{2: "all-1G"},
+			expected: VGPUConfigSpecSlice{
+				{Devices: []interface{}{0, 1}, VGPUDevices: VGPUDeviceCounts{type1G: {Count: 2}}},
+				{Devices: []interface{}{2}, VGPUDevices: VGPUDeviceCounts{type1G: {Count: 2}}},
+			},
+		},
+		{
+			description: "override picks the entries matching the GPU",
+			base:        "all-1G",
+			gpuConfigs:  map[int]string{0: "mixed", 2: "mixed"},
+			expected: VGPUConfigSpecSlice{
+				{Devices: []interface{}{1}, VGPUDevices: VGPUDeviceCounts{type1G: {Count: 2}}},
+				{Devices: []interface{}{0}, VGPUDevices: VGPUDeviceCounts{type1G: {Count: 2}}},
+				{Devices: []interface{}{2}, VGPUDevices: VGPUDeviceCounts{type2G: {Count: 1}}},
+			},
+		},
+		{
+			description: "no base leaves the other GPUs untouched",
+			gpuConfigs:  map[int]string{1: "all-2G"},
+			expected: VGPUConfigSpecSlice{
+				{Devices: []interface{}{1}, VGPUDevices: VGPUDeviceCounts{type2G: {Count: 1}}},
+			},
+		},
+		{
+			description: "out of range index",
+			base:        "all-1G",
+			gpuConfigs:  map[int]string{3: "all-2G"},
+			expectedErr: true,
+		},
+		{
+			description: "negative index",
+			base:        "all-1G",
+			gpuConfigs:  map[int]string{-1: "all-2G"},
+			expectedErr: true,
+		},
+		{
+			description: "unknown config for a GPU",
+			base:        "all-1G",
+			gpuConfigs:  map[int]string{0: "unknown"},
+			expectedErr: true,
+		},
+		{
+			description: "unknown base config",
+			base:        "unknown",
+			gpuConfigs:  map[int]string{0: "all-2G"},
+			expectedErr: true,
+		},
+		{
+			description: "override config without an entry for the GPU",
+			base:        "all-1G",
+			gpuConfigs:  map[int]string{1: "gpu-0-only"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			composed, err := spec.ComposeVGPUConfig(tc.base, tc.gpuConfigs, 3)
+			if tc.expectedErr {
+				if err == nil {
+					t.Errorf("expected error, got %v", composed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(composed, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, composed)
+			}
+		})
+	}
+
+	// The entries of the spec are not modified
+	if devices := spec.VGPUConfigs["all-1G"][0].Devices; devices != "all" {
+		t.Errorf("expected base entry to keep 'devices: all', got %v", devices)
+	}
+}
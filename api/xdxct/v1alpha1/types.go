@@ -0,0 +1,95 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "github.com/chen-mao/xdxct-vgpu-device-manager/api/spec/v1"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+const (
+	Group    = "xdxct.com"
+	Version  = "v1alpha1"
+	Kind     = "VGPUNodeConfig"
+	Resource = "vgpunodeconfigs"
+)
+
+// Node states reported in the status of a 'VGPUNodeConfig'
+const (
+	NodeStateApplied = "applied"
+	NodeStateFailed  = "failed"
+)
+
+// Reasons reported in the status of a 'VGPUNodeConfig' for a node in the failed state
+const (
+	NodeReasonGPUNotFound          = "GPUNotFound"
+	NodeReasonTypeUnsupported      = "TypeUnsupported"
+	NodeReasonInsufficientCapacity = "InsufficientCapacity"
+	NodeReasonDeviceBusy           = "DeviceBusy"
+	NodeReasonPermissionDenied     = "PermissionDenied"
+	NodeReasonConfigInvalid        = "ConfigInvalid"
+	NodeReasonUnknownConfig        = "UnknownConfig"
+	NodeReasonTimeout              = "Timeout"
+	NodeReasonConflict             = "Conflict"
+	NodeReasonApplyFailed          = "ApplyFailed"
+)
+
+// VGPUNodeConfig is a cluster scoped resource holding the vGPU device
+// configurations for all nodes matched by its node selector
+type VGPUNodeConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VGPUNodeConfigSpec   `json:"spec"`
+	Status VGPUNodeConfigStatus `json:"status,omitempty"`
+}
+
+// VGPUNodeConfigList is a list of 'VGPUNodeConfig' resources
+type VGPUNodeConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []VGPUNodeConfig `json:"items"`
+}
+
+// VGPUNodeConfigSpec embeds the config file schema ('version' and
+// 'vgpu-configs') together with the nodes it applies to
+type VGPUNodeConfigSpec struct {
+	NodeSelector      *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+	DefaultVGPUConfig string                `json:"defaultVGPUConfig,omitempty"`
+	v1.Spec           `json:",inline"`
+}
+
+// VGPUNodeConfigStatus reports the result of the last apply on every node
+type VGPUNodeConfigStatus struct {
+	Nodes []NodeStatus `json:"nodes,omitempty"`
+}
+
+// NodeStatus is the state of a single node selected by a 'VGPUNodeConfig'
+type NodeStatus struct {
+	Name           string      `json:"name"`
+	VGPUConfig     string      `json:"vgpuConfig"`
+	State          string      `json:"state"`
+	Reason         string      `json:"reason,omitempty"`
+	Message        string      `json:"message,omitempty"`
+	LastUpdateTime metav1.Time `json:"lastUpdateTime"`
+	GPUs           []GPUStatus `json:"gpus,omitempty"`
+}
+
+// GPUStatus is the vGPU inventory of a single GPU on a node
+type GPUStatus struct {
+	Index       int              `json:"index"`
+	Address     string           `json:"address"`
+	VGPUDevices types.VGPUConfig `json:"vgpuDevices,omitempty"`
+}
+
+// SetNodeStatus adds or replaces the status entry for 'status.Name'
+func (s *VGPUNodeConfigStatus) SetNodeStatus(status NodeStatus) {
+	for i := range s.Nodes {
+		if s.Nodes[i].Name == status.Name {
+			s.Nodes[i] = status
+			return
+		}
+	}
+	s.Nodes = append(s.Nodes, status)
+}
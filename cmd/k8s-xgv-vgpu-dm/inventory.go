@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+const (
+	inventoryConfigMapPrefix = "xdxct-vgpu-inventory-"
+	inventoryLabel           = "xdxct.com/vgpu-inventory"
+	inventoryNodeLabel       = "xdxct.com/vgpu-inventory.node"
+	inventoryDataKey         = "inventory.json"
+)
+
+// nodeInventory is the content of the inventory configmap of a node
+type nodeInventory struct {
+	Node           string               `json:"node"`
+	VGPUConfig     string               `json:"vgpuConfig,omitempty"`
+	LastUpdateTime metav1.Time          `json:"lastUpdateTime"`
+	GPUs           []types.GPUInventory `json:"gpus"`
+}
+
+// inventoryReporter publishes the vGPU inventory of the node to a configmap
+type inventoryReporter struct {
+	sync.Mutex
+	clientset  kubernetes.Interface
+	opts       []vgpu.Option
+	vgpuConfig string
+}
+
+func newInventoryReporter(clientset kubernetes.Interface, opts ...vgpu.Option) *inventoryReporter {
+	return &inventoryReporter{
+		clientset: clientset,
+		opts:      opts,
+	}
+}
+
+// Update records the vGPU config applied to the node and publishes the inventory
+func (r *inventoryReporter) Update(selectedConfig string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.vgpuConfig = selectedConfig
+	return r.publish()
+}
+
+// Refresh publishes the inventory for the last applied vGPU config
+func (r *inventoryReporter) Refresh() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.publish()
+}
+
+// publish writes the current vGPU inventory of the node to its configmap
+// in the namespace of the GPU components, creating it if needed
+func (r *inventoryReporter) publish() error {
+	gpus, err := vgpu.GetInventory(r.opts...)
+	if err != nil {
+		return fmt.Errorf("unable to get vGPU inventory: %v", err)
+	}
+	data, err := json.MarshalIndent(nodeInventory{
+		Node:           nodeNameFlag,
+		VGPUConfig:     r.vgpuConfig,
+		LastUpdateTime: metav1.Now(),
+		GPUs:           gpus,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode vGPU inventory: %v", err)
+	}
+
+	node, err := getNode(r.clientset)
+	if err != nil {
+		return err
+	}
+
+	configMaps := r.clientset.CoreV1().ConfigMaps(namespaceFlag)
+	name := inventoryConfigMapPrefix + nodeNameFlag
+	configMap, err := configMaps.Get(context.TODO(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespaceFlag,
+				Labels: map[string]string{
+					inventoryLabel:     "true",
+					inventoryNodeLabel: nodeNameFlag,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: "v1",
+						Kind:       "Node",
+						Name:       node.Name,
+						UID:        node.UID,
+					},
+				},
+			},
+			Data: map[string]string{
+				inventoryDataKey: string(data),
+			},
+		}
+		_, err = configMaps.Create(context.TODO(), configMap, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to create configmap %s: %v", name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get configmap %s: %v", name, err)
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[inventoryDataKey] = string(data)
+	_, err = configMaps.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to update configmap %s: %v", name, err)
+	}
+	return nil
+}
+
+// getUsedMDEVTypes returns the mdev types of the vGPU devices on all nodes, read from
+// their inventory configmaps
+func getUsedMDEVTypes(ctx context.Context, clientset kubernetes.Interface) (map[string]bool, error) {
+	configMaps, err := clientset.CoreV1().ConfigMaps(namespaceFlag).List(ctx, metav1.ListOptions{
+		LabelSelector: inventoryLabel + "=true",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list inventory configmaps: %v", err)
+	}
+	mdevTypes := make(map[string]bool)
+	for _, configMap := range configMaps.Items {
+		var inventory nodeInventory
+		if err := json.Unmarshal([]byte(configMap.Data[inventoryDataKey]), &inventory); err != nil {
+			return nil, fmt.Errorf("unable to decode configmap %s: %v", configMap.Name, err)
+		}
+		for _, gpu := range inventory.GPUs {
+			for _, device := range gpu.VGPUDevices {
+				mdevTypes[device.Type] = true
+			}
+		}
+	}
+	return mdevTypes, nil
+}
+
+// refreshInventoryPeriodically keeps the inventory configmap of the node up to date
+// with changes made outside of the daemon
+func refreshInventoryPeriodically(inventory *inventoryReporter, interval time.Duration) chan struct{} {
+	stopch := make(chan struct{})
+	if interval <= 0 {
+		return stopch
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stopch:
+				return
+			}
+			err := inventory.Refresh()
+			if err != nil {
+				log.Warnf("Unable to refresh vGPU inventory: %v", err)
+			}
+		}
+	}()
+	return stopch
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib/fakesysfs"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+// newTestInventoryReporter returns a reporter for the node 'node-a' with one fake GPU,
+// publishing to a fake clientset holding the node and 'objects'
+func newTestInventoryReporter(t *testing.T, objects ...corev1.ConfigMap) (*inventoryReporter, *fake.Clientset, *fakesysfs.Sysfs) {
+	t.Helper()
+	nodeNameFlag = "node-a"
+	namespaceFlag = "xdxct"
+
+	fs, err := fakesysfs.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("unable to create fake sysfs: %v", err)
+	}
+	if err := fs.AddGPU(fakesysfs.NewTestGPU("0000:01:00.0")); err != nil {
+		t.Fatalf("unable to add GPU: %v", err)
+	}
+
+	clientset := fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-a", UID: "7c6b5a49-3827-4165-9a0b-1c2d3e4f5a6b"},
+	})
+	for i := range objects {
+		_, err := clientset.CoreV1().ConfigMaps(objects[i].Namespace).Create(context.TODO(), &objects[i], metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	clientset.ClearActions()
+	return newInventoryReporter(clientset, vgpu.WithXdxlib(fs.Interface())), clientset, fs
+}
+
+// getInventoryConfigMap returns the inventory configmap of 'node-a' and its decoded inventory
+func getInventoryConfigMap(t *testing.T, clientset *fake.Clientset) (*corev1.ConfigMap, nodeInventory) {
+	t.Helper()
+	configMap, err := clientset.CoreV1().ConfigMaps("xdxct").Get(context.TODO(), "xdxct-vgpu-inventory-node-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var inventory nodeInventory
+	if err := json.Unmarshal([]byte(configMap.Data[inventoryDataKey]), &inventory); err != nil {
+		t.Fatalf("unable to decode inventory: %v", err)
+	}
+	return configMap, inventory
+}
+
+// verbs returns the verbs of the actions writing configmaps
+func verbs(clientset *fake.Clientset) []string {
+	var verbs []string
+	for _, action := range clientset.Actions() {
+		if action.GetResource().Resource == "configmaps" && action.GetVerb() != "get" && action.GetVerb() != "list" {
+			verbs = append(verbs, action.GetVerb())
+		}
+	}
+	return verbs
+}
+
+func TestInventoryReporterCreate(t *testing.T) {
+	reporter, clientset, fs := newTestInventoryReporter(t)
+
+	if err := reporter.Update("all-1G"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	configMap, inventory := getInventoryConfigMap(t, clientset)
+	if configMap.Labels[inventoryLabel] != "true" || configMap.Labels[inventoryNodeLabel] != "node-a" {
+		t.Errorf("expected inventory labels, got %v", configMap.Labels)
+	}
+	expectedOwner := metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Node",
+		Name:       "node-a",
+		UID:        "7c6b5a49-3827-4165-9a0b-1c2d3e4f5a6b",
+	}
+	if len(configMap.OwnerReferences) != 1 || configMap.OwnerReferences[0] != expectedOwner {
+		t.Errorf("expected owner reference %v, got %v", expectedOwner, configMap.OwnerReferences)
+	}
+	if inventory.Node != "node-a" || inventory.VGPUConfig != "all-1G" || len(inventory.GPUs) != 1 {
+		t.Errorf("expected inventory of node-a with 1 GPU and config all-1G, got %v", inventory)
+	}
+
+	// A refresh updates the configmap with the devices created since, for the same config
+	configManager := vgpu.NewXdxlibVGPUConfigManager(vgpu.WithXdxlib(fs.Interface()))
+	if err := configManager.SetVGPUConfig(0, types.VGPUConfig{fakesysfs.TestType1G: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := reporter.Refresh(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, inventory = getInventoryConfigMap(t, clientset)
+	if inventory.VGPUConfig != "all-1G" || len(inventory.GPUs) != 1 || len(inventory.GPUs[0].VGPUDevices) != 2 {
+		t.Errorf("expected inventory with 2 vGPU devices and config all-1G, got %v", inventory)
+	}
+
+	expectedVerbs := []string{"create", "update"}
+	if actual := verbs(clientset); !slices.Equal(actual, expectedVerbs) {
+		t.Errorf("expected configmap actions %v, got %v", expectedVerbs, actual)
+	}
+
+	usedTypes, err := getUsedMDEVTypes(context.TODO(), clientset)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(usedTypes) != 1 || !usedTypes[fakesysfs.TestType1G] {
+		t.Errorf("expected used mdev types %s, got %v", fakesysfs.TestType1G, usedTypes)
+	}
+}
+
+func TestInventoryReporterUpdate(t *testing.T) {
+	// The configmap of a previous run of the daemon, with a key of someone else
+	existing := corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "xdxct-vgpu-inventory-node-a",
+			Namespace: "xdxct",
+			Labels: map[string]string{
+				inventoryLabel:     "true",
+				inventoryNodeLabel: "node-a",
+			},
+		},
+		Data: map[string]string{
+			inventoryDataKey: `{"node":"node-a","vgpuConfig":"all-2G","lastUpdateTime":null,"gpus":[]}`,
+			"note":           "kept",
+		},
+	}
+	reporter, clientset, _ := newTestInventoryReporter(t, existing)
+
+	if err := reporter.Update("all-1G"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	configMap, inventory := getInventoryConfigMap(t, clientset)
+	if inventory.VGPUConfig != "all-1G" || len(inventory.GPUs) != 1 {
+		t.Errorf("expected inventory with 1 GPU and config all-1G, got %v", inventory)
+	}
+	if configMap.Data["note"] != "kept" {
+		t.Errorf("expected other keys to be kept, got %v", configMap.Data)
+	}
+	if actual := verbs(clientset); !slices.Equal(actual, []string{"update"}) {
+		t.Errorf("expected the existing configmap to be updated, got actions %v", actual)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/kubevirt"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+// kubeVirtClient reads and patches the KubeVirt CR through the raw REST client
+type kubeVirtClient struct {
+	rest      rest.Interface
+	namespace string
+}
+
+func newKubeVirtClient(clientset *kubernetes.Clientset, namespace string) *kubeVirtClient {
+	return &kubeVirtClient{
+		rest:      clientset.CoreV1().RESTClient(),
+		namespace: namespace,
+	}
+}
+
+func (c *kubeVirtClient) path(segments ...string) string {
+	return path.Join(append([]string{"/apis", kubevirt.Group, kubevirt.Version, "namespaces", c.namespace, kubevirt.Resource}, segments...)...)
+}
+
+// get returns the KubeVirt CR of the namespace, there is only one per cluster
+func (c *kubeVirtClient) get(ctx context.Context) (*kubevirt.KubeVirt, error) {
+	raw, err := c.rest.Get().AbsPath(c.path()).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var list kubevirt.KubeVirtList
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("unable to decode KubeVirt list: %v", err)
+	}
+	if len(list.Items) == 0 {
+		return nil, fmt.Errorf("no KubeVirt found in namespace %s", c.namespace)
+	}
+	return &list.Items[0], nil
+}
+
+func (c *kubeVirtClient) patch(ctx context.Context, name string, data []byte) error {
+	_, err := c.rest.Patch(k8stypes.MergePatchType).
+		AbsPath(c.path(name)).
+		Body(data).
+		DoRaw(ctx)
+	return err
+}
+
+// permitMediatedDevices makes the devices, and the entries of the mdev types in use on
+// other nodes, the permitted host devices of the KubeVirt CR with the resource prefix,
+// retrying on conflicts with the daemons of other nodes patching the same object
+func (c *kubeVirtClient) permitMediatedDevices(ctx context.Context, devices []kubevirt.MediatedDevice, usedTypes map[string]bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		kv, err := c.get(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to get KubeVirt: %w", err)
+		}
+		existing := kv.GetMediatedDevices()
+		permitted := keepUsedMediatedDevices(existing, devices, usedTypes)
+		merged, changed := kubevirt.MergeMediatedDevices(existing, permitted, resourcePrefixFlag)
+		if !changed {
+			return nil
+		}
+		data, err := kubevirt.NewMergePatch(merged, kv.Metadata.ResourceVersion)
+		if err != nil {
+			return err
+		}
+		log.Infof("Permitting mediated devices in KubeVirt %s: %v", kv.Metadata.Name, merged)
+		err = c.patch(ctx, kv.Metadata.Name, data)
+		if err != nil {
+			return fmt.Errorf("unable to patch KubeVirt: %w", err)
+		}
+		return nil
+	})
+}
+
+// keepUsedMediatedDevices adds the existing entries with the resource prefix of the mdev
+// types in use on other nodes to the devices, sorted by resource name. Their mdev names
+// are only known on those nodes, so their entries are kept as they are.
+func keepUsedMediatedDevices(existing []kubevirt.MediatedDevice, devices []kubevirt.MediatedDevice, usedTypes map[string]bool) []kubevirt.MediatedDevice {
+	permitted := append([]kubevirt.MediatedDevice{}, devices...)
+	generated := make(map[string]bool)
+	for _, device := range devices {
+		generated[device.ResourceName] = true
+	}
+	for _, device := range existing {
+		mdevType, owned := kubevirt.ResourceMDEVType(resourcePrefixFlag, device.ResourceName)
+		if !owned || !usedTypes[mdevType] || generated[device.ResourceName] {
+			continue
+		}
+		device.ExternalResourceProvider = true
+		generated[device.ResourceName] = true
+		permitted = append(permitted, device)
+	}
+	sort.Slice(permitted, func(i, j int) bool {
+		return permitted[i].ResourceName < permitted[j].ResourceName
+	})
+	return permitted
+}
+
+// updateKubeVirt permits the types of the vGPU devices on the node in the KubeVirt CR and
+// removes the entries of types no longer in use on any node, as published in the inventory
+// configmaps of the nodes
+func updateKubeVirt(ctx context.Context, clientset kubernetes.Interface, kubeVirt *kubeVirtClient) error {
+	inventory, err := vgpu.GetInventory()
+	if err != nil {
+		return fmt.Errorf("unable to get vGPU inventory: %v", err)
+	}
+	var mdevTypes []string
+	for _, gpu := range inventory {
+		for _, device := range gpu.VGPUDevices {
+			mdevTypes = append(mdevTypes, device.Type)
+		}
+	}
+
+	names, err := vgpu.GetMDEVTypeNames()
+	if err != nil {
+		return fmt.Errorf("unable to get mdev type names: %v", err)
+	}
+	devices, err := kubevirt.NewMediatedDevices(mdevTypes, names, resourcePrefixFlag)
+	if err != nil {
+		return err
+	}
+	usedTypes, err := getUsedMDEVTypes(ctx, clientset)
+	if err != nil {
+		return err
+	}
+	return kubeVirt.permitMediatedDevices(ctx, devices, usedTypes)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/kubevirt"
+)
+
+func TestKeepUsedMediatedDevices(t *testing.T) {
+	resourcePrefixFlag = kubevirt.DefaultResourcePrefix
+
+	device1G := kubevirt.MediatedDevice{MDEVNameSelector: "XGV 1G", ResourceName: "xdxct.com/XGV_V0_1G_1_CORE", ExternalResourceProvider: true}
+	device2G := kubevirt.MediatedDevice{MDEVNameSelector: "XGV 2G", ResourceName: "xdxct.com/XGV_V0_2G_1_CORE", ExternalResourceProvider: true}
+	existing := []kubevirt.MediatedDevice{
+		{MDEVNameSelector: "XGV 2G", ResourceName: "xdxct.com/XGV_V0_2G_1_CORE"},
+		{MDEVNameSelector: "XGV 4G", ResourceName: "xdxct.com/XGV_V0_4G_1_CORE", ExternalResourceProvider: true},
+		{MDEVNameSelector: "XGV 1G", ResourceName: "xdxct.com/XGV_V0_1G_1_CORE", ExternalResourceProvider: true},
+		{MDEVNameSelector: "GRID T4-1Q", ResourceName: "nvidia.com/GRID_T4-1Q"},
+	}
+	// The 1G devices are on this node, the 2G ones on another node and the 4G ones on none
+	usedTypes := map[string]bool{
+		"XGV_V0_1G_1_CORE": true,
+		"XGV_V0_2G_1_CORE": true,
+		"GRID_T4-1Q":       true,
+	}
+
+	permitted := keepUsedMediatedDevices(existing, []kubevirt.MediatedDevice{device1G}, usedTypes)
+	expected := []kubevirt.MediatedDevice{device1G, device2G}
+	if !reflect.DeepEqual(permitted, expected) {
+		t.Errorf("expected %v, got %v", expected, permitted)
+	}
+}
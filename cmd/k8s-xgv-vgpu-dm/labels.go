@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+
+	v1 "github.com/chen-mao/xdxct-vgpu-device-manager/api/spec/v1"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+const (
+	gpuCountLabel                  = "xdxct.com/gpu.count"
+	gpuDeviceIDLabel               = "xdxct.com/gpu.device-id"
+	vGPUTypesLabel                 = "xdxct.com/vgpu.types"
+	vGPUConfigAvailableLabel       = "xdxct.com/vgpu.config.available"
+	vGPUTypeLabelPrefix            = "xdxct.com/vgpu.type."
+	vGPUConfigAvailableLabelPrefix = "xdxct.com/vgpu.config.available."
+)
+
+// capabilityLabels and capabilityLabelPrefixes are the labels owned by the labeler,
+// those that are no longer computed are removed from the node. Other labels in the
+// xdxct.com domain, e.g. set by other components, are left alone.
+var (
+	capabilityLabels = map[string]bool{
+		gpuCountLabel:            true,
+		gpuDeviceIDLabel:         true,
+		vGPUTypesLabel:           true,
+		vGPUConfigAvailableLabel: true,
+	}
+	capabilityLabelPrefixes = []string{
+		vGPUTypeLabelPrefix,
+		vGPUConfigAvailableLabelPrefix,
+	}
+)
+
+// getCapabilityLabels computes the labels describing the XDXCT GPUs of the node, the
+// vGPU types they support and the named configs from 'spec' that can be applied.
+// The lists are joined with '.' and additionally exposed as one label per item, so
+// that they can be used in node selectors.
+func getCapabilityLabels(inventory []types.GPUInventory, spec *v1.Spec) map[string]string {
+	labels := map[string]string{
+		gpuCountLabel: strconv.Itoa(len(inventory)),
+	}
+	if len(inventory) == 0 {
+		return labels
+	}
+
+	deviceIDs := map[string]bool{}
+	vGPUTypes := map[string]bool{}
+	for _, gpu := range inventory {
+		deviceIDs[gpu.Device] = true
+		for _, t := range gpu.MDEVTypes {
+			vGPUTypes[t.Name] = true
+		}
+	}
+	setListLabel(labels, gpuDeviceIDLabel, "", deviceIDs)
+	setListLabel(labels, vGPUTypesLabel, vGPUTypeLabelPrefix, vGPUTypes)
+
+	if spec != nil {
+		available := map[string]bool{}
+		for name, configSpecs := range spec.VGPUConfigs {
+			if isVGPUConfigAvailable(inventory, configSpecs) {
+				available[name] = true
+			}
+		}
+		setListLabel(labels, vGPUConfigAvailableLabel, vGPUConfigAvailableLabelPrefix, available)
+	}
+	return labels
+}
+
+// isVGPUConfigAvailable checks if every entry of a named config can be applied to the GPUs it selects
+func isVGPUConfigAvailable(inventory []types.GPUInventory, configSpecs v1.VGPUConfigSpecSlice) bool {
+	for _, configSpec := range configSpecs {
+		for i := range inventory {
+			if !configSpec.MatchDevices(inventory[i].Index) {
+				continue
+			}
+			if configSpec.DeviceFilter != nil {
+				deviceID, err := inventory[i].DeviceID()
+				if err != nil || !configSpec.MatchDeviceFilter(deviceID) {
+					continue
+				}
+			}
+			for mdevType, count := range configSpec.VGPUDevices {
+				if count.IsRelative() && !inventory[i].IsMDEVTypeSupported(mdevType) {
+					return false
+				}
+			}
+			vgpuConfig, resolved := configSpec.VGPUDevices.Resolve(&inventory[i])
+			if !resolved {
+				// Relative counts depend on the devices of other types, only check the fixed ones
+				vgpuConfig = configSpec.VGPUDevices.Absolute()
+			}
+			if !inventory[i].SupportsVGPUConfig(vgpuConfig) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// setListLabel sets 'key' to the sorted items joined with '.' and, if 'prefix' is not
+// empty, a '<prefix><item>=true' label per item. Invalid labels are skipped.
+func setListLabel(labels map[string]string, key string, prefix string, items map[string]bool) {
+	var values []string
+	for item := range items {
+		values = append(values, item)
+	}
+	sort.Strings(values)
+
+	value := strings.Join(values, ".")
+	if errs := validation.IsValidLabelValue(value); len(errs) == 0 {
+		labels[key] = value
+	} else {
+		log.Warnf("Skipping label %s=%s: %s", key, value, strings.Join(errs, ", "))
+	}
+
+	if prefix == "" {
+		return
+	}
+	for _, item := range values {
+		if errs := validation.IsQualifiedName(prefix + item); len(errs) > 0 {
+			log.Warnf("Skipping label %s%s: %s", prefix, item, strings.Join(errs, ", "))
+			continue
+		}
+		labels[prefix+item] = "true"
+	}
+}
+
+func isCapabilityLabel(key string) bool {
+	if capabilityLabels[key] {
+		return true
+	}
+	for _, prefix := range capabilityLabelPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateCapabilityLabels recomputes the capability labels of the node and patches
+// the node object, removing stale labels
+func updateCapabilityLabels(ctx context.Context, clientset *kubernetes.Clientset, spec *v1.Spec) error {
+	inventory, err := vgpu.GetInventory()
+	if err != nil {
+		return fmt.Errorf("unable to get vGPU inventory: %v", err)
+	}
+	labels := getCapabilityLabels(inventory, spec)
+
+	node, err := getNode(clientset)
+	if err != nil {
+		return err
+	}
+
+	patchLabels := getCapabilityLabelsPatch(node.Labels, labels)
+	if len(patchLabels) == 0 {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": patchLabels,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to encode node labels patch: %v", err)
+	}
+	_, err = clientset.CoreV1().Nodes().Patch(ctx, nodeNameFlag, k8stypes.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to patch node labels: %v", err)
+	}
+	return nil
+}
+
+// getCapabilityLabelsPatch returns the labels to change to turn the capability labels
+// among 'current' into 'labels', with a nil value for those to remove
+func getCapabilityLabelsPatch(current map[string]string, labels map[string]string) map[string]interface{} {
+	patch := map[string]interface{}{}
+	for key := range current {
+		if isCapabilityLabel(key) {
+			if _, exists := labels[key]; !exists {
+				patch[key] = nil
+			}
+		}
+	}
+	for key, value := range labels {
+		if current[key] != value {
+			patch[key] = value
+		}
+	}
+	return patch
+}
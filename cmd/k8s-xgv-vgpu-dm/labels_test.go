@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGetCapabilityLabelsPatch(t *testing.T) {
+	current := map[string]string{
+		gpuCountLabel:                            "2",
+		vGPUTypesLabel:                           "XGV_V0_1G_1_CORE.XGV_V0_2G_1_CORE",
+		vGPUTypeLabelPrefix + "XGV_V0_1G_1_CORE": "true",
+		vGPUTypeLabelPrefix + "XGV_V0_2G_1_CORE": "true",
+		// Labels of other components in the xdxct.com domain
+		"xdxct.com/gpu.product":      "XDX-GPU",
+		"xdxct.com/vgpu.host-driver": "1.0",
+		"kubernetes.io/hostname":     "node",
+	}
+	labels := map[string]string{
+		gpuCountLabel:                            "2",
+		vGPUTypesLabel:                           "XGV_V0_1G_1_CORE",
+		vGPUTypeLabelPrefix + "XGV_V0_1G_1_CORE": "true",
+	}
+
+	patch := getCapabilityLabelsPatch(current, labels)
+	expected := map[string]interface{}{
+		vGPUTypesLabel:                           "XGV_V0_1G_1_CORE",
+		vGPUTypeLabelPrefix + "XGV_V0_2G_1_CORE": nil,
+	}
+	if len(patch) != len(expected) {
+		t.Fatalf("expected patch %v, got %v", expected, patch)
+	}
+	for key, value := range expected {
+		if actual, exists := patch[key]; !exists || actual != value {
+			t.Errorf("expected patch %v, got %v", expected, patch)
+			break
+		}
+	}
+}
@@ -2,18 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	cli "github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
 	corev1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/kubernetes"
@@ -21,13 +25,27 @@ import (
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/api/xdxct/v1alpha1"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/logging"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/tracing"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/audit"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/config"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/exitcode"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/kubevirt"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
 )
 
 const (
 	resourceNodes                = "nodes"
 	vGPUConfigLabel              = "xdxct.com/vgpu-config"
+	vGPUConfigGPULabelPrefix     = "xdxct.com/vgpu-config.gpu-"
 	cliName                      = "xgv-vgpu-dm"
 	kubevirt_device_plugin_Label = "name=xdxct-kubevirt-dp-ds"
+
+	// applyTimeoutGrace is the time xgv-vgpu-dm gets to stop after '--timeout' expired,
+	// before it is killed
+	applyTimeoutGrace = 30 * time.Second
 )
 
 var (
@@ -36,6 +54,20 @@ var (
 	namespaceFlag         string
 	configFileFlag        string
 	defaultVGPUConfigFlag string
+	inventoryIntervalFlag time.Duration
+	deterministicUUIDFlag bool
+	placementFlag         string
+	parallelismFlag       int
+	continueOnErrorFlag   bool
+	kubeVirtFlag          bool
+	kubeVirtNamespaceFlag string
+	resourcePrefixFlag    string
+	cdiSpecFileFlag       string
+	stateFileFlag         string
+	logFormatFlag         string
+	auditLogFlag          string
+	tracingExporterFlag   string
+	timeoutFlag           time.Duration
 )
 
 type SyncableVGPUConfig struct {
@@ -43,6 +75,7 @@ type SyncableVGPUConfig struct {
 	mutex          sync.Mutex
 	current        string
 	lastVGPUConfig string
+	resync         bool
 }
 
 func NewSyncableVGPUConfig() *SyncableVGPUConfig {
@@ -63,13 +96,23 @@ func (m *SyncableVGPUConfig) Set(value string) {
 func (m *SyncableVGPUConfig) Get() string {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	if m.lastVGPUConfig == m.current {
+	if m.lastVGPUConfig == m.current && !m.resync {
 		m.cond.Wait()
 	}
+	m.resync = false
 	m.lastVGPUConfig = m.current
 	return m.lastVGPUConfig
 }
 
+// Resync wakes up a pending Get even if the value has not changed, so that the
+// current vGPU config is applied again
+func (m *SyncableVGPUConfig) Resync() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.resync = true
+	m.cond.Broadcast()
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Before = validationFlags
@@ -103,7 +146,7 @@ func main() {
 			Name:        "configFile",
 			Aliases:     []string{"f"},
 			Value:       "",
-			Usage:       "the absolute path to vGPU config file",
+			Usage:       "the absolute path to vGPU config file or a directory of config fragments, used when no VGPUNodeConfig selects the node",
 			Destination: &configFileFlag,
 			EnvVars:     []string{"CONFIGFILE"},
 		},
@@ -115,6 +158,104 @@ func main() {
 			Destination: &defaultVGPUConfigFlag,
 			EnvVars:     []string{"DEFAULTVGPUCONFIG"},
 		},
+		&cli.DurationFlag{
+			Name:        "inventory-interval",
+			Value:       60 * time.Second,
+			Usage:       "the interval at which the vGPU inventory configmap of the node is refreshed, 0 disables periodic refresh",
+			Destination: &inventoryIntervalFlag,
+			EnvVars:     []string{"INVENTORYINTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:        "deterministic-uuids",
+			Value:       false,
+			Usage:       "derive the UUIDs of created vGPU devices from the node name, GPU address, type and ordinal",
+			Destination: &deterministicUUIDFlag,
+			EnvVars:     []string{"DETERMINISTICUUIDS"},
+		},
+		&cli.StringFlag{
+			Name:        "placement",
+			Value:       string(vgpu.PlacementPack),
+			Usage:       "how vGPU devices are distributed over the parent devices of a GPU, e.g. its SR-IOV virtual functions: 'pack' or 'spread'",
+			Destination: &placementFlag,
+			EnvVars:     []string{"PLACEMENT"},
+		},
+		&cli.IntFlag{
+			Name:        "parallelism",
+			Value:       1,
+			Usage:       "the number of GPUs checked and configured concurrently",
+			Destination: &parallelismFlag,
+			EnvVars:     []string{"PARALLELISM"},
+		},
+		&cli.BoolFlag{
+			Name:        "continue-on-error",
+			Value:       false,
+			Usage:       "keep configuring the remaining GPUs after a GPU failed",
+			Destination: &continueOnErrorFlag,
+			EnvVars:     []string{"CONTINUEONERROR"},
+		},
+		&cli.BoolFlag{
+			Name:        "kubevirt",
+			Value:       false,
+			Usage:       "permit the types of the vGPU devices on the node in the permittedHostDevices of the KubeVirt CR after every apply",
+			Destination: &kubeVirtFlag,
+			EnvVars:     []string{"KUBEVIRT"},
+		},
+		&cli.StringFlag{
+			Name:        "kubevirt-namespace",
+			Value:       "kubevirt",
+			Usage:       "the namespace of the KubeVirt CR",
+			Destination: &kubeVirtNamespaceFlag,
+			EnvVars:     []string{"KUBEVIRTNAMESPACE"},
+		},
+		&cli.StringFlag{
+			Name:        "resource-prefix",
+			Value:       kubevirt.DefaultResourcePrefix,
+			Usage:       "the prefix of the resource names the vGPU types are permitted as in KubeVirt",
+			Destination: &resourcePrefixFlag,
+			EnvVars:     []string{"RESOURCEPREFIX"},
+		},
+		&cli.StringFlag{
+			Name:        "cdi-spec-file",
+			Value:       "",
+			Usage:       "the absolute path to the CDI spec file regenerated for the vGPU devices on the node after every apply, empty to disable",
+			Destination: &cdiSpecFileFlag,
+			EnvVars:     []string{"CDISPECFILE"},
+		},
+		&cli.StringFlag{
+			Name:        "state-file",
+			Value:       "",
+			Usage:       "the absolute path to the state file xgv-vgpu-dm records the applied vGPU devices in for 'restore', which must be mounted from the host, empty to disable",
+			Destination: &stateFileFlag,
+			EnvVars:     []string{"STATEFILE"},
+		},
+		&cli.StringFlag{
+			Name:        "log-format",
+			Value:       logging.FormatText,
+			Usage:       "the format of log lines, also used by xgv-vgpu-dm: 'text' or 'json'",
+			Destination: &logFormatFlag,
+			EnvVars:     []string{"LOGFORMAT"},
+		},
+		&cli.StringFlag{
+			Name:        "audit-log",
+			Value:       "",
+			Usage:       "the JSON-lines file, or 'syslog', xgv-vgpu-dm audits every creation and deletion of a vGPU device to, empty to disable",
+			Destination: &auditLogFlag,
+			EnvVars:     []string{"AUDITLOG"},
+		},
+		&cli.StringFlag{
+			Name:        "tracing-exporter",
+			Value:       tracing.ExporterNone,
+			Usage:       "where the spans of every reconciliation, including those of xgv-vgpu-dm, are exported: 'none' or 'otlp', configured by the OTEL_EXPORTER_OTLP_* environment variables",
+			Destination: &tracingExporterFlag,
+			EnvVars:     []string{"TRACINGEXPORTER"},
+		},
+		&cli.DurationFlag{
+			Name:        "timeout",
+			Value:       0,
+			Usage:       "the time xgv-vgpu-dm may take to create and delete the vGPU devices of a config, 0 for no limit",
+			Destination: &timeoutFlag,
+			EnvVars:     []string{"TIMEOUT"},
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -132,12 +273,21 @@ func validationFlags(c *cli.Context) error {
 	if namespaceFlag == "" {
 		return fmt.Errorf("invalid <namespace> flag: must not be empty string")
 	}
-	if configFileFlag == "" {
-		return fmt.Errorf("invalid <configFileFlag> flag: must not be empty string")
-	}
 	if defaultVGPUConfigFlag == "" {
 		return fmt.Errorf("invalid <default-VGPU-Config> flag: must not be empty string")
 	}
+	if _, err := vgpu.ParsePlacementStrategy(placementFlag); err != nil {
+		return fmt.Errorf("invalid <placement> flag: %v", err)
+	}
+	if parallelismFlag < 1 {
+		return fmt.Errorf("invalid <parallelism> flag: must be at least 1")
+	}
+	if err := logging.SetFormat(logFormatFlag); err != nil {
+		return fmt.Errorf("invalid <log-format> flag: %v", err)
+	}
+	logging.SetFields(log.Fields{
+		logging.NodeField: nodeNameFlag,
+	})
 	return nil
 }
 
@@ -162,6 +312,12 @@ func notifyVGPUConfigChangesFromNode(clientset *kubernetes.Clientset, vGPUConfig
 				if oldLabel != newLabel {
 					vGPUConfig.Set(newLabel)
 				}
+				oldGPUConfigs := getGPUConfigLabels(oldObj.(*corev1.Node))
+				newGPUConfigs := getGPUConfigLabels(newObj.(*corev1.Node))
+				if strings.Join(oldGPUConfigs, ",") != strings.Join(newGPUConfigs, ",") {
+					log.Infof("vGPU configs selected for specific GPUs changed to %v", newGPUConfigs)
+					vGPUConfig.Resync()
+				}
 			},
 		},
 	)
@@ -194,47 +350,69 @@ func start(c *cli.Context) error {
 		return fmt.Errorf("error building kubernetes clientset from config: %s", err)
 	}
 
+	shutdownTracing, err := tracing.Setup(context.Background(), tracingExporterFlag, "k8s-xgv-vgpu-dm")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Warnf("Unable to export spans: %v", err)
+		}
+	}()
+
 	vGPUConfig := NewSyncableVGPUConfig()
+	nodeConfigs := newVGPUNodeConfigClient(clientset)
+	inventory := newInventoryReporter(clientset)
 
 	stopch := notifyVGPUConfigChangesFromNode(clientset, vGPUConfig)
 	defer close(stopch)
 
+	nodeConfigStopch := notifyVGPUNodeConfigChanges(clientset, nodeConfigs, vGPUConfig)
+	defer close(nodeConfigStopch)
+
+	inventoryStopch := refreshInventoryPeriodically(inventory, inventoryIntervalFlag)
+	defer close(inventoryStopch)
+
 	//Apply initial vGPU configuration
 	selectedConfig, err := getNodeLabel(clientset)
 	if err != nil {
 		return fmt.Errorf("unable to get vGPU config label: %v", err)
 	}
-	if selectedConfig == "" {
-		log.Infof("No vGPU config specified for node. Proceeding with default config: %s", defaultVGPUConfigFlag)
-		selectedConfig = defaultVGPUConfigFlag
-	} else {
+	if selectedConfig != "" {
 		selectedConfig = vGPUConfig.Get()
 	}
 
-	log.Infof("Updating to vGPU config: %s", selectedConfig)
-	err = updateConfig(clientset, selectedConfig)
+	err = updateConfig(clientset, nodeConfigs, inventory, selectedConfig)
 	if err != nil {
-		log.Errorf("ERROR: %v", err)
+		log.WithField(logging.ConfigField, selectedConfig).Errorf("ERROR: %v", err)
 	} else {
-		log.Infof("Successfully updated to vGPU config: %s", selectedConfig)
+		log.WithField(logging.ConfigField, selectedConfig).Infof("Successfully updated vGPU config")
 	}
 
 	for {
 		log.Infof("Waiting for change to %s label", vGPUConfigLabel)
 		value := vGPUConfig.Get()
-		err = updateConfig(clientset, value)
+		err = updateConfig(clientset, nodeConfigs, inventory, value)
 		if err != nil {
-			log.Errorf("ERROR: %v", err)
+			log.WithField(logging.ConfigField, value).Errorf("ERROR: %v", err)
 			continue
 		}
-		log.Infof("Successfully update to vGPU config: %s", value)
+		log.WithField(logging.ConfigField, value).Infof("Successfully updated vGPU config")
 	}
 }
 
-func getNodeLabel(clientset *kubernetes.Clientset) (string, error) {
+func getNode(clientset kubernetes.Interface) (*corev1.Node, error) {
 	node, err := clientset.CoreV1().Nodes().Get(context.TODO(), nodeNameFlag, metav1.GetOptions{})
 	if err != nil {
-		return "", fmt.Errorf("unable to get node obj: %v", err)
+		return nil, fmt.Errorf("unable to get node obj: %v", err)
+	}
+	return node, nil
+}
+
+func getNodeLabel(clientset *kubernetes.Clientset) (string, error) {
+	node, err := getNode(clientset)
+	if err != nil {
+		return "", err
 	}
 	value, ok := node.Labels[vGPUConfigLabel]
 	if !ok {
@@ -243,21 +421,161 @@ func getNodeLabel(clientset *kubernetes.Clientset) (string, error) {
 	return value, nil
 }
 
-func updateConfig(clientset *kubernetes.Clientset, selectedConfig string) error {
+// getGPUConfigLabels returns the named configs selected for specific GPUs of the node through
+// 'xdxct.com/vgpu-config.gpu-<index>' labels, as 'index=name' sorted by index
+func getGPUConfigLabels(node *corev1.Node) []string {
+	var indexes []int
+	for key := range node.Labels {
+		if !strings.HasPrefix(key, vGPUConfigGPULabelPrefix) {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(key, vGPUConfigGPULabelPrefix))
+		if err != nil || index < 0 {
+			log.Warnf("Ignoring label %s with invalid GPU index", key)
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var gpuConfigs []string
+	for _, index := range indexes {
+		name := node.Labels[vGPUConfigGPULabelPrefix+strconv.Itoa(index)]
+		if name == "" {
+			continue
+		}
+		gpuConfigs = append(gpuConfigs, fmt.Sprintf("%d=%s", index, name))
+	}
+	return gpuConfigs
+}
+
+// updateConfig reconciles the vGPU devices of the node with the selected config. Every
+// call is traced as a 'reconcile' span, the parent of the spans of xgv-vgpu-dm.
+func updateConfig(clientset *kubernetes.Clientset, nodeConfigs *vGPUNodeConfigClient, inventory *inventoryReporter, selectedConfig string) (err error) {
+	ctx, span := tracing.Start(context.Background(), "reconcile", attribute.String(logging.NodeField, nodeNameFlag))
+	defer func() { tracing.End(span, err) }()
+
+	node, err := getNode(clientset)
+	if err != nil {
+		return err
+	}
+
+	// A VGPUNodeConfig selecting the node takes precedence over the config file
+	configFile := configFileFlag
+	defaultVGPUConfig := defaultVGPUConfigFlag
+	nodeConfig, err := nodeConfigs.forNode(ctx, node)
+	var conflict *nodeConfigConflictError
+	if errors.As(err, &conflict) {
+		reportNodeConflict(ctx, nodeConfigs, conflict, selectedConfig)
+	}
+	if err != nil {
+		return err
+	}
+	if nodeConfig != nil {
+		log.Infof("Using vGPU configs from %s %s", v1alpha1.Kind, nodeConfig.Name)
+		configFile, err = writeConfigFile(nodeConfig)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(configFile)
+		if nodeConfig.Spec.DefaultVGPUConfig != "" {
+			defaultVGPUConfig = nodeConfig.Spec.DefaultVGPUConfig
+		}
+	}
+	if configFile == "" {
+		return fmt.Errorf("no %s selects the node and no config file is set", v1alpha1.Kind)
+	}
+
+	if selectedConfig == "" {
+		log.WithField(logging.ConfigField, defaultVGPUConfig).Infof("No vGPU config specified for node. Proceeding with default config")
+		selectedConfig = defaultVGPUConfig
+	}
+	span.SetAttributes(attribute.String(logging.ConfigField, selectedConfig))
+	logger := log.WithField(logging.ConfigField, selectedConfig)
+	gpuConfigs := getGPUConfigLabels(node)
+	if len(gpuConfigs) > 0 {
+		logger.Infof("Updating vGPU config, with vGPU configs for specific GPUs: %v", gpuConfigs)
+	} else {
+		logger.Infof("Updating vGPU config")
+	}
+
+	err = applyConfigWithRestart(ctx, clientset, configFile, selectedConfig, gpuConfigs)
+	if nodeConfig != nil {
+		reportNodeStatus(ctx, nodeConfigs, nodeConfig, selectedConfig, err)
+	}
+	traced(ctx, "update inventory", func(ctx context.Context) error {
+		inventoryErr := inventory.Update(selectedConfig)
+		if inventoryErr != nil {
+			log.Warnf("Unable to update vGPU inventory: %v", inventoryErr)
+		}
+		return inventoryErr
+	})
+	traced(ctx, "update node labels", func(ctx context.Context) error {
+		labelsErr := updateNodeLabels(ctx, clientset, configFile)
+		if labelsErr != nil {
+			log.Warnf("Unable to update node labels: %v", labelsErr)
+		}
+		return labelsErr
+	})
+	if kubeVirtFlag {
+		traced(ctx, "update KubeVirt", func(ctx context.Context) error {
+			kubeVirtErr := updateKubeVirt(ctx, clientset, newKubeVirtClient(clientset, kubeVirtNamespaceFlag))
+			if kubeVirtErr != nil {
+				log.Warnf("Unable to update KubeVirt permittedHostDevices: %v", kubeVirtErr)
+			}
+			return kubeVirtErr
+		})
+	}
+	return err
+}
+
+// withTimeout returns a context that is done once '--timeout' expired, if set
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeoutFlag > 0 {
+		return context.WithTimeout(ctx, timeoutFlag)
+	}
+	return context.WithCancel(ctx)
+}
+
+// traced runs 'f' in a span that is a child of the span in 'ctx', with a context
+// holding the new span
+func traced(ctx context.Context, name string, f func(ctx context.Context) error) error {
+	ctx, span := tracing.Start(ctx, name)
+	err := f(ctx)
+	tracing.End(span, err)
+	return err
+}
+
+// updateNodeLabels labels the node with its GPU and vGPU capabilities, including
+// the named configs from the config file that can be applied to it
+func updateNodeLabels(ctx context.Context, clientset *kubernetes.Clientset, configFile string) error {
+	spec, err := config.ParseFile(configFile)
+	if err != nil {
+		return fmt.Errorf("unable to parse config file %s: %v", configFile, err)
+	}
+	return updateCapabilityLabels(ctx, clientset, spec)
+}
+
+func applyConfigWithRestart(ctx context.Context, clientset *kubernetes.Clientset, configFile string, selectedConfig string, gpuConfigs []string) error {
 	// to do add validator components
 	// nvidia采用的删除label, operator 会shutdown validation和kubevirt-device-plugin的组件，接着再去重新调用组件。
 	// 这里是删除了pod, daemonset 会重启pod达到重启的效果。
 	log.Info("Restart all GPU Component in Kubernetes.")
-	err := deleteGPUComponent(clientset)
+	err := traced(ctx, "shutdown GPU components", func(ctx context.Context) error {
+		return deleteGPUComponent(ctx, clientset)
+	})
 	if err != nil {
-		fmt.Printf("Unable to delete GPU component: %v", err)
+		log.Errorf("Unable to delete GPU component: %v", err)
 		return err
 	}
 
-	log.Info("Applying the selected vGPU device configuration to the node")
-	err = applyConfig(selectedConfig)
+	logger := log.WithField(logging.ConfigField, selectedConfig)
+	logger.Info("Applying the selected vGPU device configuration to the node")
+	err = traced(ctx, "apply vGPU config", func(ctx context.Context) error {
+		return applyConfig(ctx, configFile, selectedConfig, gpuConfigs)
+	})
 	if err != nil {
-		fmt.Printf("Unable to apply config %s: %v", selectedConfig, err)
+		logger.Errorf("Unable to apply config: %v", err)
 		return err
 	}
 	return nil
@@ -265,8 +583,8 @@ func updateConfig(clientset *kubernetes.Clientset, selectedConfig string) error
 
 // to do: delete pod by set label
 // to do: add validation
-func deleteGPUComponent(clientset *kubernetes.Clientset) error {
-	Pods, err := clientset.CoreV1().Pods("default").List(context.TODO(), metav1.ListOptions{
+func deleteGPUComponent(ctx context.Context, clientset *kubernetes.Clientset) error {
+	Pods, err := clientset.CoreV1().Pods("default").List(ctx, metav1.ListOptions{
 		LabelSelector: kubevirt_device_plugin_Label,
 		FieldSelector: fmt.Sprintf("spec.nodeName=%s", nodeNameFlag),
 	})
@@ -274,7 +592,7 @@ func deleteGPUComponent(clientset *kubernetes.Clientset) error {
 		return fmt.Errorf("unable to get pod object: %v", err)
 	}
 	for _, pod := range Pods.Items {
-		err = clientset.CoreV1().Pods("default").Delete(context.TODO(), pod.Name, metav1.DeleteOptions{})
+		err = clientset.CoreV1().Pods("default").Delete(ctx, pod.Name, metav1.DeleteOptions{})
 		if err != nil {
 			return fmt.Errorf("unable to get pod object: %v", err)
 		}
@@ -282,38 +600,61 @@ func deleteGPUComponent(clientset *kubernetes.Clientset) error {
 	return nil
 }
 
-func waitForPodDeletion(clientset *kubernetes.Clientset) error {
-	timeOut := time.After(120 * time.Second)
-	timeInterval := time.Second * 2
-	for {
-		podList, err := clientset.CoreV1().Pods("default").List(context.TODO(), metav1.ListOptions{
-			LabelSelector: kubevirt_device_plugin_Label,
-			FieldSelector: fmt.Sprintf("spec.nodeName=%s", nodeNameFlag),
-		})
-		if apierrors.IsNotFound(err) {
-			return nil
-		}
-		if len(podList.Items) == 0 {
-			return nil
-		}
-
-		select {
-		case <-time.After(timeInterval):
-		case <-timeOut:
-			return fmt.Errorf("failed to delete pod: %v", err)
-		}
-	}
-}
-
-func applyConfig(config string) error {
+// applyConfig runs xgv-vgpu-dm to apply the config. Its spans continue the trace of 'ctx'.
+func applyConfig(ctx context.Context, configFile string, config string, gpuConfigs []string) error {
 	args := []string{
 		"-v",
+		"--log-format", logFormatFlag,
+		"--tracing-exporter", tracingExporterFlag,
 		"apply",
-		"-f", configFileFlag,
+		"-f", configFile,
 		"-c", config,
+		// Always passed, as an empty value disables the state file of xgv-vgpu-dm
+		"--state-file=" + stateFileFlag,
+	}
+	for _, gpuConfig := range gpuConfigs {
+		args = append(args, "--gpu", gpuConfig)
+	}
+	if deterministicUUIDFlag {
+		args = append(args, "--deterministic-uuids", "--node-name", nodeNameFlag)
+	}
+	if placementFlag != "" {
+		args = append(args, "--placement", placementFlag)
+	}
+	args = append(args, "--parallelism", strconv.Itoa(parallelismFlag))
+	if continueOnErrorFlag {
+		args = append(args, "--continue-on-error")
+	}
+	if cdiSpecFileFlag != "" {
+		args = append(args, "--cdi-spec-file", cdiSpecFileFlag)
 	}
-	cmd := exec.Command(cliName, args...)
+	if auditLogFlag != "" {
+		args = append(args, "--audit-log", auditLogFlag, "--audit-actor", audit.ActorDaemon)
+	}
+	if timeoutFlag > 0 {
+		args = append(args, "--timeout", timeoutFlag.String())
+
+		// Kill xgv-vgpu-dm if it does not stop by itself, e.g. as a sysfs write blocks
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeoutFlag+applyTimeoutGrace)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, cliName, args...)
+	cmd.WaitDelay = applyTimeoutGrace
+	cmd.Env = append(os.Environ(), tracing.Environ(ctx)...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	err := cmd.Run()
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%s killed: %w", cliName, ctx.Err())
+	}
+
+	// The exit code tells why the config could not be applied, see pkg/exitcode
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if codeErr := exitcode.Err(exitErr.ExitCode()); codeErr != nil {
+			return fmt.Errorf("%s failed with %w: %w", cliName, err, codeErr)
+		}
+	}
+	return err
 }
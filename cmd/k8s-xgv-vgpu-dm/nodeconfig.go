@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/api/xdxct/v1alpha1"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/exitcode"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+// vGPUNodeConfigRetryInterval is the time waited before watching 'VGPUNodeConfig'
+// objects again after the watch failed, e.g. as the CRD is not installed
+const vGPUNodeConfigRetryInterval = 30 * time.Second
+
+// vGPUNodeConfigClient reads 'VGPUNodeConfig' resources and updates their status
+// through the raw REST client, so no generated clientset is needed
+type vGPUNodeConfigClient struct {
+	rest rest.Interface
+}
+
+func newVGPUNodeConfigClient(clientset *kubernetes.Clientset) *vGPUNodeConfigClient {
+	return &vGPUNodeConfigClient{
+		rest: clientset.CoreV1().RESTClient(),
+	}
+}
+
+func (c *vGPUNodeConfigClient) path(segments ...string) string {
+	return path.Join(append([]string{"/apis", v1alpha1.Group, v1alpha1.Version, v1alpha1.Resource}, segments...)...)
+}
+
+func (c *vGPUNodeConfigClient) list(ctx context.Context) (*v1alpha1.VGPUNodeConfigList, error) {
+	raw, err := c.rest.Get().AbsPath(c.path()).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var list v1alpha1.VGPUNodeConfigList
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("unable to decode %s list: %v", v1alpha1.Kind, err)
+	}
+	return &list, nil
+}
+
+// watchEvent is an event of a watch on 'VGPUNodeConfig' objects, as sent by the API server
+type watchEvent struct {
+	Type   watch.EventType `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// watch calls 'changed' for every change to the 'VGPUNodeConfig' objects after
+// 'resourceVersion', until the API server ends the watch or 'ctx' is done
+func (c *vGPUNodeConfigClient) watch(ctx context.Context, resourceVersion string, changed func()) error {
+	stream, err := c.rest.Get().
+		AbsPath(c.path()).
+		Param("watch", "true").
+		Param("allowWatchBookmarks", "true").
+		Param("resourceVersion", resourceVersion).
+		Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	decoder := json.NewDecoder(stream)
+	for {
+		var event watchEvent
+		err := decoder.Decode(&event)
+		if err == io.EOF || ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to decode %s watch event: %v", v1alpha1.Kind, err)
+		}
+		switch event.Type {
+		case watch.Error:
+			var status metav1.Status
+			if err := json.Unmarshal(event.Object, &status); err != nil {
+				return fmt.Errorf("unable to decode %s watch error: %v", v1alpha1.Kind, err)
+			}
+			return apierrors.FromObject(&status)
+		case watch.Bookmark:
+		default:
+			changed()
+		}
+	}
+}
+
+func (c *vGPUNodeConfigClient) get(ctx context.Context, name string) (*v1alpha1.VGPUNodeConfig, error) {
+	raw, err := c.rest.Get().AbsPath(c.path(name)).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var config v1alpha1.VGPUNodeConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("unable to decode %s %s: %v", v1alpha1.Kind, name, err)
+	}
+	return &config, nil
+}
+
+func (c *vGPUNodeConfigClient) updateStatus(ctx context.Context, config *v1alpha1.VGPUNodeConfig) error {
+	body, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("unable to encode %s %s: %v", v1alpha1.Kind, config.Name, err)
+	}
+	_, err = c.rest.Put().
+		AbsPath(c.path(config.Name, "status")).
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		DoRaw(ctx)
+	return err
+}
+
+// nodeConfigConflictError is returned when several 'VGPUNodeConfig' objects select a
+// node, as there is no way to tell which of them is meant to configure it
+type nodeConfigConflictError struct {
+	node    string
+	configs []v1alpha1.VGPUNodeConfig
+}
+
+func (e *nodeConfigConflictError) names() []string {
+	var names []string
+	for _, config := range e.configs {
+		names = append(names, config.Name)
+	}
+	return names
+}
+
+func (e *nodeConfigConflictError) Error() string {
+	return fmt.Sprintf("node %s is selected by %d %s objects: %s", e.node, len(e.configs), v1alpha1.Kind, strings.Join(e.names(), ", "))
+}
+
+// forNode returns the 'VGPUNodeConfig' whose node selector matches the node, or nil if
+// there is none or the CRD is not installed in the cluster. If several of them match the
+// node, none is chosen and a *nodeConfigConflictError is returned.
+func (c *vGPUNodeConfigClient) forNode(ctx context.Context, node *corev1.Node) (*v1alpha1.VGPUNodeConfig, error) {
+	list, err := c.list(ctx)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to list %s objects: %v", v1alpha1.Kind, err)
+	}
+
+	var matches []v1alpha1.VGPUNodeConfig
+	for _, item := range list.Items {
+		selector := labels.Everything()
+		if item.Spec.NodeSelector != nil {
+			selector, err = metav1.LabelSelectorAsSelector(item.Spec.NodeSelector)
+			if err != nil {
+				log.Warnf("Ignoring %s %s with invalid node selector: %v", v1alpha1.Kind, item.Name, err)
+				continue
+			}
+		}
+		if selector.Matches(labels.Set(node.Labels)) {
+			matches = append(matches, item)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &matches[0], nil
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Name < matches[j].Name
+	})
+	return nil, &nodeConfigConflictError{
+		node:    node.Name,
+		configs: matches,
+	}
+}
+
+// setNodeStatus records the status of a node on a 'VGPUNodeConfig', retrying on conflicts
+// with the daemons of other nodes updating the same object
+func (c *vGPUNodeConfigClient) setNodeStatus(ctx context.Context, name string, status v1alpha1.NodeStatus) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		config, err := c.get(ctx, name)
+		if err != nil {
+			return fmt.Errorf("unable to get %s %s: %w", v1alpha1.Kind, name, err)
+		}
+		config.Status.SetNodeStatus(status)
+		return c.updateStatus(ctx, config)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update status of %s %s: %v", v1alpha1.Kind, name, err)
+	}
+	return nil
+}
+
+// writeConfigFile writes the config embedded in a 'VGPUNodeConfig' to a temporary
+// file that can be passed to the xgv-vgpu-dm CLI
+func writeConfigFile(config *v1alpha1.VGPUNodeConfig) (string, error) {
+	data, err := yaml.Marshal(config.Spec.Spec)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal config of %s %s: %v", v1alpha1.Kind, config.Name, err)
+	}
+	file, err := os.CreateTemp("", "vgpu-config-*.yaml")
+	if err != nil {
+		return "", fmt.Errorf("unable to create config file: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("unable to write config file: %v", err)
+	}
+	return file.Name(), nil
+}
+
+// getGPUStatuses collects the vGPU devices currently created on every GPU of the node
+func getGPUStatuses(ctx context.Context) ([]v1alpha1.GPUStatus, error) {
+	gpus, err := xdxlib.New().Xdxpci.GetGPUs()
+	if err != nil {
+		return nil, fmt.Errorf("error enumerating GPUs: %v", err)
+	}
+	configManager := vgpu.NewXdxlibVGPUConfigManager()
+
+	var statuses []v1alpha1.GPUStatus
+	for i, gpu := range gpus {
+		vgpuConfig, err := configManager.GetVGPUConfigContext(ctx, i)
+		if err != nil {
+			return nil, fmt.Errorf("error getting vGPU config of GPU %d: %v", i, err)
+		}
+		statuses = append(statuses, v1alpha1.GPUStatus{
+			Index:       i,
+			Address:     gpu.Address,
+			VGPUDevices: vgpuConfig,
+		})
+	}
+	return statuses, nil
+}
+
+// reportNodeStatus updates the status of the 'VGPUNodeConfig' the config was applied from
+func reportNodeStatus(ctx context.Context, nodeConfigs *vGPUNodeConfigClient, config *v1alpha1.VGPUNodeConfig, selectedConfig string, applyErr error) {
+	status := v1alpha1.NodeStatus{
+		Name:           nodeNameFlag,
+		VGPUConfig:     selectedConfig,
+		State:          v1alpha1.NodeStateApplied,
+		LastUpdateTime: metav1.Now(),
+	}
+	if applyErr != nil {
+		status.State = v1alpha1.NodeStateFailed
+		status.Reason = nodeReason(applyErr)
+		status.Message = applyErr.Error()
+	}
+
+	statusCtx, cancel := withTimeout(ctx)
+	defer cancel()
+	gpus, err := getGPUStatuses(statusCtx)
+	if err != nil {
+		log.Warnf("Unable to collect GPU inventory: %v", err)
+	}
+	status.GPUs = gpus
+
+	err = nodeConfigs.setNodeStatus(ctx, config.Name, status)
+	if err != nil {
+		log.Warnf("Unable to report node status: %v", err)
+	}
+}
+
+// reportNodeConflict marks the node as failed in the status of every 'VGPUNodeConfig'
+// selecting it, so the conflict shows up wherever the node is looked up
+func reportNodeConflict(ctx context.Context, nodeConfigs *vGPUNodeConfigClient, conflict *nodeConfigConflictError, selectedConfig string) {
+	status := v1alpha1.NodeStatus{
+		Name:           nodeNameFlag,
+		VGPUConfig:     selectedConfig,
+		State:          v1alpha1.NodeStateFailed,
+		Reason:         v1alpha1.NodeReasonConflict,
+		Message:        conflict.Error(),
+		LastUpdateTime: metav1.Now(),
+	}
+	for _, config := range conflict.configs {
+		err := nodeConfigs.setNodeStatus(ctx, config.Name, status)
+		if err != nil {
+			log.Warnf("Unable to report node status: %v", err)
+		}
+	}
+}
+
+// nodeReason maps the error of applying a config to the reason reported in the node status
+func nodeReason(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return v1alpha1.NodeReasonTimeout
+	case errors.Is(err, vgpu.ErrGPUNotFound):
+		return v1alpha1.NodeReasonGPUNotFound
+	case errors.Is(err, vgpu.ErrTypeUnsupported):
+		return v1alpha1.NodeReasonTypeUnsupported
+	case errors.Is(err, vgpu.ErrInsufficientCapacity):
+		return v1alpha1.NodeReasonInsufficientCapacity
+	case errors.Is(err, vgpu.ErrDeviceBusy):
+		return v1alpha1.NodeReasonDeviceBusy
+	case errors.Is(err, vgpu.ErrPermissionDenied):
+		return v1alpha1.NodeReasonPermissionDenied
+	case errors.Is(err, exitcode.ErrConfigInvalid):
+		return v1alpha1.NodeReasonConfigInvalid
+	case errors.Is(err, exitcode.ErrUnknownConfig):
+		return v1alpha1.NodeReasonUnknownConfig
+	}
+	return v1alpha1.NodeReasonApplyFailed
+}
+
+// nodeConfigKey identifies a 'VGPUNodeConfig' revision, so changes to it can be detected
+func nodeConfigKey(config *v1alpha1.VGPUNodeConfig) string {
+	if config == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", config.Name, config.Generation)
+}
+
+// notifyVGPUNodeConfigChanges watches the 'VGPUNodeConfig' objects and the labels of the
+// node, and forces a resync of the vGPU config whenever the 'VGPUNodeConfig' selecting the
+// node or its generation changes
+func notifyVGPUNodeConfigChanges(clientset *kubernetes.Clientset, nodeConfigs *vGPUNodeConfigClient, vGPUConfig *SyncableVGPUConfig) chan struct{} {
+	lookup := func(ctx context.Context) (string, error) {
+		node, err := clientset.CoreV1().Nodes().Get(ctx, nodeNameFlag, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("unable to get node obj: %v", err)
+		}
+		config, err := nodeConfigs.forNode(ctx, node)
+		var conflict *nodeConfigConflictError
+		if errors.As(err, &conflict) {
+			// Resync once the conflict is resolved, or the conflicting objects change
+			return "conflict:" + strings.Join(conflict.names(), ","), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return nodeConfigKey(config), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var mutex sync.Mutex
+	last, err := lookup(ctx)
+	if err != nil {
+		log.Warnf("Unable to look up %s for node: %v", v1alpha1.Kind, err)
+	}
+	check := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		current, err := lookup(ctx)
+		if err != nil {
+			log.Warnf("Unable to look up %s for node: %v", v1alpha1.Kind, err)
+			return
+		}
+		if current != last {
+			log.Infof("%s for node changed from '%s' to '%s', resyncing vGPU config", v1alpha1.Kind, last, current)
+			vGPUConfig.Resync()
+		}
+		last = current
+	}
+
+	// The node selectors of the 'VGPUNodeConfig' objects match the labels of the node
+	_, controller := cache.NewInformer(
+		cache.NewListWatchFromClient(
+			clientset.CoreV1().RESTClient(),
+			resourceNodes,
+			corev1.NamespaceAll,
+			fields.OneTermEqualSelector("metadata.name", nodeNameFlag),
+		),
+		&corev1.Node{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if !labels.Equals(oldObj.(*corev1.Node).Labels, newObj.(*corev1.Node).Labels) {
+					check()
+				}
+			},
+		},
+	)
+
+	stopch := make(chan struct{})
+	go controller.Run(stopch)
+	go func() {
+		<-stopch
+		cancel()
+	}()
+	go func() {
+		for ctx.Err() == nil {
+			err := watchVGPUNodeConfigs(ctx, nodeConfigs, check)
+			switch {
+			case err == nil || apierrors.IsResourceExpired(err) || apierrors.IsGone(err):
+				// The watch ended or fell behind, list the objects again
+				continue
+			case apierrors.IsNotFound(err):
+				log.Debugf("%s CRD not installed, retrying in %v", v1alpha1.Kind, vGPUNodeConfigRetryInterval)
+			default:
+				log.Warnf("Unable to watch %s objects, retrying in %v: %v", v1alpha1.Kind, vGPUNodeConfigRetryInterval, err)
+			}
+			select {
+			case <-time.After(vGPUNodeConfigRetryInterval):
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return stopch
+}
+
+// watchVGPUNodeConfigs lists the 'VGPUNodeConfig' objects and watches them from the
+// resource version of the list, calling 'changed' after the list and every change
+func watchVGPUNodeConfigs(ctx context.Context, nodeConfigs *vGPUNodeConfigClient, changed func()) error {
+	list, err := nodeConfigs.list(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list %s objects: %w", v1alpha1.Kind, err)
+	}
+	changed()
+	return nodeConfigs.watch(ctx, list.ResourceVersion, changed)
+}
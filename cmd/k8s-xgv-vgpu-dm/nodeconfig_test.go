@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/api/xdxct/v1alpha1"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/config"
+)
+
+// fakeAPIServer serves 'VGPUNodeConfig' objects, given as raw JSON as the API server
+// would return them
+type fakeAPIServer struct {
+	sync.Mutex
+	// objects are the 'VGPUNodeConfig' objects by name, nil if the CRD is not installed
+	objects map[string]string
+	// conflicts is the number of status updates to reject with a conflict
+	conflicts int
+	// updates is the number of status updates received
+	updates int
+	// events are the watch events sent to a watch, which ends once it is closed
+	events chan string
+	// watchResourceVersion is the resource version the last watch started from
+	watchResourceVersion string
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("watch") == "true" {
+		s.serveWatch(w, r)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	prefix := fmt.Sprintf("/apis/%s/%s/%s", v1alpha1.Group, v1alpha1.Version, v1alpha1.Resource)
+	segments := strings.Split(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/"), "/")
+	if s.objects == nil || !strings.HasPrefix(r.URL.Path, prefix) {
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && segments[0] == "":
+		var items []string
+		for _, name := range s.names() {
+			items = append(items, s.objects[name])
+		}
+		fmt.Fprintf(w, `{"kind":"%sList","metadata":{"resourceVersion":"7"},"items":[%s]}`, v1alpha1.Kind, strings.Join(items, ","))
+	case r.Method == http.MethodGet && len(segments) == 1:
+		object, exists := s.objects[segments[0]]
+		if !exists {
+			writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+			return
+		}
+		fmt.Fprint(w, object)
+	case r.Method == http.MethodPut && len(segments) == 2 && segments[1] == "status":
+		s.updates++
+		if s.conflicts > 0 {
+			s.conflicts--
+			writeStatus(w, http.StatusConflict, metav1.StatusReasonConflict)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		s.objects[segments[0]] = string(body)
+		w.Write(body)
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed)
+	}
+}
+
+// serveWatch streams the watch events until they are closed
+func (s *fakeAPIServer) serveWatch(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	if s.objects == nil {
+		s.Unlock()
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+		return
+	}
+	s.watchResourceVersion = r.URL.Query().Get("resourceVersion")
+	s.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	for event := range s.events {
+		fmt.Fprintln(w, event)
+		w.(http.Flusher).Flush()
+	}
+}
+
+func (s *fakeAPIServer) names() []string {
+	var names []string
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason metav1.StatusReason) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Reason:   reason,
+		Code:     int32(code),
+	})
+}
+
+// newFakeVGPUNodeConfigClient returns a client talking to a fake API server with 'objects'
+func newFakeVGPUNodeConfigClient(t *testing.T, objects map[string]string) (*vGPUNodeConfigClient, *fakeAPIServer) {
+	fake := &fakeAPIServer{objects: objects}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client, err := rest.RESTClientFor(&rest.Config{
+		Host: server.URL,
+		ContentConfig: rest.ContentConfig{
+			GroupVersion:         &corev1.SchemeGroupVersion,
+			NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating REST client: %v", err)
+	}
+	return &vGPUNodeConfigClient{rest: client}, fake
+}
+
+// nodeConfigObject returns the JSON of a 'VGPUNodeConfig' with the given node selector and spec
+func nodeConfigObject(name string, nodeSelector string, spec string) string {
+	if nodeSelector != "" {
+		spec = fmt.Sprintf(`"nodeSelector":%s,%s`, nodeSelector, spec)
+	}
+	return fmt.Sprintf(`{"apiVersion":"%s/%s","kind":"%s","metadata":{"name":"%s","generation":1},"spec":{%s}}`,
+		v1alpha1.Group, v1alpha1.Version, v1alpha1.Kind, name, spec)
+}
+
+const testNodeConfigSpec = `"version":"v1","vgpu-configs":{"PANGU-A0-1G-1-CORE":[{"devices":"all","vgpu-devices":{"XGV_V0_1G_1_CORE":2}}]}`
+
+func TestForNode(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-a",
+			Labels: map[string]string{"xdxct.com/vgpu-node-pool": "pangu-a0"},
+		},
+	}
+	poolA0 := `{"matchLabels":{"xdxct.com/vgpu-node-pool":"pangu-a0"}}`
+	poolB0 := `{"matchLabels":{"xdxct.com/vgpu-node-pool":"pangu-b0"}}`
+	invalid := `{"matchExpressions":[{"key":"xdxct.com/vgpu-node-pool","operator":"Bogus"}]}`
+
+	testCases := []struct {
+		description string
+		objects     map[string]string
+		expected    string
+		conflicts   []string
+	}{
+		{
+			description: "CRD not installed",
+		},
+		{
+			description: "no objects",
+			objects:     map[string]string{},
+		},
+		{
+			description: "selector matches",
+			objects: map[string]string{
+				"pangu-a0": nodeConfigObject("pangu-a0", poolA0, testNodeConfigSpec),
+				"pangu-b0": nodeConfigObject("pangu-b0", poolB0, testNodeConfigSpec),
+			},
+			expected: "pangu-a0",
+		},
+		{
+			description: "selector does not match",
+			objects: map[string]string{
+				"pangu-b0": nodeConfigObject("pangu-b0", poolB0, testNodeConfigSpec),
+			},
+		},
+		{
+			description: "no selector matches every node",
+			objects: map[string]string{
+				"all": nodeConfigObject("all", "", testNodeConfigSpec),
+			},
+			expected: "all",
+		},
+		{
+			description: "invalid selector is ignored",
+			objects: map[string]string{
+				"invalid":  nodeConfigObject("invalid", invalid, testNodeConfigSpec),
+				"pangu-a0": nodeConfigObject("pangu-a0", poolA0, testNodeConfigSpec),
+			},
+			expected: "pangu-a0",
+		},
+		{
+			description: "several objects match",
+			objects: map[string]string{
+				"pangu-a0": nodeConfigObject("pangu-a0", poolA0, testNodeConfigSpec),
+				"all":      nodeConfigObject("all", "", testNodeConfigSpec),
+				"pangu-b0": nodeConfigObject("pangu-b0", poolB0, testNodeConfigSpec),
+			},
+			conflicts: []string{"all", "pangu-a0"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			client, _ := newFakeVGPUNodeConfigClient(t, tc.objects)
+			config, err := client.forNode(context.Background(), node)
+
+			if tc.conflicts != nil {
+				var conflict *nodeConfigConflictError
+				if !errors.As(err, &conflict) {
+					t.Fatalf("expected conflict error, got %v", err)
+				}
+				if !slices.Equal(conflict.names(), tc.conflicts) {
+					t.Errorf("expected conflicting objects %v, got %v", tc.conflicts, conflict.names())
+				}
+				if config != nil {
+					t.Errorf("expected no object, got %s", config.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			name := ""
+			if config != nil {
+				name = config.Name
+			}
+			if name != tc.expected {
+				t.Errorf("expected object '%s', got '%s'", tc.expected, name)
+			}
+		})
+	}
+}
+
+func TestNodeConfigDeviceIndices(t *testing.T) {
+	spec := `"version":"v1","vgpu-configs":{"PANGU-A0-mixed":[{"devices":[0,2],"vgpu-devices":{"XGV_V0_1G_1_CORE":2}}]}`
+	client, _ := newFakeVGPUNodeConfigClient(t, map[string]string{
+		"mixed": nodeConfigObject("mixed", "", spec),
+	})
+	nodeConfig, err := client.get(context.Background(), "mixed")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The config the daemon passes to xgv-vgpu-dm must select the same GPUs
+	configFile, err := writeConfigFile(nodeConfig)
+	if err != nil {
+		t.Fatalf("unexpected error writing config file: %v", err)
+	}
+	defer os.Remove(configFile)
+	written, err := config.ParseFile(configFile)
+	if err != nil {
+		t.Fatalf("unexpected error parsing config file: %v", err)
+	}
+
+	for description, entry := range map[string]interface{ MatchDevices(int) bool }{
+		"decoded": &nodeConfig.Spec.VGPUConfigs["PANGU-A0-mixed"][0],
+		"written": &written.VGPUConfigs["PANGU-A0-mixed"][0],
+	} {
+		for index, expected := range map[int]bool{0: true, 1: false, 2: true} {
+			if matches := entry.MatchDevices(index); matches != expected {
+				t.Errorf("%s: expected MatchDevices(%d) %v, got %v", description, index, expected, matches)
+			}
+		}
+	}
+}
+
+func TestSetNodeStatus(t *testing.T) {
+	object := nodeConfigObject("pangu-a0", "", testNodeConfigSpec)
+	object = strings.TrimSuffix(object, "}") + `,"status":{"nodes":[{"name":"node-b","vgpuConfig":"PANGU-A0-1G-1-CORE","state":"applied","lastUpdateTime":null}]}}`
+	client, fake := newFakeVGPUNodeConfigClient(t, map[string]string{"pangu-a0": object})
+	// The daemon of another node updates the object in between
+	fake.conflicts = 1
+
+	statuses := []v1alpha1.NodeStatus{
+		{Name: "node-a", VGPUConfig: "PANGU-A0-1G-1-CORE", State: v1alpha1.NodeStateApplied},
+		{Name: "node-a", VGPUConfig: "PANGU-A0-1G-1-CORE", State: v1alpha1.NodeStateFailed, Reason: v1alpha1.NodeReasonConflict},
+	}
+	for _, status := range statuses {
+		err := client.setNodeStatus(context.Background(), "pangu-a0", status)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if fake.updates != 3 {
+		t.Errorf("expected 3 status updates, got %d", fake.updates)
+	}
+
+	nodeConfig, err := client.get(context.Background(), "pangu-a0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nodes := nodeConfig.Status.Nodes
+	if len(nodes) != 2 {
+		t.Fatalf("expected the status of 2 nodes, got %v", nodes)
+	}
+	if nodes[0].Name != "node-b" || nodes[0].State != v1alpha1.NodeStateApplied {
+		t.Errorf("expected status of node-b to be kept, got %v", nodes[0])
+	}
+	if nodes[1].Name != "node-a" || nodes[1].State != v1alpha1.NodeStateFailed || nodes[1].Reason != v1alpha1.NodeReasonConflict {
+		t.Errorf("expected status of node-a to be replaced, got %v", nodes[1])
+	}
+
+	// Too many conflicts are reported
+	fake.conflicts = retry.DefaultRetry.Steps
+	err = client.setNodeStatus(context.Background(), "pangu-a0", statuses[0])
+	if err == nil {
+		t.Errorf("expected error after %d conflicts, got nil", retry.DefaultRetry.Steps)
+	}
+}
+
+func TestWatchVGPUNodeConfigs(t *testing.T) {
+	object := nodeConfigObject("pangu-a0", "", testNodeConfigSpec)
+	expired := `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Expired","code":410}`
+
+	testCases := []struct {
+		description string
+		objects     map[string]string
+		events      []string
+		changes     int
+		expectedErr func(error) bool
+	}{
+		{
+			description: "changes until the watch ends",
+			objects:     map[string]string{"pangu-a0": object},
+			events: []string{
+				fmt.Sprintf(`{"type":"ADDED","object":%s}`, object),
+				`{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"8"}}}`,
+				fmt.Sprintf(`{"type":"MODIFIED","object":%s}`, object),
+				fmt.Sprintf(`{"type":"DELETED","object":%s}`, object),
+			},
+			// The list and every event but the bookmark
+			changes: 4,
+		},
+		{
+			description: "resource version too old",
+			objects:     map[string]string{},
+			events:      []string{fmt.Sprintf(`{"type":"ERROR","object":%s}`, expired)},
+			changes:     1,
+			expectedErr: apierrors.IsResourceExpired,
+		},
+		{
+			description: "CRD not installed",
+			expectedErr: apierrors.IsNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			client, fake := newFakeVGPUNodeConfigClient(t, tc.objects)
+			fake.events = make(chan string, len(tc.events))
+			for _, event := range tc.events {
+				fake.events <- event
+			}
+			close(fake.events)
+
+			changes := 0
+			err := watchVGPUNodeConfigs(context.Background(), client, func() { changes++ })
+			if tc.expectedErr != nil {
+				if !tc.expectedErr(err) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if changes != tc.changes {
+				t.Errorf("expected %d changes, got %d", tc.changes, changes)
+			}
+			if tc.objects != nil && fake.watchResourceVersion != "7" {
+				t.Errorf("expected the watch to start from the resource version of the list, got %q", fake.watchResourceVersion)
+			}
+		})
+	}
+}
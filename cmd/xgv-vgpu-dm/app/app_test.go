@@ -0,0 +1,809 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/logging"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib/fakesysfs"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/exitcode"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+const (
+	type1G = fakesysfs.TestType1G
+	type2G = fakesysfs.TestType2G
+)
+
+const testConfig = `version: v1
+vgpu-configs:
+  all-1G:
+    - devices: all
+      vgpu-devices:
+        "XGV_V0_1G_1_CORE": 2
+  all-2G:
+    - devices: all
+      vgpu-devices:
+        "XGV_V0_2G_1_CORE": 2
+  too-large:
+    - devices: all
+      vgpu-devices:
+        "XGV_V0_2G_1_CORE": 3
+  max-1G:
+    - devices: all
+      vgpu-devices:
+        "XGV_V0_1G_1_CORE": max
+  max-2G:
+    - devices: all
+      vgpu-devices:
+        "XGV_V0_2G_1_CORE": max
+  filtered:
+    - devices: all
+      vgpu-devices:
+        "XGV_V0_1G_1_CORE": 2
+    - devices: all
+      device-filter: "0x20001eed"
+      vgpu-devices:
+        "XGV_V0_2G_1_CORE": 2
+  invalid-filter:
+    - devices: all
+      device-filter: ["0x20001eed", "unknown"]
+      vgpu-devices:
+        "XGV_V0_2G_1_CORE": 2
+  none:
+    - devices: all
+      vgpu-devices: {}
+  pinned-1G:
+    - devices: [0]
+      vgpu-devices:
+        "XGV_V0_1G_1_CORE": 2
+      vgpu-device-uuids:
+        "XGV_V0_1G_1_CORE": ["5b8e1e6a-5a1c-4d8b-9d3e-0c6f2a1b3c4d"]
+`
+
+// setupTest runs all commands against a fake sysfs with the given GPUs and returns
+// it, along with the path of a config file holding 'testConfig'
+func setupTest(t *testing.T, gpus ...fakesysfs.GPU) (*fakesysfs.Sysfs, string) {
+	t.Helper()
+	dir := t.TempDir()
+	fs, err := fakesysfs.New(filepath.Join(dir, "root"))
+	if err != nil {
+		t.Fatalf("unable to create fake sysfs: %v", err)
+	}
+	for _, gpu := range gpus {
+		if err := fs.AddGPU(gpu); err != nil {
+			t.Fatalf("unable to add GPU %s: %v", gpu.Address, err)
+		}
+	}
+
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte(testConfig), 0644); err != nil {
+		t.Fatalf("unable to write config file: %v", err)
+	}
+
+	previous := xdxlibInterface
+	xdxlibInterface = fs.Interface()
+	t.Cleanup(func() {
+		xdxlibInterface = previous
+	})
+	return fs, configFile
+}
+
+// run runs xgv-vgpu-dm with the given arguments and returns its exit code. The
+// flags of all commands are reset first, as cobra keeps them between runs.
+func run(t *testing.T, args ...string) int {
+	t.Helper()
+	resetFlags(rootCmd)
+	rootCmd.SetArgs(args)
+	rootCmd.SilenceUsage = true
+	rootCmd.SilenceErrors = true
+	err := rootCmd.Execute()
+	if cancelCommand != nil {
+		cancelCommand()
+	}
+	return exitcode.FromError(err)
+}
+
+func resetFlags(cmd *cobra.Command) {
+	reset := func(flag *pflag.Flag) {
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			_ = slice.Replace(nil)
+		} else {
+			_ = flag.Value.Set(flag.DefValue)
+		}
+		flag.Changed = false
+	}
+	cmd.PersistentFlags().VisitAll(reset)
+	cmd.Flags().VisitAll(reset)
+	for _, child := range cmd.Commands() {
+		resetFlags(child)
+	}
+}
+
+// mdevs returns the sorted UUIDs of the mdevs on a GPU of the fake sysfs
+func mdevs(fs *fakesysfs.Sysfs, address string) []string {
+	ids := fs.MDEVs()[address]
+	sort.Strings(ids)
+	return ids
+}
+
+// vgpuConfigs returns the vGPU config of every GPU of the fake sysfs
+func vgpuConfigs(t *testing.T) []types.VGPUConfig {
+	t.Helper()
+	snapshot, err := takeSnapshot()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	configs := make([]types.VGPUConfig, len(snapshot.GPUs))
+	for i := range snapshot.GPUs {
+		configs[i], err = snapshot.GetVGPUConfig(i)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return configs
+}
+
+// checkVGPUConfigs fails the test unless the GPUs of the fake sysfs have the expected vGPU configs
+func checkVGPUConfigs(t *testing.T, expected []types.VGPUConfig) {
+	t.Helper()
+	configs := vgpuConfigs(t)
+	if len(configs) != len(expected) {
+		t.Fatalf("expected %d GPUs, got %d", len(expected), len(configs))
+	}
+	for i := range expected {
+		if !configs[i].Equals(expected[i]) {
+			t.Errorf("expected vGPU config %v on GPU %d, got %v", expected[i], i, configs[i])
+		}
+	}
+}
+
+// captureStdout runs xgv-vgpu-dm with the given arguments and returns its exit code
+// along with what it printed to stdout
+func captureStdout(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unable to create pipe: %v", err)
+	}
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	code := run(t, args...)
+	os.Stdout = stdout
+	w.Close()
+	return code, <-output
+}
+
+func TestApplyAndAssert(t *testing.T) {
+	fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"), fakesysfs.NewTestGPU("0000:02:00.0"))
+
+	if code := run(t, "assert", "-f", configFile, "-c", "all-1G"); code != exitcode.NotApplied {
+		t.Fatalf("expected exit code %d before apply, got %d", exitcode.NotApplied, code)
+	}
+	if code := run(t, "apply", "-f", configFile, "-c", "all-1G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	for _, address := range []string{"0000:01:00.0", "0000:02:00.0"} {
+		if n := len(mdevs(fs, address)); n != 2 {
+			t.Errorf("expected 2 mdevs on %s, got %d", address, n)
+		}
+	}
+	if code := run(t, "assert", "-f", configFile, "-c", "all-1G"); code != exitcode.Success {
+		t.Fatalf("expected assert to succeed after apply, got exit code %d", code)
+	}
+
+	// Applying the same config again keeps the devices
+	before := mdevs(fs, "0000:01:00.0")
+	if code := run(t, "apply", "-f", configFile, "-c", "all-1G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	if after := mdevs(fs, "0000:01:00.0"); !slices.Equal(before, after) {
+		t.Errorf("expected mdevs %v to be kept, got %v", before, after)
+	}
+}
+
+func TestAssertPartialConfig(t *testing.T) {
+	fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"), fakesysfs.NewTestGPU("0000:02:00.0"))
+
+	// GPU 1 is not selected by 'pinned-1G', its devices must not be checked
+	if code := run(t, "apply", "-f", configFile, "--gpu", "1=all-2G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	if code := run(t, "apply", "-f", configFile, "-c", "pinned-1G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	checkVGPUConfigs(t, []types.VGPUConfig{{type1G: 2}, {type2G: 2}})
+	if code := run(t, "assert", "-f", configFile, "-c", "pinned-1G"); code != exitcode.Success {
+		t.Fatalf("expected assert to succeed after apply, got exit code %d", code)
+	}
+
+	// Applying the same config again keeps the devices of both GPUs
+	before := fs.MDEVs()
+	if code := run(t, "apply", "-f", configFile, "-c", "pinned-1G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	for _, address := range []string{"0000:01:00.0", "0000:02:00.0"} {
+		expected := before[address]
+		sort.Strings(expected)
+		if after := mdevs(fs, address); !slices.Equal(expected, after) {
+			t.Errorf("expected mdevs %v to be kept on %s, got %v", expected, address, after)
+		}
+	}
+
+	// The selected GPU is still checked
+	if code := run(t, "apply", "-f", configFile, "-c", "all-2G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	if code := run(t, "assert", "-f", configFile, "-c", "pinned-1G"); code != exitcode.NotApplied {
+		t.Fatalf("expected exit code %d, got %d", exitcode.NotApplied, code)
+	}
+}
+
+func TestAssertGPUConfigs(t *testing.T) {
+	testCases := []struct {
+		description string
+		args        []string
+		expected    []types.VGPUConfig
+	}{
+		{
+			description: "named config for a single GPU",
+			args:        []string{"--gpu", "0=all-1G"},
+			expected:    []types.VGPUConfig{{type1G: 2}, {}},
+		},
+		{
+			description: "named config for a GPU and selected config for the others",
+			args:        []string{"-c", "all-1G", "--gpu", "1=all-2G"},
+			expected:    []types.VGPUConfig{{type1G: 2}, {type2G: 2}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"), fakesysfs.NewTestGPU("0000:02:00.0"))
+
+			args := append([]string{"apply", "-f", configFile, "-s", ""}, tc.args...)
+			if code := run(t, args...); code != exitcode.Success {
+				t.Fatalf("expected apply to succeed, got exit code %d", code)
+			}
+			checkVGPUConfigs(t, tc.expected)
+			args = append([]string{"assert", "-f", configFile}, tc.args...)
+			if code := run(t, args...); code != exitcode.Success {
+				t.Fatalf("expected assert to succeed after apply, got exit code %d", code)
+			}
+
+			// A resync applying the same configs again keeps the devices
+			before := fs.MDEVs()
+			args = append([]string{"apply", "-f", configFile, "-s", ""}, tc.args...)
+			if code := run(t, args...); code != exitcode.Success {
+				t.Fatalf("expected apply to succeed, got exit code %d", code)
+			}
+			for _, address := range []string{"0000:01:00.0", "0000:02:00.0"} {
+				expected := before[address]
+				sort.Strings(expected)
+				if after := mdevs(fs, address); !slices.Equal(expected, after) {
+					t.Errorf("expected mdevs %v to be kept on %s, got %v", expected, address, after)
+				}
+			}
+		})
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	_, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+	t.Setenv("NODE_NAME", "node-a")
+
+	// Every command logs the config it selects, not one selected by a command before
+	for _, config := range []string{"all-1G", "", "all-2G"} {
+		args := []string{"--log-format", "json", "apply", "-f", configFile, "-s", ""}
+		if config != "" {
+			args = append(args, "-c", config)
+		} else {
+			args = append(args, "--gpu", "0=all-1G")
+		}
+		code, output := captureStdout(t, args...)
+		if code != exitcode.Success {
+			t.Fatalf("expected apply to succeed, got exit code %d", code)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+			var fields map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &fields); err != nil {
+				t.Fatalf("unable to parse log line %q: %v", line, err)
+			}
+			if fields[logging.NodeField] != "node-a" {
+				t.Errorf("expected node field node-a, got %v in %q", fields[logging.NodeField], line)
+			}
+			if value, exists := fields[logging.ConfigField]; (config == "" && exists) || (config != "" && value != config) {
+				t.Errorf("expected config field %q, got %v in %q", config, value, line)
+			}
+		}
+	}
+	if hooks := len(log.StandardLogger().Hooks[log.InfoLevel]); hooks != 1 {
+		t.Errorf("expected a single hook setting log fields, got %d", hooks)
+	}
+}
+
+func TestApplyPartiallyPinnedUUIDs(t *testing.T) {
+	fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+
+	if code := run(t, "apply", "-f", configFile, "-c", "pinned-1G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	before := mdevs(fs, "0000:01:00.0")
+	if len(before) != 2 || !slices.Contains(before, "5b8e1e6a-5a1c-4d8b-9d3e-0c6f2a1b3c4d") {
+		t.Fatalf("expected 2 mdevs including the pinned UUID, got %v", before)
+	}
+
+	// The device without a pinned UUID got a random one, which must not count as a mismatch
+	if code := run(t, "assert", "-f", configFile, "-c", "pinned-1G"); code != exitcode.Success {
+		t.Fatalf("expected assert to succeed after apply, got exit code %d", code)
+	}
+	if code := run(t, "apply", "-f", configFile, "-c", "pinned-1G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	if after := mdevs(fs, "0000:01:00.0"); !slices.Equal(before, after) {
+		t.Errorf("expected mdevs %v to be kept, got %v", before, after)
+	}
+}
+
+func TestApplyRelativeCounts(t *testing.T) {
+	fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+
+	// Resolved against the inventory of the snapshot taken before assert
+	if code := run(t, "apply", "-f", configFile, "-c", "max-1G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	if n := len(mdevs(fs, "0000:01:00.0")); n != 4 {
+		t.Errorf("expected 4 mdevs, got %d", n)
+	}
+	if code := run(t, "assert", "-f", configFile, "-c", "max-1G"); code != exitcode.Success {
+		t.Fatalf("expected assert to succeed after apply, got exit code %d", code)
+	}
+
+	// Resolved against the inventory of the GPU once its devices of other types are cleared
+	if code := run(t, "apply", "-f", configFile, "-c", "max-2G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	if n := len(mdevs(fs, "0000:01:00.0")); n != 2 {
+		t.Errorf("expected 2 mdevs, got %d", n)
+	}
+	if code := run(t, "assert", "-f", configFile, "-c", "max-2G"); code != exitcode.Success {
+		t.Fatalf("expected assert to succeed after apply, got exit code %d", code)
+	}
+}
+
+func TestApplyFailures(t *testing.T) {
+	testCases := []struct {
+		description string
+		args        []string
+		expected    int
+	}{
+		{
+			description: "unknown config",
+			args:        []string{"-c", "unknown"},
+			expected:    exitcode.UnknownConfig,
+		},
+		{
+			description: "layout infeasible",
+			args:        []string{"-c", "too-large"},
+			expected:    exitcode.LayoutInfeasible,
+		},
+		{
+			description: "GPU index out of range",
+			args:        []string{"-c", "all-2G", "--gpu", "5=all-1G"},
+			expected:    exitcode.ConfigInvalid,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+			if code := run(t, "apply", "-f", configFile, "-c", "all-1G", "-s", ""); code != exitcode.Success {
+				t.Fatalf("expected apply to succeed, got exit code %d", code)
+			}
+			before := mdevs(fs, "0000:01:00.0")
+
+			args := append([]string{"apply", "-f", configFile, "-s", ""}, tc.args...)
+			if code := run(t, args...); code != tc.expected {
+				t.Fatalf("expected exit code %d, got %d", tc.expected, code)
+			}
+			// The devices of the previous config are kept or restored
+			if after := mdevs(fs, "0000:01:00.0"); !slices.Equal(before, after) {
+				t.Errorf("expected mdevs %v to be kept, got %v", before, after)
+			}
+		})
+	}
+}
+
+func TestApplyDeviceBusy(t *testing.T) {
+	fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+	if code := run(t, "apply", "-f", configFile, "-c", "all-1G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	before := mdevs(fs, "0000:01:00.0")
+	if err := fs.SetBusy(before[1], true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if code := run(t, "apply", "-f", configFile, "-c", "all-2G", "-s", ""); code != exitcode.DeviceBusy {
+		t.Fatalf("expected exit code %d, got %d", exitcode.DeviceBusy, code)
+	}
+	if after := mdevs(fs, "0000:01:00.0"); !slices.Equal(before, after) {
+		t.Errorf("expected mdevs %v to be restored, got %v", before, after)
+	}
+}
+
+func TestApplyPermissionDenied(t *testing.T) {
+	fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+	fs.SetReadOnly(true)
+
+	if code := run(t, "apply", "-f", configFile, "-c", "all-1G", "-s", ""); code != exitcode.PermissionDenied {
+		t.Fatalf("expected exit code %d, got %d", exitcode.PermissionDenied, code)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	testCases := []struct {
+		description string
+		args        []string
+	}{
+		{
+			description: "selected config",
+			args:        []string{"-c", "all-1G"},
+		},
+		{
+			description: "named configs for specific GPUs",
+			args:        []string{"-c", "all-1G", "--gpu", "1=all-2G"},
+		},
+		{
+			description: "applied in parallel",
+			args:        []string{"-c", "all-1G", "--parallelism", "2"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"), fakesysfs.NewTestGPU("0000:02:00.0"))
+			stateFile := filepath.Join(t.TempDir(), "state.yaml")
+
+			args := append([]string{"apply", "-f", configFile, "-s", stateFile}, tc.args...)
+			if code := run(t, args...); code != exitcode.Success {
+				t.Fatalf("expected apply to succeed, got exit code %d", code)
+			}
+			applied := fs.MDEVs()
+
+			// Replace the devices, as if they were lost on reboot and others created since
+			if code := run(t, "apply", "-f", configFile, "-c", "max-2G", "-s", ""); code != exitcode.Success {
+				t.Fatalf("expected apply to succeed, got exit code %d", code)
+			}
+			if code := run(t, "restore", "-s", stateFile); code != exitcode.Success {
+				t.Fatalf("expected restore to succeed, got exit code %d", code)
+			}
+			for _, address := range []string{"0000:01:00.0", "0000:02:00.0"} {
+				expected := applied[address]
+				sort.Strings(expected)
+				if restored := mdevs(fs, address); !slices.Equal(expected, restored) {
+					t.Errorf("expected mdevs %v to be restored on %s, got %v", expected, address, restored)
+				}
+			}
+		})
+	}
+}
+
+func TestRestorePartialApply(t *testing.T) {
+	fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"), fakesysfs.NewTestGPU("0000:02:00.0"))
+	stateFile := filepath.Join(t.TempDir(), "state.yaml")
+
+	if code := run(t, "apply", "-f", configFile, "-c", "all-1G", "-s", stateFile); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	busy := mdevs(fs, "0000:01:00.0")
+	if err := fs.SetBusy(busy[0], true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if code := run(t, "apply", "-f", configFile, "-c", "all-2G", "--continue-on-error", "-s", stateFile); code != exitcode.DeviceBusy {
+		t.Fatalf("expected exit code %d, got %d", exitcode.DeviceBusy, code)
+	}
+	applied := mdevs(fs, "0000:02:00.0")
+
+	state, err := ReadStateFile(stateFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !state.Partial {
+		t.Errorf("expected the state to be partial")
+	}
+
+	// The GPU the apply failed on keeps its previous devices, the other one gets the applied ones
+	if err := fs.SetBusy(busy[0], false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if code := run(t, "apply", "-f", configFile, "-c", "max-1G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	if code := run(t, "restore", "-s", stateFile); code != exitcode.Success {
+		t.Fatalf("expected restore to succeed, got exit code %d", code)
+	}
+	if restored := mdevs(fs, "0000:01:00.0"); !slices.Equal(busy, restored) {
+		t.Errorf("expected mdevs %v to be restored on the failed GPU, got %v", busy, restored)
+	}
+	if restored := mdevs(fs, "0000:02:00.0"); !slices.Equal(applied, restored) {
+		t.Errorf("expected mdevs %v to be restored on the applied GPU, got %v", applied, restored)
+	}
+	checkVGPUConfigs(t, []types.VGPUConfig{{type1G: 2}, {type2G: 2}})
+}
+
+func TestRestoreCDISpec(t *testing.T) {
+	fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.yaml")
+	cdiSpecFile := filepath.Join(dir, "xdxct-vgpu.yaml")
+
+	if code := run(t, "apply", "-f", configFile, "-c", "all-1G", "-s", stateFile); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	// Drop the devices, as on reboot
+	if code := run(t, "apply", "-f", configFile, "-c", "all-2G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	if code := run(t, "restore", "-s", stateFile, "--cdi-spec-file", cdiSpecFile); code != exitcode.Success {
+		t.Fatalf("expected restore to succeed, got exit code %d", code)
+	}
+
+	spec, err := os.ReadFile(cdiSpecFile)
+	if err != nil {
+		t.Fatalf("expected restore to write the CDI spec: %v", err)
+	}
+	for _, id := range mdevs(fs, "0000:01:00.0") {
+		if !strings.Contains(string(spec), "name: "+id) {
+			t.Errorf("expected CDI spec to contain vGPU device %s, got:\n%s", id, spec)
+		}
+	}
+}
+
+func TestRestoreWait(t *testing.T) {
+	fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+	stateFile := filepath.Join(t.TempDir(), "state.yaml")
+
+	if code := run(t, "apply", "-f", configFile, "-c", "all-1G", "-s", stateFile); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	applied := mdevs(fs, "0000:01:00.0")
+
+	// Restore on a node whose GPU has not shown up yet, as at boot
+	fs, _ = setupTest(t)
+	if code := run(t, "restore", "-s", stateFile); code != exitcode.GPUNotFound {
+		t.Fatalf("expected exit code %d without waiting, got %d", exitcode.GPUNotFound, code)
+	}
+
+	added := make(chan error, 1)
+	go func() {
+		time.Sleep(2 * restoreWaitInterval)
+		added <- fs.AddGPU(fakesysfs.NewTestGPU("0000:01:00.0"))
+	}()
+	if code := run(t, "restore", "-s", stateFile, "--wait", "1m"); code != exitcode.Success {
+		t.Fatalf("expected restore to succeed, got exit code %d", code)
+	}
+	if err := <-added; err != nil {
+		t.Fatalf("unable to add GPU: %v", err)
+	}
+	if restored := mdevs(fs, "0000:01:00.0"); !slices.Equal(applied, restored) {
+		t.Errorf("expected mdevs %v to be restored, got %v", applied, restored)
+	}
+}
+
+// testGPUAddress returns the PCI address of the GPU at 'index' in TestApplyGPUs
+func testGPUAddress(index int) string {
+	return fmt.Sprintf("0000:%02d:00.0", index+1)
+}
+
+func TestApplyGPUs(t *testing.T) {
+	oneG := types.VGPUConfig{type1G: 2}
+	twoG := types.VGPUConfig{type2G: 2}
+
+	testCases := []struct {
+		description string
+		args        []string
+		busy        []int
+		expected    []types.VGPUConfig
+		code        int
+	}{
+		{
+			description: "sequential",
+			args:        []string{"-c", "all-2G"},
+			expected:    []types.VGPUConfig{twoG, twoG, twoG, twoG},
+			code:        exitcode.Success,
+		},
+		{
+			description: "parallel",
+			args:        []string{"-c", "all-2G", "--parallelism", "3"},
+			expected:    []types.VGPUConfig{twoG, twoG, twoG, twoG},
+			code:        exitcode.Success,
+		},
+		{
+			description: "stop at the first failure",
+			args:        []string{"-c", "all-2G"},
+			busy:        []int{1},
+			expected:    []types.VGPUConfig{twoG, oneG, oneG, oneG},
+			code:        exitcode.DeviceBusy,
+		},
+		{
+			description: "continue on error",
+			args:        []string{"-c", "all-2G", "--continue-on-error"},
+			busy:        []int{1},
+			expected:    []types.VGPUConfig{twoG, oneG, twoG, twoG},
+			code:        exitcode.DeviceBusy,
+		},
+		{
+			description: "continue on error in parallel",
+			args:        []string{"-c", "all-2G", "--continue-on-error", "--parallelism", "4"},
+			busy:        []int{1},
+			expected:    []types.VGPUConfig{twoG, oneG, twoG, twoG},
+			code:        exitcode.DeviceBusy,
+		},
+		{
+			description: "continue on error with several failures",
+			args:        []string{"-c", "all-2G", "--continue-on-error"},
+			busy:        []int{1, 2},
+			expected:    []types.VGPUConfig{twoG, oneG, oneG, twoG},
+			code:        exitcode.ApplyFailed,
+		},
+		{
+			description: "named configs for specific GPUs",
+			args:        []string{"-c", "all-2G", "--gpu", "1=all-1G", "--gpu", "3=all-1G"},
+			expected:    []types.VGPUConfig{twoG, oneG, twoG, oneG},
+			code:        exitcode.Success,
+		},
+		{
+			description: "named configs for specific GPUs only",
+			args:        []string{"--gpu", "2=all-2G"},
+			expected:    []types.VGPUConfig{oneG, oneG, twoG, oneG},
+			code:        exitcode.Success,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs, configFile := setupTest(t,
+				fakesysfs.NewTestGPU(testGPUAddress(0)),
+				fakesysfs.NewTestGPU(testGPUAddress(1)),
+				fakesysfs.NewTestGPU(testGPUAddress(2)),
+				fakesysfs.NewTestGPU(testGPUAddress(3)),
+			)
+			if code := run(t, "apply", "-f", configFile, "-c", "all-1G", "-s", ""); code != exitcode.Success {
+				t.Fatalf("expected apply to succeed, got exit code %d", code)
+			}
+			for _, index := range tc.busy {
+				if err := fs.SetBusy(mdevs(fs, testGPUAddress(index))[0], true); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			args := append([]string{"apply", "-f", configFile, "-s", ""}, tc.args...)
+			if code := run(t, args...); code != tc.code {
+				t.Fatalf("expected exit code %d, got %d", tc.code, code)
+			}
+			checkVGPUConfigs(t, tc.expected)
+		})
+	}
+}
+
+func TestApplyDeviceFilter(t *testing.T) {
+	other := fakesysfs.NewTestGPU("0000:02:00.0")
+	other.Device = 0x2000
+	_, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"), other)
+
+	if code := run(t, "apply", "-f", configFile, "-c", "invalid-filter", "-s", ""); code != exitcode.ConfigInvalid {
+		t.Fatalf("expected exit code %d, got %d", exitcode.ConfigInvalid, code)
+	}
+	checkVGPUConfigs(t, []types.VGPUConfig{{}, {}})
+
+	// The second entry only overrides the first one for the GPU with device ID 0x2000
+	if code := run(t, "apply", "-f", configFile, "-c", "filtered", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	checkVGPUConfigs(t, []types.VGPUConfig{{type1G: 2}, {type2G: 2}})
+	if code := run(t, "assert", "-f", configFile, "-c", "filtered"); code != exitcode.Success {
+		t.Fatalf("expected assert to succeed after apply, got exit code %d", code)
+	}
+}
+
+func TestExport(t *testing.T) {
+	testCases := []struct {
+		description string
+		format      string
+		expected    func(id string) string
+	}{
+		{
+			description: "libvirt",
+			format:      formatLibvirt,
+			expected: func(id string) string {
+				return "<address uuid='" + id + "'/>"
+			},
+		},
+		{
+			description: "cdi",
+			format:      formatCDI,
+			expected: func(id string) string {
+				return "name: " + id
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"), fakesysfs.NewTestGPU("0000:02:00.0"))
+			if code := run(t, "apply", "-f", configFile, "-c", "all-1G", "-s", ""); code != exitcode.Success {
+				t.Fatalf("expected apply to succeed, got exit code %d", code)
+			}
+
+			code, output := captureStdout(t, "export", "--format", tc.format)
+			if code != exitcode.Success {
+				t.Fatalf("expected export to succeed, got exit code %d", code)
+			}
+			for _, address := range []string{"0000:01:00.0", "0000:02:00.0"} {
+				for _, id := range mdevs(fs, address) {
+					if !strings.Contains(output, tc.expected(id)) {
+						t.Errorf("expected export to contain %q, got:\n%s", tc.expected(id), output)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestExportImportMdevctl(t *testing.T) {
+	fs, configFile := setupTest(t, fakesysfs.NewTestGPU("0000:01:00.0"), fakesysfs.NewTestGPU("0000:02:00.0"))
+	mdevctlDir := filepath.Join(t.TempDir(), "mdevctl")
+
+	if code := run(t, "apply", "-f", configFile, "-c", "all-2G", "--gpu", "1=all-1G", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	exported := map[string][]string{
+		"0000:01:00.0": mdevs(fs, "0000:01:00.0"),
+		"0000:02:00.0": mdevs(fs, "0000:02:00.0"),
+	}
+	if code := run(t, "export", "--format", formatMdevctl, "--mdevctl-dir", mdevctlDir); code != exitcode.Success {
+		t.Fatalf("expected export to succeed, got exit code %d", code)
+	}
+
+	// Delete the devices, then recreate them from the imported config
+	if code := run(t, "apply", "-f", configFile, "-c", "none", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply to succeed, got exit code %d", code)
+	}
+	code, imported := captureStdout(t, "import", "--mdevctl-dir", mdevctlDir, "-c", "restored")
+	if code != exitcode.Success {
+		t.Fatalf("expected import to succeed, got exit code %d", code)
+	}
+	importedFile := filepath.Join(t.TempDir(), "imported.yaml")
+	if err := os.WriteFile(importedFile, []byte(imported), 0644); err != nil {
+		t.Fatalf("unable to write imported config: %v", err)
+	}
+	if code := run(t, "apply", "-f", importedFile, "-c", "restored", "-s", ""); code != exitcode.Success {
+		t.Fatalf("expected apply of the imported config to succeed, got exit code %d:\n%s", code, imported)
+	}
+
+	checkVGPUConfigs(t, []types.VGPUConfig{{type2G: 2}, {type1G: 2}})
+	for address, ids := range exported {
+		if restored := mdevs(fs, address); !slices.Equal(ids, restored) {
+			t.Errorf("expected mdevs %v on %s, got %v", ids, address, restored)
+		}
+	}
+}
@@ -6,6 +6,11 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/logging"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/cdi"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/exitcode"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
 )
 
 var applyFlags = Flags{}
@@ -19,23 +24,57 @@ func applyWrapper() error {
 	log.Debugf("Parsing config file...")
 	spec, err := ParseConfigFile(&applyFlags)
 	if err != nil {
-		return fmt.Errorf("failed to parse config file: %v", err)
+		return fmt.Errorf("%w: failed to parse config file: %w", exitcode.ErrConfigInvalid, err)
 	}
 
 	VGPUConfig, err := GetSelectedVGPUConfig(&applyFlags, spec)
+	auditor = auditor.WithConfig(applyFlags.SelectedConfig)
 	log.Debugf("Selecting specific vgpu configuration: %v", VGPUConfig)
 	if err != nil {
-		return fmt.Errorf("failed to select vgpu config: %v", err)
+		return fmt.Errorf("failed to select vgpu config: %w", err)
+	}
+
+	err = ValidateVGPUConfig(VGPUConfig)
+	if err != nil {
+		return fmt.Errorf("%w: %w", exitcode.ErrConfigInvalid, err)
+	}
+
+	// The GPUs are scanned once, assert and apply both check the config against this snapshot
+	snapshot, err := takeSnapshot()
+	if err != nil {
+		return err
 	}
 
 	log.Infoln("Assert vGPU device configuration and check current vgpu device...")
-	err = AssertVGPUConfig(VGPUConfig)
+	err = AssertVGPUConfig(&applyFlags, snapshot, VGPUConfig)
 	if err != nil {
 		log.Infoln("Apply vGPU device configuration...")
-		err := ApplyVGPUConfig(VGPUConfig)
+		outcomes, err := ApplyVGPUConfig(&applyFlags, snapshot, VGPUConfig)
+		switch {
+		case len(outcomes) == 0:
+		case LogFormat == logging.FormatJSON:
+			logSummary(outcomes)
+		default:
+			if err := printSummary(os.Stdout, outcomes); err != nil {
+				log.Warnf("Unable to print summary: %v", err)
+			}
+		}
 		if err != nil {
-			return err
+			// The GPUs the config was applied to must not be restored to their previous layout
+			if stateErr := saveState(&applyFlags, outcomes); stateErr != nil {
+				log.Warnf("Unable to record the partially applied vGPU devices: %v", stateErr)
+			}
+			return fmt.Errorf("%w: %w", exitcode.ErrApplyFailed, err)
 		}
+	}
+
+	err = saveState(&applyFlags, nil)
+	if err != nil {
+		return err
+	}
+
+	err = saveCDISpec(&applyFlags)
+	if err != nil {
 		return err
 	}
 
@@ -43,6 +82,54 @@ func applyWrapper() error {
 	return nil
 }
 
+// saveState records the applied vGPU devices in the state file, if enabled. If 'outcomes'
+// holds failed GPUs, the state is partial: the failed GPUs keep their entries from the
+// previous state file, if any, as their current vGPU devices may be incomplete.
+func saveState(f *Flags, outcomes []GPUOutcome) error {
+	if f.StateFile == "" {
+		return nil
+	}
+	log.Debugf("Writing state file %s...", f.StateFile)
+	state, err := GetCurrentState(f)
+	if err != nil {
+		return fmt.Errorf("failed to get current state: %v", err)
+	}
+
+	failed := make(map[string]bool)
+	for _, outcome := range outcomes {
+		if outcome.Result == GPUFailed {
+			failed[outcome.Address] = true
+		}
+	}
+	if len(failed) > 0 {
+		previous := make(map[string]GPUState)
+		if previousState, err := ReadStateFile(f.StateFile); err == nil {
+			for _, gpuState := range previousState.GPUs {
+				previous[gpuState.Address] = gpuState
+			}
+		}
+		var gpus []GPUState
+		for _, gpuState := range state.GPUs {
+			if failed[gpuState.Address] {
+				var exists bool
+				gpuState, exists = previous[gpuState.Address]
+				if !exists {
+					continue
+				}
+			}
+			gpus = append(gpus, gpuState)
+		}
+		state.GPUs = gpus
+		state.Partial = true
+	}
+
+	err = WriteStateFile(f.StateFile, state)
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
 var applyCmd = &cobra.Command{
 	Use:   "apply",
 	Short: "Apply changes (if necessary) for a specific vGPU device configuration from a configuration file",
@@ -57,6 +144,14 @@ var applyCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(applyCmd)
-	applyCmd.PersistentFlags().StringVarP(&applyFlags.ConfigFile, "config-file", "f", os.Getenv("XGV_VGPU_DM_CONFIG_FILE"), "Path to the configuration file")
+	applyCmd.PersistentFlags().StringVarP(&applyFlags.ConfigFile, "config-file", "f", os.Getenv("XGV_VGPU_DM_CONFIG_FILE"), "Path to the configuration file, or a directory of configuration fragments")
 	applyCmd.PersistentFlags().StringVarP(&applyFlags.SelectedConfig, "selected-config", "c", os.Getenv("XGV_VGPU_DM_SELECTED_CONFIG"), "The label of the vgpu-config from the config file to apply to the node")
+	applyCmd.PersistentFlags().StringArrayVar(&applyFlags.GPUConfigs, "gpu", getenvListOrDefault("XGV_VGPU_DM_GPU_CONFIGS", nil), "Apply the vgpu-config with the given label to a specific GPU instead of the selected config, as 'index=label' (can be repeated)")
+	applyCmd.PersistentFlags().StringVarP(&applyFlags.StateFile, "state-file", "s", getenvOrDefault("XGV_VGPU_DM_STATE_FILE", DefaultStateFile), "Path to the state file recording the applied vGPU devices, empty to disable")
+	applyCmd.PersistentFlags().StringVar(&applyFlags.CDISpecFile, "cdi-spec-file", os.Getenv("XGV_VGPU_DM_CDI_SPEC_FILE"), fmt.Sprintf("Path to the CDI spec file regenerated for the vGPU devices after apply, e.g. %s, empty to disable", cdi.DefaultSpecFile))
+	applyCmd.PersistentFlags().BoolVar(&applyFlags.DeterministicUUIDs, "deterministic-uuids", os.Getenv("XGV_VGPU_DM_DETERMINISTIC_UUIDS") == "true", "Derive the UUIDs of created vGPU devices from the node name, GPU address, type and ordinal instead of generating random UUIDs")
+	applyCmd.PersistentFlags().StringVar(&applyFlags.NodeName, "node-name", getenvOrDefault("NODE_NAME", hostname()), "The node name used to derive deterministic UUIDs")
+	applyCmd.PersistentFlags().StringVar(&applyFlags.Placement, "placement", getenvOrDefault("XGV_VGPU_DM_PLACEMENT", string(vgpu.PlacementPack)), "How vGPU devices are distributed over the parent devices of a GPU, e.g. its SR-IOV virtual functions: 'pack' or 'spread'")
+	applyCmd.PersistentFlags().IntVar(&applyFlags.Parallelism, "parallelism", getenvIntOrDefault("XGV_VGPU_DM_PARALLELISM", 1), "The number of GPUs checked and configured concurrently")
+	applyCmd.PersistentFlags().BoolVar(&applyFlags.ContinueOnError, "continue-on-error", os.Getenv("XGV_VGPU_DM_CONTINUE_ON_ERROR") == "true", "Keep configuring the remaining GPUs after a GPU failed, instead of stopping at the first failure")
 }
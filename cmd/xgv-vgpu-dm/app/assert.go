@@ -0,0 +1,70 @@
+package app
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/exitcode"
+)
+
+var assertFlags = Flags{}
+
+func assertWrapper() error {
+	err := CheckFlags(&assertFlags)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Parsing config file...")
+	spec, err := ParseConfigFile(&assertFlags)
+	if err != nil {
+		return fmt.Errorf("%w: failed to parse config file: %w", exitcode.ErrConfigInvalid, err)
+	}
+
+	VGPUConfig, err := GetSelectedVGPUConfig(&assertFlags, spec)
+	if err != nil {
+		return fmt.Errorf("failed to select vgpu config: %w", err)
+	}
+
+	err = ValidateVGPUConfig(VGPUConfig)
+	if err != nil {
+		return fmt.Errorf("%w: %w", exitcode.ErrConfigInvalid, err)
+	}
+
+	snapshot, err := takeSnapshot()
+	if err != nil {
+		return err
+	}
+	err = AssertVGPUConfig(&assertFlags, snapshot, VGPUConfig)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Selected vGPU device configuration is currently applied")
+	return nil
+}
+
+var assertCmd = &cobra.Command{
+	Use:   "assert",
+	Short: "Assert that a specific vGPU device configuration from a configuration file is currently applied",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := assertWrapper(); err != nil {
+			log.Errorln(err)
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(assertCmd)
+	assertCmd.PersistentFlags().StringVarP(&assertFlags.ConfigFile, "config-file", "f", os.Getenv("XGV_VGPU_DM_CONFIG_FILE"), "Path to the configuration file, or a directory of configuration fragments")
+	assertCmd.PersistentFlags().StringVarP(&assertFlags.SelectedConfig, "selected-config", "c", os.Getenv("XGV_VGPU_DM_SELECTED_CONFIG"), "The label of the vgpu-config from the config file to assert")
+	assertCmd.PersistentFlags().StringArrayVar(&assertFlags.GPUConfigs, "gpu", getenvListOrDefault("XGV_VGPU_DM_GPU_CONFIGS", nil), "Assert the vgpu-config with the given label on a specific GPU instead of the selected config, as 'index=label' (can be repeated)")
+	assertCmd.PersistentFlags().BoolVar(&assertFlags.DeterministicUUIDs, "deterministic-uuids", os.Getenv("XGV_VGPU_DM_DETERMINISTIC_UUIDS") == "true", "Also assert that the UUIDs of the vGPU devices are derived from the node name, GPU address, type and ordinal")
+	assertCmd.PersistentFlags().StringVar(&assertFlags.NodeName, "node-name", getenvOrDefault("NODE_NAME", hostname()), "The node name used to derive deterministic UUIDs")
+	assertCmd.PersistentFlags().IntVar(&assertFlags.Parallelism, "parallelism", getenvIntOrDefault("XGV_VGPU_DM_PARALLELISM", 1), "The number of GPUs checked concurrently")
+}
@@ -0,0 +1,35 @@
+package app
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/cdi"
+)
+
+// getCDISpec returns the CDI spec of all vGPU devices on the node
+func getCDISpec() (*cdi.Spec, error) {
+	devices, err := xdxlibInterface.Xdxmdev.GetAllMediatedDevices()
+	if err != nil {
+		return nil, fmt.Errorf("error getting all vgpu devices: %v", err)
+	}
+	return cdi.NewSpec(devices), nil
+}
+
+// saveCDISpec regenerates the CDI spec file for the vGPU devices on the node, if enabled
+func saveCDISpec(f *Flags) error {
+	if f.CDISpecFile == "" {
+		return nil
+	}
+	log.Debugf("Writing CDI spec file %s...", f.CDISpecFile)
+	spec, err := getCDISpec()
+	if err != nil {
+		return fmt.Errorf("failed to get CDI spec: %v", err)
+	}
+	err = cdi.WriteSpecFile(f.CDISpecFile, spec)
+	if err != nil {
+		return fmt.Errorf("failed to write CDI spec file: %v", err)
+	}
+	return nil
+}
@@ -2,154 +2,307 @@ package app
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 
-	"github.com/chen-mao/go-xdxlib/pkg/xdxpci"
+	v1 "github.com/chen-mao/xdxct-vgpu-device-manager/api/spec/v1"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/logging"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/tracing"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/config"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/exitcode"
 	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
 	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
-	"gopkg.in/yaml.v2"
 )
 
-func ParseConfigFile(f *Flags) (*Spec, error) {
+func ParseConfigFile(f *Flags) (*v1.Spec, error) {
+	if f.ConfigFile != "-" {
+		return config.ParseFile(f.ConfigFile)
+	}
+
 	var configYaml []byte
-	var err error
-	if f.ConfigFile == "-" {
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			configYaml = append(configYaml, scanner.Bytes()...)
-			configYaml = append(configYaml, '\n')
-		}
-	} else {
-		configYaml, err = os.ReadFile(f.ConfigFile)
-		if err != nil {
-			return nil, fmt.Errorf("read file error: %v", err)
-		}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		configYaml = append(configYaml, scanner.Bytes()...)
+		configYaml = append(configYaml, '\n')
 	}
+	return config.Parse(configYaml)
+}
 
-	var spec Spec
-	err = yaml.Unmarshal(configYaml, &spec)
+func GetSelectedVGPUConfig(f *Flags, spec *v1.Spec) (v1.VGPUConfigSpecSlice, error) {
+	gpuConfigs, err := parseGPUConfigs(f.GPUConfigs)
 	if err != nil {
-		return nil, fmt.Errorf("unmarshal error: %v", err)
+		return nil, err
 	}
-	return &spec, nil
-}
 
-func GetSelectedVGPUConfig(f *Flags, spec *Spec) (VGPUConfigSpecSlice, error) {
-	if f.SelectedConfig == "" && len(spec.VGPUConfigs) > 1 {
+	if f.SelectedConfig == "" && len(gpuConfigs) == 0 && len(spec.VGPUConfigs) > 1 {
 		return nil, fmt.Errorf("missing required flag 'selected-config' when more than one config available")
 	}
 
-	if f.SelectedConfig == "" && len(spec.VGPUConfigs) == 1 {
+	if f.SelectedConfig == "" && len(gpuConfigs) == 0 && len(spec.VGPUConfigs) == 1 {
 		for c := range spec.VGPUConfigs {
 			f.SelectedConfig = c
 		}
 	}
 
-	if _, exists := spec.VGPUConfigs[f.SelectedConfig]; !exists {
-		return nil, fmt.Errorf("select vgpu-conig not present: %v", f.SelectedConfig)
+	if len(gpuConfigs) == 0 || f.SelectedConfig != "" {
+		if _, exists := spec.VGPUConfigs[f.SelectedConfig]; !exists {
+			return nil, fmt.Errorf("%w: %v", exitcode.ErrUnknownConfig, f.SelectedConfig)
+		}
+	}
+	if len(gpuConfigs) == 0 {
+		return spec.VGPUConfigs[f.SelectedConfig], nil
+	}
+	for index, name := range gpuConfigs {
+		if _, exists := spec.VGPUConfigs[name]; !exists {
+			return nil, fmt.Errorf("%w for GPU %d: %v", exitcode.ErrUnknownConfig, index, name)
+		}
 	}
-	return spec.VGPUConfigs[f.SelectedConfig], nil
-}
 
-func WalkSelectedVGPUConfigForEachGPU(vGPUConfig VGPUConfigSpecSlice, f func(VGPUConfigSpec, int) error) error {
-	xdxpci := xdxpci.New()
-	gpus, err := xdxpci.GetGPUs()
-	log.Debugf("gpu on node: %d", len(gpus))
+	// Named configs selected for specific GPUs replace the selected config on these GPUs
+	gpus, err := xdxlibInterface.Xdxpci.GetGPUs()
 	if err != nil {
-		return fmt.Errorf("error enumerating GPUs: %v", err)
+		return nil, fmt.Errorf("error enumerating GPUs: %v", err)
 	}
-	for _, vc := range vGPUConfig {
-		if vc.DeviceFilter == nil {
-			log.Debugf("Walking VGPUConfig for (devices=%v)", vc.Devices)
-		} else {
-			log.Debugf("Walking VGPUConfig for (device-filter=%v, devices=%v)", vc.DeviceFilter, vc.Devices)
-		}
+	composed, err := spec.ComposeVGPUConfig(f.SelectedConfig, gpuConfigs, len(gpus))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", exitcode.ErrConfigInvalid, err)
+	}
+	return composed, nil
+}
 
-		for i, gpu := range gpus {
-			// to do
-			deviceID := types.NewDeviceID(gpu.Device, gpu.Vendor)
-			// if !vc.MatchDeviceFilter(deviceID) {
-			// 	continue
-			// }
+// vgpuDeviceReader reads the vGPU devices of a GPU, either live or from a snapshot
+type vgpuDeviceReader interface {
+	GetVGPUConfig(gpu int) (types.VGPUConfig, error)
+	GetVGPUDevices(gpu int) ([]types.VGPUDevice, error)
+}
 
-			if !vc.MatchDevices(i) {
-				continue
-			}
+// gpuInventoryReader reads the inventory of a GPU, either live or from a snapshot
+type gpuInventoryReader interface {
+	GetGPUInventory(gpu int) (*types.GPUInventory, error)
+}
 
-			log.Debugf("GPU %v: %v", i, deviceID)
+// liveInventory reads the inventory of a GPU from xdxlibInterface on every call
+type liveInventory struct{}
 
-			err = f(vc, i)
-			if err != nil {
-				return nil
-			}
+func (liveInventory) GetGPUInventory(gpu int) (*types.GPUInventory, error) {
+	return vgpu.GetGPUInventory(gpu, vgpu.WithXdxlib(xdxlibInterface))
+}
+
+// takeSnapshot enumerates the GPUs of xdxlibInterface and their vGPU devices once
+func takeSnapshot() (*vgpu.Snapshot, error) {
+	snapshot, err := vgpu.TakeSnapshot(vgpu.WithXdxlib(xdxlibInterface))
+	if err != nil {
+		return nil, fmt.Errorf("error taking snapshot of vGPU devices: %v", err)
+	}
+	return snapshot, nil
+}
+
+// getUUIDGenerator returns the generator of the UUIDs of the vGPU devices of 'vs',
+// or nil if random UUIDs should be used
+func getUUIDGenerator(f *Flags, vs v1.VGPUConfigSpec) vgpu.UUIDGenerator {
+	var generator vgpu.UUIDGenerator
+	if f.DeterministicUUIDs {
+		generator = vgpu.NewDeterministicUUIDGenerator(f.NodeName)
+	}
+	if len(vs.VGPUDeviceUUIDs) > 0 {
+		fallback := generator
+		if fallback == nil {
+			fallback = vgpu.NewRandomUUIDGenerator()
 		}
+		generator = vgpu.NewPinnedUUIDGenerator(vs.VGPUDeviceUUIDs, fallback)
 	}
+	return generator
+}
 
-	return nil
+// resolveVGPUConfig resolves the vGPU device counts of 'vs' for a GPU against its inventory.
+// Relative counts can only be resolved if the GPU has no vGPU devices of other types,
+// 'resolved' is false otherwise.
+func resolveVGPUConfig(inventories gpuInventoryReader, vs v1.VGPUConfigSpec, index int) (config types.VGPUConfig, resolved bool, err error) {
+	if !vs.VGPUDevices.IsRelative() {
+		return vs.VGPUDevices.Absolute(), true, nil
+	}
+	inventory, err := inventories.GetGPUInventory(index)
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting inventory of GPU %d: %w", index, err)
+	}
+	config, resolved = vs.VGPUDevices.Resolve(inventory)
+	if resolved {
+		logging.ForGPU(index, inventory.Address).Debugf("Resolved vGPU config %v: %v", vs.VGPUDevices, config)
+	}
+	return config, resolved, nil
 }
 
-// AssertVGPUConfig asserts that the selected vGPU config is applied to the node
-func AssertVGPUConfig(vGPUConfig VGPUConfigSpecSlice) error {
-	xdxpci := xdxpci.New()
-	gpus, err := xdxpci.GetGPUs()
+// isVGPUConfigApplied checks if the vGPU devices of 'vgpuConfig' already exist on a GPU.
+// When UUIDs are not random, the UUIDs of the existing devices must match as well.
+func isVGPUConfigApplied(current vgpuDeviceReader, index int, address string, vgpuConfig types.VGPUConfig, generator vgpu.UUIDGenerator) (bool, error) {
+	currentVGPUConfig, err := current.GetVGPUConfig(index)
 	if err != nil {
-		return fmt.Errorf("error get gpus info: %v", err)
+		return false, fmt.Errorf("error getting vGPU config: %w", err)
 	}
-	matched := make([]bool, len(gpus))
-	err = WalkSelectedVGPUConfigForEachGPU(vGPUConfig, func(vs VGPUConfigSpec, index int) error {
-		configManager := vgpu.NewXdxlibVGPUConfigManager()
-		currentVGPUConfig, err := configManager.GetVGPUConfig(index)
-		if err != nil {
-			return fmt.Errorf("error get vGPU config: %v", err)
+	logging.ForGPU(index, address).Debugf("Current vGPU config: %v", currentVGPUConfig)
+	if !currentVGPUConfig.Equals(vgpuConfig) {
+		return false, nil
+	}
+	if generator == nil {
+		return true, nil
+	}
+
+	devices, err := current.GetVGPUDevices(index)
+	if err != nil {
+		return false, fmt.Errorf("error getting vGPU devices: %w", err)
+	}
+	return vgpu.MatchesUUIDs(devices, vgpuConfig, address, generator), nil
+}
+
+// ValidateVGPUConfig checks the entries of the selected vGPU config before walking the GPUs
+func ValidateVGPUConfig(vGPUConfig v1.VGPUConfigSpecSlice) error {
+	for _, vc := range vGPUConfig {
+		if err := vc.VGPUDevices.Validate(); err != nil {
+			return err
+		}
+		if err := vc.ValidateUUIDs(); err != nil {
+			return err
+		}
+		if err := vc.ValidateDeviceFilter(); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// AssertVGPUConfig asserts that the selected vGPU config is applied to the GPUs of 'snapshot'
+// it selects. GPUs no entry of the config selects are left out of the check.
+func AssertVGPUConfig(f *Flags, snapshot *vgpu.Snapshot, vGPUConfig v1.VGPUConfigSpecSlice) (err error) {
+	_, span := tracing.Start(commandCtx, "assert")
+	defer func() { tracing.End(span, err) }()
+	matched := make([]bool, len(snapshot.GPUs))
+	outcomes, err := WalkSelectedVGPUConfigForEachGPU(snapshot.GPUs, vGPUConfig, walkOptions{Parallelism: f.Parallelism}, func(vs v1.VGPUConfigSpec, index int) (bool, error) {
+		generator := getUUIDGenerator(f, vs)
+		logger := logging.ForGPU(index, snapshot.GPUs[index].Address)
 
-		log.Debugf("Asserting vGPU config: %v", vs.VGPUDevices)
-		if currentVGPUConfig.Equals(vs.VGPUDevices) {
-			log.Debugf("Skipping -- already set to desired value")
+		logger.Debugf("Asserting vGPU config: %v", vs.VGPUDevices)
+		vgpuConfig, resolved, err := resolveVGPUConfig(snapshot, vs, index)
+		if err != nil {
+			return false, err
+		}
+		if !resolved {
+			matched[index] = false
+			return false, nil
+		}
+		applied, err := isVGPUConfigApplied(snapshot, index, snapshot.GPUs[index].Address, vgpuConfig, generator)
+		if err != nil {
+			return false, fmt.Errorf("error get vGPU config: %w", err)
+		}
+		if applied {
+			logger.Debugf("Skipping -- already set to desired value")
 			matched[index] = true
-			return nil
+			return false, nil
 		}
 
 		matched[index] = false
-		return nil
+		return false, nil
 	})
 
 	if err != nil {
 		return err
 	}
 
-	for _, match := range matched {
-		if !match {
-			return fmt.Errorf("not all GPUs match the specified config")
+	for _, outcome := range outcomes {
+		if !matched[outcome.Index] {
+			return exitcode.ErrNotApplied
 		}
 	}
 
 	return nil
 }
 
-// ApplyVGPUConfig applies the selected vGPU config to the node
-func ApplyVGPUConfig(VGPUConfig VGPUConfigSpecSlice) error {
-	return WalkSelectedVGPUConfigForEachGPU(VGPUConfig, func(vs VGPUConfigSpec, index int) error {
-		configManager := vgpu.NewXdxlibVGPUConfigManager()
-		currentVGPUConfig, err := configManager.GetVGPUConfig(index)
+// ApplyVGPUConfig applies the selected vGPU config to the GPUs of 'snapshot', skipping those
+// it shows the config applied to, and returns the outcome for every GPU. The returned error
+// is a 'GPUErrors' if the config could not be applied to some GPUs.
+func ApplyVGPUConfig(f *Flags, snapshot *vgpu.Snapshot, VGPUConfig v1.VGPUConfigSpecSlice) (_ []GPUOutcome, err error) {
+	ctx, span := tracing.Start(commandCtx, "apply")
+	defer func() { tracing.End(span, err) }()
+	opts := walkOptions{
+		Parallelism:     f.Parallelism,
+		ContinueOnError: f.ContinueOnError,
+	}
+	return WalkSelectedVGPUConfigForEachGPU(snapshot.GPUs, VGPUConfig, opts, func(vs v1.VGPUConfigSpec, index int) (_ bool, err error) {
+		gpuCtx, gpuSpan := tracing.Start(ctx, "apply GPU",
+			attribute.Int(logging.GPUField, index),
+			attribute.String(logging.AddressField, snapshot.GPUs[index].Address))
+		defer func() { tracing.End(gpuSpan, err) }()
+
+		generator := getUUIDGenerator(f, vs)
+		configManager := newVGPUConfigManager(
+			vgpu.WithUUIDGenerator(generator),
+			vgpu.WithPlacementStrategy(vgpu.PlacementStrategy(f.Placement)),
+		)
+		logger := logging.ForGPU(index, snapshot.GPUs[index].Address)
+
+		vgpuConfig, resolved, err := resolveVGPUConfig(snapshot, vs, index)
 		if err != nil {
-			return fmt.Errorf("error getting vGPU config: %v", err)
+			return false, err
+		}
+		if !resolved {
+			logger.Debugf("Updating vGPU config: %v", vs.VGPUDevices)
+			err = setRelativeVGPUConfig(gpuCtx, logger, configManager, index, vs)
+			if err != nil {
+				return true, fmt.Errorf("error setting VGPU config: %w", err)
+			}
+			return true, nil
 		}
-		log.Debugf("Current vGPU config: %v", currentVGPUConfig)
 
-		if currentVGPUConfig.Equals(vs.VGPUDevices) {
-			log.Debugf("Skipping -- already set to desired value")
-			return nil
+		applied, err := isVGPUConfigApplied(snapshot, index, snapshot.GPUs[index].Address, vgpuConfig, generator)
+		if err != nil {
+			return false, err
+		}
+		if applied {
+			logger.Debugf("Skipping -- already set to desired value")
+			return false, nil
 		}
 
-		log.Debugf("Updating vGPU config: %v", vs.VGPUDevices)
-		err = configManager.SetVGPUConfig(index, vs.VGPUDevices)
+		logger.Debugf("Updating vGPU config: %v", vgpuConfig)
+		err = configManager.SetVGPUConfigContext(gpuCtx, index, vgpuConfig)
 		if err != nil {
-			return fmt.Errorf("error setting VGPU config: %v", err)
+			return true, fmt.Errorf("error setting VGPU config: %w", err)
 		}
-		return nil
+		return true, nil
 	})
 }
+
+// setRelativeVGPUConfig sets relative vGPU device counts on a GPU that has vGPU devices of
+// other types. These are cleared first so the counts can be resolved against the full
+// capacity of the GPU, and restored if the config cannot be set, even if 'ctx' is done.
+func setRelativeVGPUConfig(ctx context.Context, logger *log.Entry, configManager vgpu.Manager, index int, vs v1.VGPUConfigSpec) error {
+	previous, err := configManager.GetVGPUDevicesContext(ctx, index)
+	if err != nil {
+		return fmt.Errorf("error getting vGPU devices: %w", err)
+	}
+	var vgpuConfig types.VGPUConfig
+	resolved := false
+	err = configManager.ClearVGPUConfigContext(ctx, index)
+	if err != nil {
+		err = fmt.Errorf("error clearing vGPU config: %w", err)
+	} else {
+		// The GPU was cleared, so its inventory is read again
+		vgpuConfig, resolved, err = resolveVGPUConfig(liveInventory{}, vs, index)
+	}
+	if err == nil && !resolved {
+		err = fmt.Errorf("unable to resolve %v", vs.VGPUDevices)
+	}
+	if err == nil {
+		logger.Debugf("Updating vGPU config: %v", vgpuConfig)
+		err = configManager.SetVGPUConfigContext(ctx, index, vgpuConfig)
+	}
+	if err != nil {
+		if restoreErr := configManager.SetVGPUDevicesContext(context.WithoutCancel(ctx), index, previous); restoreErr != nil {
+			return fmt.Errorf("%w (restoring previous vGPU devices failed: %v)", err, restoreErr)
+		}
+		return err
+	}
+	return nil
+}
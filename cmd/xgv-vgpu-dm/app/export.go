@@ -0,0 +1,138 @@
+package app
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/libvirt"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/mdevctl"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+const (
+	formatLibvirt = "libvirt"
+	formatCDI     = "cdi"
+	formatMdevctl = "mdevctl"
+)
+
+var exportFlags = Flags{}
+
+func exportWrapper() error {
+	switch exportFlags.Format {
+	case formatLibvirt:
+		return exportLibvirt(&exportFlags)
+	case formatCDI:
+		spec, err := getCDISpec()
+		if err != nil {
+			return err
+		}
+		return spec.Write(os.Stdout)
+	case formatMdevctl:
+		return exportMdevctl(&exportFlags)
+	default:
+		return fmt.Errorf("invalid value for flag 'format': must be '%s', '%s' or '%s'", formatLibvirt, formatCDI, formatMdevctl)
+	}
+}
+
+// exportLibvirt prints a libvirt <hostdev> element per vGPU device, grouped by VM if assigned
+func exportLibvirt(f *Flags) error {
+	devices, err := getAllVGPUDevices()
+	if err != nil {
+		return err
+	}
+
+	var assignments libvirt.Assignments
+	if f.AssignmentsFile != "" {
+		log.Debugf("Reading assignments file...")
+		assignments, err = libvirt.ReadAssignments(f.AssignmentsFile)
+		if err != nil {
+			return fmt.Errorf("failed to read assignments file: %v", err)
+		}
+	}
+	return libvirt.WriteHostdevs(os.Stdout, devices, assignments)
+}
+
+// exportMdevctl writes persistent mdevctl definitions of the vGPU devices on the node,
+// replacing the definitions of other mdevs of the XDXCT GPUs
+func exportMdevctl(f *Flags) error {
+	snapshot, err := takeSnapshot()
+	if err != nil {
+		return err
+	}
+	ids, err := vgpu.GetMDEVTypeIDs(vgpu.WithXdxlib(xdxlibInterface))
+	if err != nil {
+		return fmt.Errorf("failed to get mdev type IDs: %v", err)
+	}
+
+	var parents []string
+	var definitions []mdevctl.Device
+	for i := range snapshot.GPUs {
+		gpuParents, err := snapshot.GetParentAddresses(i)
+		if err != nil {
+			return fmt.Errorf("error getting parent devices of GPU %d: %v", i, err)
+		}
+		parents = append(parents, gpuParents...)
+
+		devices, err := snapshot.GetVGPUDevices(i)
+		if err != nil {
+			return fmt.Errorf("error getting vGPU devices of GPU %d: %v", i, err)
+		}
+		for _, device := range devices {
+			definitions = append(definitions, mdevctl.Device{
+				UUID:          device.UUID,
+				ParentAddress: device.ParentAddress,
+				Definition: mdevctl.Definition{
+					MDEVType: ids[device.Type],
+					Start:    mdevctl.StartAuto,
+				},
+			})
+		}
+	}
+
+	log.Infof("Writing mdevctl definitions of %d vGPU devices to %s", len(definitions), f.MdevctlDir)
+	err = mdevctl.WriteDefinitions(f.MdevctlDir, definitions, parents)
+	if err != nil {
+		return fmt.Errorf("failed to write mdevctl definitions: %v", err)
+	}
+	return nil
+}
+
+// getAllVGPUDevices returns the vGPU devices of all GPUs on the node, ordered by GPU
+func getAllVGPUDevices() ([]types.VGPUDevice, error) {
+	snapshot, err := takeSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	var devices []types.VGPUDevice
+	for i := range snapshot.GPUs {
+		gpuDevices, err := snapshot.GetVGPUDevices(i)
+		if err != nil {
+			return nil, fmt.Errorf("error getting vGPU devices of GPU %d: %v", i, err)
+		}
+		devices = append(devices, gpuDevices...)
+	}
+	return devices, nil
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the vGPU devices on the node, e.g. as libvirt hostdev elements, a CDI spec or mdevctl definitions",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := exportWrapper(); err != nil {
+			log.Errorln(err)
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.PersistentFlags().StringVar(&exportFlags.Format, "format", formatLibvirt, "The export format: 'libvirt' for a <hostdev> element per vGPU device, 'cdi' for a Container Device Interface spec, or 'mdevctl' for persistent mdevctl definitions")
+	exportCmd.PersistentFlags().StringVar(&exportFlags.MdevctlDir, "mdevctl-dir", getenvOrDefault("XGV_VGPU_DM_MDEVCTL_DIR", mdevctl.DefaultDir), "Path to the directory the mdevctl definitions are written to")
+	exportCmd.PersistentFlags().StringVar(&exportFlags.AssignmentsFile, "assignments", os.Getenv("XGV_VGPU_DM_ASSIGNMENTS_FILE"), "Path to a YAML file mapping VM names to the UUIDs of their vGPU devices, to group the exported devices by VM")
+}
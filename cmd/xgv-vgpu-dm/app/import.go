@@ -0,0 +1,145 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	v1 "github.com/chen-mao/xdxct-vgpu-device-manager/api/spec/v1"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/logging"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/mdevctl"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+const (
+	fromMdevctl = "mdevctl"
+
+	// DefaultImportedConfig is the label of the vgpu-config an import is written to
+	DefaultImportedConfig = "imported"
+)
+
+var importFlags = Flags{}
+
+func importWrapper() error {
+	if importFlags.From != fromMdevctl {
+		return fmt.Errorf("invalid value for flag 'from': must be '%s'", fromMdevctl)
+	}
+	if importFlags.SelectedConfig == "" {
+		return fmt.Errorf("missing required flags 'selected-config'")
+	}
+
+	log.Debugf("Reading mdevctl definitions...")
+	devices, err := mdevctl.ReadDefinitions(importFlags.MdevctlDir)
+	if err != nil {
+		return fmt.Errorf("failed to read mdevctl definitions: %v", err)
+	}
+	vGPUConfig, err := convertMdevctlDefinitions(devices)
+	if err != nil {
+		return err
+	}
+
+	spec := v1.Spec{
+		Version: "v1",
+		VGPUConfigs: map[string]v1.VGPUConfigSpecSlice{
+			importFlags.SelectedConfig: vGPUConfig,
+		},
+	}
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("marshal error: %v", err)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// convertMdevctlDefinitions converts mdevctl definitions into a vgpu-config with an entry per
+// GPU that pins the UUIDs of the defined mdevs. Definitions of mdevs whose parent is not an
+// XDXCT GPU on the node are skipped.
+func convertMdevctlDefinitions(devices []mdevctl.Device) (v1.VGPUConfigSpecSlice, error) {
+	snapshot, err := takeSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	gpuIndexes := make(map[string]int)
+	for i := range snapshot.GPUs {
+		parents, err := snapshot.GetParentAddresses(i)
+		if err != nil {
+			return nil, fmt.Errorf("error getting parent devices of GPU %d: %v", i, err)
+		}
+		for _, parent := range parents {
+			gpuIndexes[parent] = i
+		}
+	}
+
+	ids, err := vgpu.GetMDEVTypeIDs(vgpu.WithXdxlib(xdxlibInterface))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mdev type IDs: %v", err)
+	}
+	mdevTypes := make(map[string]string)
+	for mdevType, id := range ids {
+		mdevTypes[id] = mdevType
+	}
+
+	vGPUConfigs := make(map[int]*v1.VGPUConfigSpec)
+	for _, device := range devices {
+		index, exists := gpuIndexes[device.ParentAddress]
+		if !exists {
+			logging.ForVGPUDevice(device.UUID, device.MDEVType, device.ParentAddress).Debugf("Skipping -- parent is not an XDXCT GPU")
+			continue
+		}
+		mdevType, exists := mdevTypes[device.MDEVType]
+		if !exists {
+			return nil, fmt.Errorf("mdev type %s of %s is not supported by any GPU", device.MDEVType, device.UUID)
+		}
+
+		vc, exists := vGPUConfigs[index]
+		if !exists {
+			vc = &v1.VGPUConfigSpec{
+				Devices:         []interface{}{index},
+				VGPUDevices:     v1.VGPUDeviceCounts{},
+				VGPUDeviceUUIDs: map[string][]string{},
+			}
+			vGPUConfigs[index] = vc
+		}
+		vc.VGPUDevices[mdevType] = v1.VGPUDeviceCount{Count: vc.VGPUDevices[mdevType].Count + 1}
+		vc.VGPUDeviceUUIDs[mdevType] = append(vc.VGPUDeviceUUIDs[mdevType], device.UUID)
+	}
+	if len(vGPUConfigs) == 0 {
+		return nil, fmt.Errorf("no mdevctl definitions of XDXCT vGPU devices found in %s", importFlags.MdevctlDir)
+	}
+
+	var indexes []int
+	for index := range vGPUConfigs {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var vGPUConfig v1.VGPUConfigSpecSlice
+	for _, index := range indexes {
+		vGPUConfig = append(vGPUConfig, *vGPUConfigs[index])
+	}
+	return vGPUConfig, nil
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Print a vGPU device configuration converted from the vGPU devices defined by another tool, e.g. mdevctl",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := importWrapper(); err != nil {
+			log.Errorln(err)
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.PersistentFlags().StringVar(&importFlags.From, "from", fromMdevctl, "The tool to import from: 'mdevctl' for its persistent definitions")
+	importCmd.PersistentFlags().StringVar(&importFlags.MdevctlDir, "mdevctl-dir", getenvOrDefault("XGV_VGPU_DM_MDEVCTL_DIR", mdevctl.DefaultDir), "Path to the directory of mdevctl definitions")
+	importCmd.PersistentFlags().StringVarP(&importFlags.SelectedConfig, "selected-config", "c", DefaultImportedConfig, "The label of the vgpu-config the imported vGPU devices are written to")
+}
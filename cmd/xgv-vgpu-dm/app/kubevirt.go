@@ -0,0 +1,151 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/kubevirt"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+const (
+	outputYAML  = "yaml"
+	outputPatch = "patch"
+)
+
+var kubevirtFlags = Flags{}
+
+func kubevirtWrapper() error {
+	if kubevirtFlags.Output != outputYAML && kubevirtFlags.Output != outputPatch {
+		return fmt.Errorf("invalid value for flag 'output': must be '%s' or '%s'", outputYAML, outputPatch)
+	}
+	if kubevirtFlags.Output == outputPatch && kubevirtFlags.KubeVirtFile == "" {
+		return fmt.Errorf("missing required flag 'kubevirt' for output '%s'", outputPatch)
+	}
+	if kubevirtFlags.KubeVirtFile == "-" && kubevirtFlags.ConfigFile == "-" {
+		return fmt.Errorf("only one of the flags 'kubevirt' and 'config-file' can read from stdin")
+	}
+
+	mdevTypes, err := getPermittedMDEVTypes(&kubevirtFlags)
+	if err != nil {
+		return err
+	}
+	if len(mdevTypes) == 0 {
+		return fmt.Errorf("no vGPU types to permit")
+	}
+	names, err := vgpu.GetMDEVTypeNames(vgpu.WithXdxlib(xdxlibInterface))
+	if err != nil {
+		return fmt.Errorf("failed to get mdev type names: %v", err)
+	}
+	devices, err := kubevirt.NewMediatedDevices(mdevTypes, names, kubevirtFlags.ResourcePrefix)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch kubevirtFlags.Output {
+	case outputPatch:
+		data, err = newKubeVirtPatch(kubevirtFlags.KubeVirtFile, devices, kubevirtFlags.ResourcePrefix)
+	default:
+		data, err = yaml.Marshal(map[string]kubevirt.PermittedHostDevices{
+			"permittedHostDevices": {MediatedDevices: devices},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode permittedHostDevices: %v", err)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// newKubeVirtPatch returns a merge patch making the devices the entries with the resource
+// prefix permitted by the KubeVirt CR in 'path', or '{}' if they already are. Like the
+// daemon, it keeps the other entries, and the patch fails if the CR changed in the meantime.
+func newKubeVirtPatch(path string, devices []kubevirt.MediatedDevice, prefix string) ([]byte, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read KubeVirt: %v", err)
+	}
+	kv, err := kubevirt.ParseKubeVirt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, changed := kubevirt.MergeMediatedDevices(kv.GetMediatedDevices(), devices, prefix)
+	if !changed {
+		log.Infof("The vGPU types are already permitted by KubeVirt %s", kv.Metadata.Name)
+		return []byte("{}\n"), nil
+	}
+	patch, err := kubevirt.NewMergePatch(merged, kv.Metadata.ResourceVersion)
+	if err != nil {
+		return nil, err
+	}
+	return append(patch, '\n'), nil
+}
+
+// getPermittedMDEVTypes returns the mdev types of the selected vGPU config if a config
+// file is given, otherwise the mdev types of the vGPU devices applied to the node
+func getPermittedMDEVTypes(f *Flags) ([]string, error) {
+	var mdevTypes []string
+	if f.ConfigFile == "" {
+		devices, err := getAllVGPUDevices()
+		if err != nil {
+			return nil, err
+		}
+		for _, device := range devices {
+			mdevTypes = append(mdevTypes, device.Type)
+		}
+		return mdevTypes, nil
+	}
+
+	log.Debugf("Parsing config file...")
+	spec, err := ParseConfigFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %v", err)
+	}
+	vGPUConfig, err := GetSelectedVGPUConfig(f, spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select vgpu config: %v", err)
+	}
+	for _, vc := range vGPUConfig {
+		for mdevType, count := range vc.VGPUDevices {
+			if count.IsRelative() || count.Count > 0 {
+				mdevTypes = append(mdevTypes, mdevType)
+			}
+		}
+	}
+	return mdevTypes, nil
+}
+
+var kubevirtCmd = &cobra.Command{
+	Use:   "kubevirt",
+	Short: "Print the KubeVirt permittedHostDevices exposing the vGPU types of a vGPU device configuration, or of the vGPU devices on the node",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := kubevirtWrapper(); err != nil {
+			log.Errorln(err)
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(kubevirtCmd)
+	kubevirtCmd.PersistentFlags().StringVarP(&kubevirtFlags.ConfigFile, "config-file", "f", os.Getenv("XGV_VGPU_DM_CONFIG_FILE"), "Path to the configuration file, or a directory of configuration fragments. If not set, the types of the vGPU devices on the node are used")
+	kubevirtCmd.PersistentFlags().StringVarP(&kubevirtFlags.SelectedConfig, "selected-config", "c", os.Getenv("XGV_VGPU_DM_SELECTED_CONFIG"), "The label of the vgpu-config from the config file")
+	kubevirtCmd.PersistentFlags().StringArrayVar(&kubevirtFlags.GPUConfigs, "gpu", getenvListOrDefault("XGV_VGPU_DM_GPU_CONFIGS", nil), "The vgpu-config with the given label for a specific GPU, as 'index=label' (can be repeated)")
+	kubevirtCmd.PersistentFlags().StringVar(&kubevirtFlags.ResourcePrefix, "resource-prefix", getenvOrDefault("XGV_VGPU_DM_RESOURCE_PREFIX", kubevirt.DefaultResourcePrefix), "The prefix of the resource names the vGPU types are exposed as")
+	kubevirtCmd.PersistentFlags().StringVarP(&kubevirtFlags.Output, "output", "o", outputYAML, "The output format: 'yaml' for a snippet of the KubeVirt CR, or 'patch' for a merge patch to use with 'kubectl patch --type merge', which makes the vGPU types those permitted with the resource prefix by the KubeVirt CR given with '--kubevirt'")
+	kubevirtCmd.PersistentFlags().StringVar(&kubevirtFlags.KubeVirtFile, "kubevirt", "", "Path to the KubeVirt CR as printed by 'kubectl get kubevirt -o json', or '-' for stdin. Required for '-o patch', whose patch keeps the entries of the CR without the resource prefix and fails if the CR changed since")
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/kubevirt"
+)
+
+const testKubeVirt = `{
+  "apiVersion": "kubevirt.io/v1",
+  "kind": "KubeVirt",
+  "metadata": {"name": "kubevirt", "namespace": "kubevirt", "resourceVersion": "42"},
+  "spec": {
+    "configuration": {
+      "permittedHostDevices": {
+        "mediatedDevices": [
+          {"mdevNameSelector": "GRID T4-1Q", "resourceName": "nvidia.com/GRID_T4-1Q"},
+          {"mdevNameSelector": "Type ID: 1; Type Name: XGV_V0_1G_1_CORE", "resourceName": "xdxct.com/XGV_V0_1G_1_CORE"},
+          {"mdevNameSelector": "Type ID: 4; Type Name: XGV_V0_4G_1_CORE", "resourceName": "xdxct.com/XGV_V0_4G_1_CORE", "externalResourceProvider": true}
+        ]
+      }
+    }
+  }
+}`
+
+func TestNewKubeVirtPatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubevirt.json")
+	if err := os.WriteFile(path, []byte(testKubeVirt), 0644); err != nil {
+		t.Fatalf("unable to write KubeVirt: %v", err)
+	}
+	names := map[string]string{
+		type1G: "Type ID: 1; Type Name: XGV_V0_1G_1_CORE",
+		type2G: "Type ID: 2; Type Name: XGV_V0_2G_1_CORE",
+	}
+
+	t.Run("replaces the entries with the resource prefix and keeps the others", func(t *testing.T) {
+		devices, err := kubevirt.NewMediatedDevices([]string{type1G, type2G}, names, kubevirt.DefaultResourcePrefix)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, err := newKubeVirtPatch(path, devices, kubevirt.DefaultResourcePrefix)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var patch struct {
+			Metadata struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"metadata"`
+			Spec struct {
+				Configuration struct {
+					PermittedHostDevices kubevirt.PermittedHostDevices `json:"permittedHostDevices"`
+				} `json:"configuration"`
+			} `json:"spec"`
+		}
+		if err := json.Unmarshal(data, &patch); err != nil {
+			t.Fatalf("unable to decode patch %s: %v", data, err)
+		}
+		if patch.Metadata.ResourceVersion != "42" {
+			t.Errorf("expected the patch to set resourceVersion 42, got %q", patch.Metadata.ResourceVersion)
+		}
+		var resources []string
+		for _, device := range patch.Spec.Configuration.PermittedHostDevices.MediatedDevices {
+			resources = append(resources, device.ResourceName)
+			if external := device.ResourceName != "nvidia.com/GRID_T4-1Q"; device.ExternalResourceProvider != external {
+				t.Errorf("expected externalResourceProvider %v for %s, got %v", external, device.ResourceName, device.ExternalResourceProvider)
+			}
+		}
+		expected := []string{"nvidia.com/GRID_T4-1Q", "xdxct.com/XGV_V0_1G_1_CORE", "xdxct.com/XGV_V0_2G_1_CORE"}
+		if !slices.Equal(resources, expected) {
+			t.Errorf("expected mediated devices %v, got %v", expected, resources)
+		}
+	})
+
+	t.Run("empty patch if the types are permitted", func(t *testing.T) {
+		devices, err := kubevirt.NewMediatedDevices([]string{type1G, type2G}, names, kubevirt.DefaultResourcePrefix)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		kv, err := kubevirt.ParseKubeVirt([]byte(testKubeVirt))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		kv.Spec.Configuration.PermittedHostDevices.MediatedDevices, _ = kubevirt.MergeMediatedDevices(kv.GetMediatedDevices(), devices, kubevirt.DefaultResourcePrefix)
+		data, err := json.Marshal(kv)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		path := filepath.Join(t.TempDir(), "kubevirt.json")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("unable to write KubeVirt: %v", err)
+		}
+		data, err = newKubeVirtPatch(path, devices, kubevirt.DefaultResourcePrefix)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(data) != "{}\n" {
+			t.Errorf("expected an empty patch, got %s", data)
+		}
+	})
+}
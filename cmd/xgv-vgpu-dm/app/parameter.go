@@ -1,6 +1,37 @@
 package app
 
+import "time"
+
 type Flags struct {
 	ConfigFile     string
 	SelectedConfig string
+	StateFile      string
+	// CDISpecFile is regenerated for the vGPU devices on the node after every apply
+	CDISpecFile string
+	// GPUConfigs selects named configs for specific GPUs as 'index=name'
+	GPUConfigs []string
+
+	DeterministicUUIDs bool
+	NodeName           string
+
+	Placement       string
+	Parallelism     int
+	ContinueOnError bool
+
+	// ResourcePrefix and Output configure the KubeVirt permittedHostDevices generated by
+	// 'kubevirt', and KubeVirtFile is the KubeVirt CR the patch is merged with
+	ResourcePrefix string
+	Output         string
+	KubeVirtFile   string
+
+	// Format and AssignmentsFile configure the vGPU devices written by 'export'
+	Format          string
+	AssignmentsFile string
+
+	// From and MdevctlDir configure the vGPU devices read by 'import'
+	From       string
+	MdevctlDir string
+
+	// Wait bounds the time 'restore' waits for the parent devices of the state file to show up
+	Wait time.Duration
 }
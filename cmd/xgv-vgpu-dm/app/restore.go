@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/logging"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/cdi"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+// restoreWaitInterval is how often 'restore' looks for the parent devices of the state file
+const restoreWaitInterval = time.Second
+
+var restoreFlags = Flags{}
+
+func restoreWrapper() error {
+	if restoreFlags.StateFile == "" {
+		return fmt.Errorf("missing required flags 'state-file'")
+	}
+
+	log.Debugf("Reading state file...")
+	state, err := ReadStateFile(restoreFlags.StateFile)
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	log.WithField(logging.ConfigField, state.SelectedConfig).Infof("Restoring vGPU config from '%s'", state.ConfigFile)
+	auditor = auditor.WithConfig(state.SelectedConfig)
+	if state.Partial {
+		log.Warnf("The last apply of '%s' failed on some GPUs, restoring their previous vGPU devices", state.SelectedConfig)
+	}
+
+	err = waitForParentDevices(commandCtx, state, restoreFlags.Wait)
+	if err != nil {
+		return err
+	}
+
+	gpus, err := xdxlibInterface.Xdxpci.GetGPUs()
+	if err != nil {
+		return fmt.Errorf("error enumerating GPUs: %v", err)
+	}
+	indexes := make(map[string]int)
+	for i, gpu := range gpus {
+		indexes[gpu.Address] = i
+	}
+
+	configManager := newVGPUConfigManager()
+	for _, gpuState := range state.GPUs {
+		// GPUs are looked up by address, indexes may change when GPUs are added or removed
+		index, exists := indexes[gpuState.Address]
+		if !exists {
+			return fmt.Errorf("GPU %d (address=%s) from state file not found", gpuState.Index, gpuState.Address)
+		}
+
+		current, err := configManager.GetVGPUDevicesContext(commandCtx, index)
+		if err != nil {
+			return fmt.Errorf("error getting vGPU devices: %w", err)
+		}
+		if equalVGPUDevices(current, gpuState.VGPUDevices) {
+			logging.ForGPU(index, gpuState.Address).Debugf("Skipping -- already restored")
+			continue
+		}
+
+		logging.ForGPU(index, gpuState.Address).Debugf("Restoring vGPU devices: %v", gpuState.VGPUDevices)
+		err = configManager.SetVGPUDevicesContext(commandCtx, index, gpuState.VGPUDevices)
+		if err != nil {
+			return fmt.Errorf("error restoring vGPU devices on GPU %d (address=%s): %w", index, gpuState.Address, err)
+		}
+	}
+
+	// The IOMMU groups of the recreated devices may differ from those before the reboot
+	err = saveCDISpec(&restoreFlags)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("vGPU device configuration successfully restored")
+	return nil
+}
+
+// waitForParentDevices waits up to 'timeout' for the GPUs of the state file and the
+// parent devices of their vGPU devices to show up, as at boot the driver may still be
+// probing them and creating their SR-IOV virtual functions
+func waitForParentDevices(ctx context.Context, state *State, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		missing, err := getMissingParentDevices(state)
+		if err == nil && len(missing) == 0 {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%w: parent devices %v from state file not found", vgpu.ErrGPUNotFound, missing)
+		}
+		if !time.Now().Before(deadline) {
+			return err
+		}
+		log.Debugf("Waiting for parent devices: %v", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (%w)", err, ctx.Err())
+		case <-time.After(restoreWaitInterval):
+		}
+	}
+}
+
+// getMissingParentDevices returns the addresses of the parent devices the vGPU devices of
+// the state file are created on, which are not present on the node
+func getMissingParentDevices(state *State) ([]string, error) {
+	parents, err := xdxlibInterface.Xdxmdev.GetAllParentDevices()
+	if err != nil {
+		return nil, fmt.Errorf("error getting all parent devices: %w", err)
+	}
+	present := make(map[string]bool)
+	for _, parent := range parents {
+		present[parent.Address] = true
+	}
+
+	var missing []string
+	for _, gpuState := range state.GPUs {
+		addresses := []string{gpuState.Address}
+		for _, device := range gpuState.VGPUDevices {
+			if device.ParentAddress != "" {
+				addresses = append(addresses, device.ParentAddress)
+			}
+		}
+		for _, address := range addresses {
+			if !present[address] {
+				present[address] = true
+				missing = append(missing, address)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// equalVGPUDevices checks if both lists contain the same devices, ignoring their order
+func equalVGPUDevices(a, b []types.VGPUDevice) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	devices := make(map[types.VGPUDevice]int)
+	for _, d := range a {
+		devices[d]++
+	}
+	for _, d := range b {
+		if devices[d] == 0 {
+			return false
+		}
+		devices[d]--
+	}
+	return true
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Recreate the vGPU devices, including their UUIDs, recorded in the state file by the last apply",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := restoreWrapper(); err != nil {
+			log.Errorln(err)
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.PersistentFlags().StringVarP(&restoreFlags.StateFile, "state-file", "s", getenvOrDefault("XGV_VGPU_DM_STATE_FILE", DefaultStateFile), "Path to the state file written by apply")
+	restoreCmd.PersistentFlags().DurationVar(&restoreFlags.Wait, "wait", getenvDurationOrDefault("XGV_VGPU_DM_RESTORE_WAIT", 0), "Wait up to this long for the GPUs and SR-IOV virtual functions of the state file to show up, e.g. while the driver is loading at boot")
+	restoreCmd.PersistentFlags().StringVar(&restoreFlags.CDISpecFile, "cdi-spec-file", os.Getenv("XGV_VGPU_DM_CDI_SPEC_FILE"), fmt.Sprintf("Path to the CDI spec file regenerated for the vGPU devices after restore, e.g. %s, empty to disable", cdi.DefaultSpecFile))
+}
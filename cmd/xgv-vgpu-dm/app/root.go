@@ -1,19 +1,89 @@
 package app
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/logging"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/tracing"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/audit"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/exitcode"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
 )
 
 var Verbose bool
 
+// LogFormat is the format of all log lines, 'text' or 'json'
+var LogFormat string
+
+// AuditLog is where changes of vGPU devices are audited, a file or "syslog", and
+// AuditActor identifies who made them
+var (
+	AuditLog   string
+	AuditActor string
+)
+
+// TracingExporter is where the spans of all commands are exported, 'none' or 'otlp'
+var TracingExporter string
+
+// Timeout bounds the time a command may take to change vGPU devices, 0 for no limit
+var Timeout time.Duration
+
+// commandCtx is done once the Timeout of the running command expires. It holds the span
+// of the command, the parent of all spans it starts, which continues the trace passed
+// by the caller in the TRACEPARENT environment variable.
+var (
+	commandCtx      = context.Background()
+	cancelCommand   context.CancelFunc
+	commandSpan     trace.Span
+	shutdownTracing func(context.Context) error
+)
+
+// auditor records the changes of vGPU devices made by all commands, nil if disabled
+var auditor *audit.Auditor
+
+// xdxlibInterface gives all commands access to the GPUs, it can be replaced to
+// run the commands against a fake sysfs
+var xdxlibInterface = xdxlib.New()
+
+// newVGPUConfigManager returns the vGPU config manager used by all commands, backed by
+// xdxlibInterface. It can be replaced, e.g. by a mock.Manager, to record what is applied.
+var newVGPUConfigManager = func(opts ...vgpu.Option) vgpu.Manager {
+	return vgpu.NewXdxlibVGPUConfigManager(append([]vgpu.Option{vgpu.WithXdxlib(xdxlibInterface), vgpu.WithAuditor(auditor)}, opts...)...)
+}
+
 var rootCmd = &cobra.Command{
 	Use:     os.Args[0],
 	Version: "0.1.0",
 	Short:   "xgv vgpu device manager tool",
 	Long:    "This is the xgv vgpu device manager tool.",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := logging.SetFormat(LogFormat); err != nil {
+			return err
+		}
+		setLogFields(cmd)
+		var err error
+		shutdownTracing, err = tracing.Setup(context.Background(), TracingExporter, "xgv-vgpu-dm")
+		if err != nil {
+			return err
+		}
+		commandCtx, commandSpan = tracing.Start(tracing.FromEnviron(context.Background()), "xgv-vgpu-dm "+cmd.Name())
+		if Timeout > 0 {
+			commandCtx, cancelCommand = context.WithTimeout(commandCtx, Timeout)
+		}
+		auditor, err = audit.Open(AuditLog, AuditActor)
+		return err
+	},
+	PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+		return auditor.Close()
+	},
 }
 
 func InitConfig() {
@@ -23,17 +93,52 @@ func InitConfig() {
 		log.SetLevel((log.InfoLevel))
 	}
 	log.SetOutput(os.Stdout)
-	log.SetFormatter(&log.TextFormatter{
-		DisableColors: false,
-		FullTimestamp: false,
-	})
+}
+
+// setLogFields sets the fields of all log lines of a command: the node and, for commands
+// working on a named config, the selected config
+func setLogFields(cmd *cobra.Command) {
+	fields := log.Fields{
+		logging.NodeField: getenvOrDefault("NODE_NAME", hostname()),
+	}
+	if flag := cmd.Flags().Lookup("selected-config"); flag != nil && flag.Value.String() != "" {
+		fields[logging.ConfigField] = flag.Value.String()
+	}
+	logging.SetFields(fields)
 }
 
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&Verbose, "verbose", "v", os.Getenv("VERBOSE") == "true", "Enable verbose logging")
+	rootCmd.PersistentFlags().StringVar(&LogFormat, "log-format", getenvOrDefault("XGV_VGPU_DM_LOG_FORMAT", logging.FormatText), "The format of log lines: 'text' or 'json'")
+	rootCmd.PersistentFlags().StringVar(&TracingExporter, "tracing-exporter", getenvOrDefault("XGV_VGPU_DM_TRACING_EXPORTER", tracing.ExporterNone), "Where spans are exported: 'none' or 'otlp', configured by the OTEL_EXPORTER_OTLP_* environment variables")
+	rootCmd.PersistentFlags().DurationVar(&Timeout, "timeout", getenvDurationOrDefault("XGV_VGPU_DM_TIMEOUT", 0), "Stop creating and deleting vGPU devices once the command ran for this long, e.g. '5m', 0 for no limit")
+	rootCmd.PersistentFlags().StringVar(&AuditLog, "audit-log", os.Getenv("XGV_VGPU_DM_AUDIT_LOG"), "Append an audit record of every creation and deletion of a vGPU device to this JSON-lines file, or send it to syslog with 'syslog'")
+	rootCmd.PersistentFlags().StringVar(&AuditActor, "audit-actor", getenvOrDefault("XGV_VGPU_DM_AUDIT_ACTOR", audit.ActorCLI), "The actor recorded in audit records")
 	cobra.OnInitialize(InitConfig)
 }
 
+// Execute runs the command and exits with the code documented in pkg/exitcode if it fails
 func Execute() {
-	cobra.CheckErr(rootCmd.Execute())
+	err := rootCmd.Execute()
+	if cancelCommand != nil {
+		cancelCommand()
+	}
+	endTracing(err)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitcode.FromError(err))
+	}
+}
+
+// endTracing ends the span of the command and flushes all spans, even if the command failed
+func endTracing(err error) {
+	if commandSpan != nil {
+		tracing.End(commandSpan, err)
+	}
+	if shutdownTracing == nil {
+		return
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Warnf("Unable to export spans: %v", err)
+	}
 }
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+const (
+	DefaultStateFile = "/var/lib/xgv-vgpu-dm/state.yaml"
+	stateVersion     = "v1"
+)
+
+// State records the vGPU layout applied to the node, so that it can be restored after a reboot
+type State struct {
+	Version        string `json:"version" yaml:"version"`
+	ConfigFile     string `json:"config-file" yaml:"config-file"`
+	SelectedConfig string `json:"selected-config" yaml:"selected-config"`
+	// Partial is set if the apply failed on some GPUs, these keep the vGPU devices
+	// recorded for them by the previous apply, if any
+	Partial bool       `json:"partial,omitempty" yaml:"partial,omitempty"`
+	GPUs    []GPUState `json:"gpus" yaml:"gpus"`
+}
+
+// GPUState records the vGPU devices created on a single GPU
+type GPUState struct {
+	Index   int    `json:"index" yaml:"index"`
+	Address string `json:"address" yaml:"address"`
+	// VGPUConfig is the named config selected for the GPU instead of the selected config, if any
+	VGPUConfig  string             `json:"vgpu-config,omitempty" yaml:"vgpu-config,omitempty"`
+	VGPUDevices []types.VGPUDevice `json:"vgpu-devices" yaml:"vgpu-devices"`
+}
+
+// GetCurrentState collects the vGPU devices currently created on every GPU of the node
+func GetCurrentState(f *Flags) (*State, error) {
+	snapshot, err := takeSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	gpuConfigs, err := parseGPUConfigs(f.GPUConfigs)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{
+		Version:        stateVersion,
+		ConfigFile:     f.ConfigFile,
+		SelectedConfig: f.SelectedConfig,
+	}
+	for i, gpu := range snapshot.GPUs {
+		devices, err := snapshot.GetVGPUDevices(i)
+		if err != nil {
+			return nil, fmt.Errorf("error getting vGPU devices of GPU %d: %v", i, err)
+		}
+		state.GPUs = append(state.GPUs, GPUState{
+			Index:       i,
+			Address:     gpu.Address,
+			VGPUConfig:  gpuConfigs[i],
+			VGPUDevices: devices,
+		})
+	}
+	return state, nil
+}
+
+// WriteStateFile atomically writes the state to 'path'
+func WriteStateFile(path string, state *State) error {
+	data, err := yaml.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("marshal error: %v", err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create state directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write state file: %w", err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("unable to write state file: %w", err)
+	}
+	return nil
+}
+
+// ReadStateFile reads the state written by a previous apply
+func ReadStateFile(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read file error: %v", err)
+	}
+	var state State
+	err = yaml.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal error: %v", err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported state file version: %v", state.Version)
+	}
+	return &state, nil
+}
@@ -2,7 +2,12 @@ package app
 
 import (
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
 )
 
 func CheckFlags(f *Flags) error {
@@ -10,8 +15,81 @@ func CheckFlags(f *Flags) error {
 	if f.ConfigFile == "" {
 		missing = append(missing, "config-file")
 	}
+	if f.DeterministicUUIDs && f.NodeName == "" {
+		missing = append(missing, "node-name")
+	}
 	if len(missing) > 0 {
 		return fmt.Errorf("missing required flags '%v'", strings.Join(missing, ", "))
 	}
+	if _, err := parseGPUConfigs(f.GPUConfigs); err != nil {
+		return fmt.Errorf("invalid value for flag 'gpu': %v", err)
+	}
+	if f.Parallelism < 1 {
+		return fmt.Errorf("invalid value for flag 'parallelism': must be at least 1")
+	}
+	if f.Placement != "" {
+		if _, err := vgpu.ParsePlacementStrategy(f.Placement); err != nil {
+			return fmt.Errorf("invalid value for flag 'placement': %v", err)
+		}
+	}
 	return nil
 }
+
+// parseGPUConfigs parses the named configs selected for specific GPUs, given as 'index=name'
+func parseGPUConfigs(values []string) (map[int]string, error) {
+	gpuConfigs := make(map[int]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("expected 'index=name', got '%s'", value)
+		}
+		index, err := strconv.Atoi(parts[0])
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid GPU index in '%s'", value)
+		}
+		if _, exists := gpuConfigs[index]; exists {
+			return nil, fmt.Errorf("more than one vgpu-config selected for GPU %d", index)
+		}
+		gpuConfigs[index] = parts[1]
+	}
+	return gpuConfigs, nil
+}
+
+func getenvOrDefault(key string, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
+
+func getenvIntOrDefault(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getenvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getenvListOrDefault(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return strings.Split(value, ",")
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,224 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/chen-mao/go-xdxlib/pkg/xdxpci"
+	log "github.com/sirupsen/logrus"
+
+	v1 "github.com/chen-mao/xdxct-vgpu-device-manager/api/spec/v1"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/logging"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+// GPUResult is the result of walking the selected vGPU config for a GPU
+type GPUResult string
+
+const (
+	// GPUSucceeded means the vGPU config of the GPU was changed
+	GPUSucceeded GPUResult = "succeeded"
+	// GPUSkipped means the GPU already matched the selected vGPU config
+	GPUSkipped GPUResult = "skipped"
+	// GPUFailed means the selected vGPU config could not be applied to the GPU
+	GPUFailed GPUResult = "failed"
+	// GPUNotRun means the GPU was not walked, as another GPU failed before
+	GPUNotRun GPUResult = "not-run"
+)
+
+// GPUOutcome is the result of walking the selected vGPU config for a GPU
+type GPUOutcome struct {
+	Index   int
+	Address string
+	Result  GPUResult
+	Err     *GPUError
+}
+
+// GPUError is the error of applying an entry of the selected vGPU config to a GPU
+type GPUError struct {
+	Index   int
+	Address string
+	// Entry is the position of the config entry in the selected vGPU config
+	Entry int
+	Spec  v1.VGPUConfigSpec
+	Err   error
+}
+
+func (e *GPUError) Error() string {
+	return fmt.Sprintf("GPU %d (address=%s, config entry %d: devices=%v, vgpu-devices=%v): %v", e.Index, e.Address, e.Entry, e.Spec.Devices, e.Spec.VGPUDevices, e.Err)
+}
+
+func (e *GPUError) Unwrap() error {
+	return e.Err
+}
+
+// GPUErrors collects the errors of all GPUs the selected vGPU config could not be applied to
+type GPUErrors []*GPUError
+
+func (e GPUErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d GPUs failed: %s", len(e), strings.Join(messages, "; "))
+}
+
+// NumGPUs returns the number of GPUs that failed, more than one selects exit code ApplyFailed
+func (e GPUErrors) NumGPUs() int {
+	return len(e)
+}
+
+func (e GPUErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// walkOptions controls how the GPUs are walked
+type walkOptions struct {
+	// Parallelism is the number of GPUs walked concurrently
+	Parallelism int
+	// ContinueOnError keeps walking the remaining GPUs after a GPU failed
+	ContinueOnError bool
+}
+
+// WalkSelectedVGPUConfigForEachGPU calls 'f' for every GPU matched by the devices and
+// device-filter of an entry of the selected vGPU config, with the last entry matching the
+// GPU, 'f' reports whether it changed the GPU. Up to 'opts.Parallelism' GPUs are walked
+// concurrently. Unless 'opts.ContinueOnError' is set, no further GPUs are walked once a GPU
+// failed. The outcome of every matched GPU is returned, together with the errors of all
+// failed GPUs as 'GPUErrors'.
+func WalkSelectedVGPUConfigForEachGPU(gpus []*xdxpci.XDXCTPCIDevice, vGPUConfig v1.VGPUConfigSpecSlice, opts walkOptions, f func(v1.VGPUConfigSpec, int) (bool, error)) ([]GPUOutcome, error) {
+	log.Debugf("gpu on node: %d", len(gpus))
+	// Later entries override earlier ones for the GPUs they match
+	entries := make([]int, len(gpus))
+	for i := range entries {
+		entries[i] = -1
+	}
+	for e, vc := range vGPUConfig {
+		if vc.DeviceFilter == nil {
+			log.Debugf("Walking VGPUConfig for (devices=%v)", vc.Devices)
+		} else {
+			log.Debugf("Walking VGPUConfig for (device-filter=%v, devices=%v)", vc.DeviceFilter, vc.Devices)
+		}
+
+		for i, gpu := range gpus {
+			if !vc.MatchDeviceFilter(types.NewDeviceID(gpu.Device, gpu.Vendor)) {
+				continue
+			}
+			if !vc.MatchDevices(i) {
+				continue
+			}
+			entries[i] = e
+		}
+	}
+
+	parallelism := opts.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	outcomes := make([]*GPUOutcome, len(gpus))
+	workers := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	failed := false
+	for i, gpu := range gpus {
+		if entries[i] == -1 {
+			continue
+		}
+		outcomes[i] = &GPUOutcome{
+			Index:   i,
+			Address: gpu.Address,
+			Result:  GPUNotRun,
+		}
+
+		workers <- struct{}{}
+		mutex.Lock()
+		stop := failed && !opts.ContinueOnError
+		mutex.Unlock()
+		if stop {
+			<-workers
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, gpu *xdxpci.XDXCTPCIDevice) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			logging.ForGPU(i, gpu.Address).Debugf("Device ID: %v", types.NewDeviceID(gpu.Device, gpu.Vendor))
+			outcome := outcomes[i]
+			e := entries[i]
+			changed, err := f(vGPUConfig[e], i)
+			switch {
+			case err != nil:
+				outcome.Result = GPUFailed
+				outcome.Err = &GPUError{
+					Index:   i,
+					Address: gpu.Address,
+					Entry:   e,
+					Spec:    vGPUConfig[e],
+					Err:     err,
+				}
+				mutex.Lock()
+				failed = true
+				mutex.Unlock()
+			case changed:
+				outcome.Result = GPUSucceeded
+			default:
+				outcome.Result = GPUSkipped
+			}
+		}(i, gpu)
+	}
+	wg.Wait()
+
+	var results []GPUOutcome
+	var errs GPUErrors
+	for _, outcome := range outcomes {
+		if outcome == nil {
+			continue
+		}
+		results = append(results, *outcome)
+		if outcome.Err != nil {
+			errs = append(errs, outcome.Err)
+		}
+	}
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+// printSummary prints a table of the outcome of every GPU
+func printSummary(w io.Writer, outcomes []GPUOutcome) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "GPU\tADDRESS\tRESULT\tERROR")
+	for _, outcome := range outcomes {
+		message := ""
+		if outcome.Err != nil {
+			message = outcome.Err.Err.Error()
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", outcome.Index, outcome.Address, outcome.Result, message)
+	}
+	return tw.Flush()
+}
+
+// logSummary logs the outcome of every GPU as a structured log line
+func logSummary(outcomes []GPUOutcome) {
+	for _, outcome := range outcomes {
+		logger := logging.ForGPU(outcome.Index, outcome.Address).WithField(logging.ResultField, outcome.Result)
+		if outcome.Err != nil {
+			logger.Errorf("Failed to apply vGPU config: %v", outcome.Err.Err)
+			continue
+		}
+		logger.Infof("vGPU config %s", outcome.Result)
+	}
+}
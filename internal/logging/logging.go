@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Names of the structured fields shared by the log lines of all binaries
+const (
+	NodeField     = "node"
+	GPUField      = "gpu"
+	AddressField  = "address"
+	MDEVTypeField = "mdevType"
+	UUIDField     = "uuid"
+	ConfigField   = "config"
+	ResultField   = "result"
+)
+
+// SetFormat sets the format of all log lines, 'text' or 'json'
+func SetFormat(format string) error {
+	switch format {
+	case FormatText:
+		log.SetFormatter(&log.TextFormatter{
+			DisableColors: false,
+			FullTimestamp: false,
+		})
+	case FormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format '%s': must be '%s' or '%s'", format, FormatText, FormatJSON)
+	}
+	return nil
+}
+
+// defaultFields sets the fields passed to SetFields on every log line, its hook is
+// added to the standard logger once
+var (
+	defaultFields = &fieldsHook{}
+	addFieldsHook sync.Once
+)
+
+// SetFields sets the fields of every following log line that does not set them itself,
+// replacing the fields set before
+func SetFields(fields log.Fields) {
+	addFieldsHook.Do(func() {
+		log.AddHook(defaultFields)
+	})
+	defaultFields.set(fields)
+}
+
+// ForGPU returns a logger with the fields identifying a GPU
+func ForGPU(index int, address string) *log.Entry {
+	return log.WithFields(log.Fields{
+		GPUField:     index,
+		AddressField: address,
+	})
+}
+
+// ForVGPUDevice returns a logger with the fields identifying a vGPU device
+func ForVGPUDevice(uuid string, mdevType string, address string) *log.Entry {
+	return log.WithFields(log.Fields{
+		UUIDField:     uuid,
+		MDEVTypeField: mdevType,
+		AddressField:  address,
+	})
+}
+
+// fieldsHook sets default fields on every log line
+type fieldsHook struct {
+	sync.RWMutex
+	fields log.Fields
+}
+
+func (h *fieldsHook) set(fields log.Fields) {
+	h.Lock()
+	defer h.Unlock()
+	h.fields = fields
+}
+
+func (h *fieldsHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *fieldsHook) Fire(entry *log.Entry) error {
+	h.RLock()
+	defer h.RUnlock()
+	for key, value := range h.fields {
+		if _, exists := entry.Data[key]; !exists {
+			entry.Data[key] = value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	defaultOTLPEndpoint = "http://localhost:4318"
+	otlpTracesPath      = "/v1/traces"
+	otlpTimeout         = 10 * time.Second
+
+	otlpEndpointEnv       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	otlpTracesEndpointEnv = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	otlpHeadersEnv        = "OTEL_EXPORTER_OTLP_HEADERS"
+	otlpTracesHeadersEnv  = "OTEL_EXPORTER_OTLP_TRACES_HEADERS"
+)
+
+// otlpExporter exports spans over OTLP/HTTP with the JSON encoding, which needs neither
+// the protobuf nor the gRPC modules of the OTLP exporters
+type otlpExporter struct {
+	client   *http.Client
+	endpoint string
+	headers  map[string]string
+}
+
+// newOTLPExporter returns an exporter for the collector set by the standard
+// OTEL_EXPORTER_OTLP_* environment variables
+func newOTLPExporter() (*otlpExporter, error) {
+	endpoint := os.Getenv(otlpTracesEndpointEnv)
+	if endpoint == "" {
+		base := os.Getenv(otlpEndpointEnv)
+		if base == "" {
+			base = defaultOTLPEndpoint
+		}
+		endpoint = strings.TrimSuffix(base, "/") + otlpTracesPath
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint '%s': must be an http or https URL", endpoint)
+	}
+
+	headers := make(map[string]string)
+	for _, env := range []string{otlpHeadersEnv, otlpTracesHeadersEnv} {
+		if err := parseOTLPHeaders(os.Getenv(env), headers); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", env, err)
+		}
+	}
+	return &otlpExporter{
+		client:   &http.Client{Timeout: otlpTimeout},
+		endpoint: endpoint,
+		headers:  headers,
+	}, nil
+}
+
+// parseOTLPHeaders adds the comma separated 'key=value' pairs to 'headers', with
+// URL encoded values
+func parseOTLPHeaders(value string, headers map[string]string) error {
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, encoded, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(key) == "" {
+			return fmt.Errorf("header '%s' is not a key=value pair", pair)
+		}
+		decoded, err := url.QueryUnescape(strings.TrimSpace(encoded))
+		if err != nil {
+			return fmt.Errorf("header '%s': %v", key, err)
+		}
+		headers[strings.TrimSpace(key)] = decoded
+	}
+	return nil
+}
+
+// ExportSpans posts the spans to the collector
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(newOTLPRequest(spans))
+	if err != nil {
+		return fmt.Errorf("unable to encode spans: %v", err)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := e.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("collector at %s returned %s: %s", e.endpoint, response.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// Shutdown does nothing, as no request is pending once ExportSpans returned
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// The OTLP/JSON messages of a trace export request, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string    `json:"stringValue,omitempty"`
+	BoolValue   *bool      `json:"boolValue,omitempty"`
+	IntValue    *string    `json:"intValue,omitempty"`
+	DoubleValue *float64   `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArray `json:"arrayValue,omitempty"`
+}
+
+type otlpArray struct {
+	Values []otlpValue `json:"values"`
+}
+
+// The OTLP status codes, which differ from the values of 'codes.Code'
+const (
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+// newOTLPRequest groups the spans by resource and instrumentation scope. The spans of
+// a process share both, so this is a single group in practice.
+func newOTLPRequest(spans []sdktrace.ReadOnlySpan) otlpRequest {
+	type scopeKey struct {
+		resource attribute.Distinct
+		scope    otlpScope
+	}
+	resources := make(map[attribute.Distinct]int)
+	scopes := make(map[scopeKey]int)
+
+	var request otlpRequest
+	for _, span := range spans {
+		resource := span.Resource().Equivalent()
+		r, exists := resources[resource]
+		if !exists {
+			r = len(request.ResourceSpans)
+			resources[resource] = r
+			request.ResourceSpans = append(request.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{Attributes: newOTLPAttributes(span.Resource().Attributes())},
+			})
+		}
+
+		resourceSpans := &request.ResourceSpans[r]
+		key := scopeKey{
+			resource: resource,
+			scope:    otlpScope{Name: span.InstrumentationScope().Name, Version: span.InstrumentationScope().Version},
+		}
+		s, exists := scopes[key]
+		if !exists {
+			s = len(resourceSpans.ScopeSpans)
+			scopes[key] = s
+			resourceSpans.ScopeSpans = append(resourceSpans.ScopeSpans, otlpScopeSpans{Scope: key.scope})
+		}
+		resourceSpans.ScopeSpans[s].Spans = append(resourceSpans.ScopeSpans[s].Spans, newOTLPSpan(span))
+	}
+	return request
+}
+
+func newOTLPSpan(span sdktrace.ReadOnlySpan) otlpSpan {
+	s := otlpSpan{
+		TraceID:           span.SpanContext().TraceID().String(),
+		SpanID:            span.SpanContext().SpanID().String(),
+		TraceState:        span.SpanContext().TraceState().String(),
+		Name:              span.Name(),
+		Kind:              int(span.SpanKind()),
+		StartTimeUnixNano: unixNano(span.StartTime()),
+		EndTimeUnixNano:   unixNano(span.EndTime()),
+		Attributes:        newOTLPAttributes(span.Attributes()),
+		Status:            otlpStatus{Message: span.Status().Description},
+	}
+	if span.Parent().HasSpanID() {
+		s.ParentSpanID = span.Parent().SpanID().String()
+	}
+	for _, event := range span.Events() {
+		s.Events = append(s.Events, otlpEvent{
+			TimeUnixNano: unixNano(event.Time),
+			Name:         event.Name,
+			Attributes:   newOTLPAttributes(event.Attributes),
+		})
+	}
+	switch span.Status().Code {
+	case codes.Ok:
+		s.Status.Code = otlpStatusOK
+	case codes.Error:
+		s.Status.Code = otlpStatusError
+	}
+	return s
+}
+
+func newOTLPAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	var keyValues []otlpKeyValue
+	for _, attr := range attrs {
+		keyValues = append(keyValues, otlpKeyValue{Key: string(attr.Key), Value: newOTLPValue(attr.Value)})
+	}
+	return keyValues
+}
+
+func newOTLPValue(value attribute.Value) otlpValue {
+	switch value.Type() {
+	case attribute.BOOL:
+		v := value.AsBool()
+		return otlpValue{BoolValue: &v}
+	case attribute.INT64:
+		v := strconv.FormatInt(value.AsInt64(), 10)
+		return otlpValue{IntValue: &v}
+	case attribute.FLOAT64:
+		v := value.AsFloat64()
+		return otlpValue{DoubleValue: &v}
+	case attribute.BOOLSLICE:
+		var values []otlpValue
+		for _, v := range value.AsBoolSlice() {
+			values = append(values, newOTLPValue(attribute.BoolValue(v)))
+		}
+		return otlpValue{ArrayValue: &otlpArray{Values: values}}
+	case attribute.INT64SLICE:
+		var values []otlpValue
+		for _, v := range value.AsInt64Slice() {
+			values = append(values, newOTLPValue(attribute.Int64Value(v)))
+		}
+		return otlpValue{ArrayValue: &otlpArray{Values: values}}
+	case attribute.FLOAT64SLICE:
+		var values []otlpValue
+		for _, v := range value.AsFloat64Slice() {
+			values = append(values, newOTLPValue(attribute.Float64Value(v)))
+		}
+		return otlpValue{ArrayValue: &otlpArray{Values: values}}
+	case attribute.STRINGSLICE:
+		var values []otlpValue
+		for _, v := range value.AsStringSlice() {
+			values = append(values, newOTLPValue(attribute.StringValue(v)))
+		}
+		return otlpValue{ArrayValue: &otlpArray{Values: values}}
+	}
+	v := value.Emit()
+	return otlpValue{StringValue: &v}
+}
+
+func unixNano(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
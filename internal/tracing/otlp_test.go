@@ -0,0 +1,138 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// fakeCollector records the requests posted to it
+type fakeCollector struct {
+	sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   []otlpRequest
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.Lock()
+	defer c.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	var request otlpRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.requests = append(c.requests, r)
+	c.bodies = append(c.bodies, request)
+	if c.status != 0 {
+		http.Error(w, "rejected", c.status)
+	}
+}
+
+func newFakeCollector(t *testing.T) (*fakeCollector, string) {
+	collector := &fakeCollector{}
+	server := httptest.NewServer(collector)
+	t.Cleanup(server.Close)
+	return collector, server.URL
+}
+
+func TestSetupOTLP(t *testing.T) {
+	collector, url := newFakeCollector(t)
+	t.Setenv(otlpEndpointEnv, url+"/")
+	t.Setenv(otlpHeadersEnv, "authorization=Bearer%20token, x-tenant = vgpu")
+
+	shutdown, err := Setup(context.Background(), ExporterOTLP, "k8s-xgv-vgpu-dm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, parent := Start(context.Background(), "reconcile", attribute.String("config", "all-1G"))
+	_, child := Start(ctx, "apply", attribute.Int("gpu", 1), attribute.StringSlice("types", []string{"1G", "2G"}))
+	End(child, errors.New("apply failed"))
+	End(parent, nil)
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	collector.Lock()
+	defer collector.Unlock()
+	if len(collector.requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(collector.requests))
+	}
+	request := collector.requests[0]
+	if request.URL.Path != otlpTracesPath || request.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("expected JSON posted to %s, got %s to %s", otlpTracesPath, request.Header.Get("Content-Type"), request.URL.Path)
+	}
+	if request.Header.Get("Authorization") != "Bearer token" || request.Header.Get("X-Tenant") != "vgpu" {
+		t.Errorf("expected the headers of %s, got %v", otlpHeadersEnv, request.Header)
+	}
+
+	body := collector.bodies[0]
+	if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("expected one resource and scope, got %+v", body)
+	}
+	resource := body.ResourceSpans[0].Resource
+	if len(resource.Attributes) != 1 || resource.Attributes[0].Key != "service.name" || *resource.Attributes[0].Value.StringValue != "k8s-xgv-vgpu-dm" {
+		t.Errorf("expected resource with service.name, got %+v", resource)
+	}
+	spans := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %+v", spans)
+	}
+	// Spans are exported in the order they ended
+	apply, reconcile := spans[0], spans[1]
+	if apply.Name != "apply" || reconcile.Name != "reconcile" {
+		t.Fatalf("expected spans apply and reconcile, got %s and %s", apply.Name, reconcile.Name)
+	}
+	if apply.TraceID != reconcile.TraceID || apply.ParentSpanID != reconcile.SpanID || reconcile.ParentSpanID != "" {
+		t.Errorf("expected apply to be a child of reconcile, got %+v and %+v", apply, reconcile)
+	}
+	if apply.Status.Code != otlpStatusError || apply.Status.Message != "apply failed" || reconcile.Status.Code != 0 {
+		t.Errorf("expected apply to fail and reconcile to be unset, got %+v and %+v", apply.Status, reconcile.Status)
+	}
+	if len(apply.Events) != 1 || apply.Events[0].Name != "exception" {
+		t.Errorf("expected the error to be recorded as an event, got %+v", apply.Events)
+	}
+	if attrs := apply.Attributes; len(attrs) != 2 || *attrs[0].Value.IntValue != "1" || len(attrs[1].Value.ArrayValue.Values) != 2 {
+		t.Errorf("expected int and string slice attributes, got %+v", attrs)
+	}
+}
+
+func TestOTLPExporterErrors(t *testing.T) {
+	collector, url := newFakeCollector(t)
+	collector.status = http.StatusServiceUnavailable
+	t.Setenv(otlpTracesEndpointEnv, url+"/custom")
+
+	exporter, err := newOTLPExporter()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exporter.endpoint != url+"/custom" {
+		t.Errorf("expected the endpoint of %s as is, got %s", otlpTracesEndpointEnv, exporter.endpoint)
+	}
+	spans := tracetest.SpanStubs{{Name: "reconcile"}}.Snapshots()
+	if err := exporter.ExportSpans(context.Background(), spans); err == nil {
+		t.Errorf("expected error for a rejected export, got nil")
+	}
+
+	t.Setenv(otlpHeadersEnv, "authorization")
+	if _, err := newOTLPExporter(); err == nil {
+		t.Errorf("expected error for an invalid header, got nil")
+	}
+	t.Setenv(otlpHeadersEnv, "")
+	t.Setenv(otlpTracesEndpointEnv, "collector:4318")
+	if _, err := newOTLPExporter(); err == nil {
+		t.Errorf("expected error for an invalid endpoint, got nil")
+	}
+}
+
+var _ sdktrace.SpanExporter = &otlpExporter{}
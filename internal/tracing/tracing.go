@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// ExporterNone disables tracing, all spans are no-ops
+	ExporterNone = "none"
+	// ExporterOTLP exports spans over OTLP/HTTP with the JSON encoding. The endpoint and
+	// headers are read from the standard OTEL_EXPORTER_OTLP_* environment variables.
+	ExporterOTLP = "otlp"
+
+	tracerName = "github.com/chen-mao/xdxct-vgpu-device-manager"
+
+	traceParentEnv = "TRACEPARENT"
+	traceStateEnv  = "TRACESTATE"
+)
+
+var propagator = propagation.TraceContext{}
+
+// Setup installs the global tracer provider for the exporter. The returned function
+// flushes the pending spans and must be called before the process exits.
+func Setup(ctx context.Context, exporter string, serviceName string) (func(context.Context) error, error) {
+	switch exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter '%s': must be '%s' or '%s'", exporter, ExporterNone, ExporterOTLP)
+	}
+
+	client, err := newOTLPExporter()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create OTLP exporter: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(client),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warnf("Unable to export spans: %v", err)
+	}))
+	return provider.Shutdown, nil
+}
+
+// Start starts a span as a child of the span in 'ctx', if any
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records 'err', if not nil, on the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Environ returns the environment variables carrying the span in 'ctx' to a child process
+func Environ(ctx context.Context) []string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+
+	var env []string
+	if value := carrier.Get("traceparent"); value != "" {
+		env = append(env, traceParentEnv+"="+value)
+	}
+	if value := carrier.Get("tracestate"); value != "" {
+		env = append(env, traceStateEnv+"="+value)
+	}
+	return env
+}
+
+// FromEnviron returns a context holding the span passed by the parent process, if any
+func FromEnviron(ctx context.Context) context.Context {
+	carrier := propagation.MapCarrier{
+		"traceparent": os.Getenv(traceParentEnv),
+		"tracestate":  os.Getenv(traceStateEnv),
+	}
+	return propagator.Extract(ctx, carrier)
+}
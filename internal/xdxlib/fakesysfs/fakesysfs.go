@@ -0,0 +1,411 @@
+// Package fakesysfs builds a fake sysfs tree with XDXCT GPUs and emulates the
+// creation and removal of mdev (vGPU) devices, so that the vGPU config manager
+// and the commands built on it can be exercised without a GPU.
+package fakesysfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/chen-mao/go-xdxlib/pkg/xdxpci"
+	"github.com/google/uuid"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib"
+)
+
+const (
+	pciDevicesDir   = "sys/devices/pci0000:00"
+	pciBusDir       = "sys/bus/pci/devices"
+	pciDriverDir    = "sys/bus/pci/drivers/xdxgpu"
+	mdevParentDir   = "sys/class/mdev_bus"
+	mdevBusDir      = "sys/bus/mdev/devices"
+	mdevDriverDir   = "sys/bus/mdev/drivers/vfio_mdev"
+	iommuGroupsDir  = "sys/kernel/iommu_groups"
+	mdevTypesSubdir = "mdev_supported_types"
+)
+
+// MDEVType is an mdev type supported by a fake GPU. Every instance of the type
+// uses 'Size' units of the capacity of the GPU.
+type MDEVType struct {
+	ID   int
+	Name string
+	Size int
+}
+
+// GPU is a fake XDXCT GPU. The capacity is shared by all mdev types, so creating
+// an instance of one type reduces the available instances of the others. SR-IOV
+// virtual functions are parent devices of their own with a separate capacity.
+type GPU struct {
+	Address          string
+	Device           uint16
+	NumaNode         int
+	Capacity         int
+	MDEVTypes        []MDEVType
+	VirtualFunctions []GPU
+}
+
+// The mdev types of the GPUs returned by NewTestGPU
+const (
+	TestType1G = "XGV_V0_1G_1_CORE"
+	TestType2G = "XGV_V0_2G_1_CORE"
+)
+
+// NewTestGPU returns a fake GPU with room for four 1G or two 2G vGPU devices, as
+// used by the tests of the vGPU config manager and the commands built on it
+func NewTestGPU(address string) GPU {
+	return GPU{
+		Address:  address,
+		Device:   0x1000,
+		Capacity: 4,
+		MDEVTypes: []MDEVType{
+			{ID: 1, Name: TestType1G, Size: 1},
+			{ID: 2, Name: TestType2G, Size: 2},
+		},
+	}
+}
+
+type gpu struct {
+	GPU
+	path  string
+	types map[string]MDEVType
+	used  int
+}
+
+type mdev struct {
+	gpu      *gpu
+	mdevType MDEVType
+	busy     bool
+}
+
+// Sysfs is a fake sysfs tree below a root directory
+type Sysfs struct {
+	sync.Mutex
+	root           string
+	gpus           map[string]*gpu
+	mdevs          map[string]*mdev
+	nextIommuGroup int
+	readOnly       bool
+}
+
+// New creates the skeleton of a fake sysfs tree below 'root', e.g. a temporary test directory
+func New(root string) (*Sysfs, error) {
+	s := &Sysfs{
+		root:           root,
+		gpus:           make(map[string]*gpu),
+		mdevs:          make(map[string]*mdev),
+		nextIommuGroup: 1,
+	}
+	for _, dir := range []string{pciDevicesDir, pciBusDir, pciDriverDir, mdevParentDir, mdevBusDir, mdevDriverDir, iommuGroupsDir} {
+		if err := os.MkdirAll(s.path(dir), 0755); err != nil {
+			return nil, fmt.Errorf("unable to create %s: %v", dir, err)
+		}
+	}
+	return s, nil
+}
+
+// Root returns the directory the fake sysfs is mounted at
+func (s *Sysfs) Root() string {
+	return s.root
+}
+
+// Interface returns an xdxlib.Interface reading the fake sysfs and emulating
+// writes to the 'create' and 'remove' attributes
+func (s *Sysfs) Interface() xdxlib.Interface {
+	return xdxlib.New(
+		xdxlib.WithSysfsRoot(s.root),
+		xdxlib.WithWriteFunc(s.Write),
+	)
+}
+
+// AddGPU adds a GPU with its mdev types to the fake sysfs
+func (s *Sysfs) AddGPU(g GPU) error {
+	s.Lock()
+	defer s.Unlock()
+	_, err := s.addGPU(g)
+	return err
+}
+
+func (s *Sysfs) addGPU(g GPU) (*gpu, error) {
+	if _, exists := s.gpus[g.Address]; exists {
+		return nil, fmt.Errorf("GPU %s already exists", g.Address)
+	}
+	gpu := &gpu{
+		GPU:   g,
+		path:  s.path(pciDevicesDir, g.Address),
+		types: make(map[string]MDEVType),
+	}
+
+	files := map[string]string{
+		"vendor":    fmt.Sprintf("0x%04x", xdxpci.PCIXDXCTVendorID),
+		"class":     fmt.Sprintf("0x%06x", xdxpci.PCIVgaControllerClass),
+		"device":    fmt.Sprintf("0x%04x", g.Device),
+		"numa_node": strconv.Itoa(g.NumaNode),
+		"config":    "",
+	}
+	for name, content := range files {
+		if err := writeFile(filepath.Join(gpu.path, name), content); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.symlink(s.path(pciDriverDir), filepath.Join(gpu.path, "driver")); err != nil {
+		return nil, err
+	}
+	if err := s.newIommuGroup(gpu.path); err != nil {
+		return nil, err
+	}
+
+	for _, t := range g.MDEVTypes {
+		if t.Size <= 0 {
+			return nil, fmt.Errorf("invalid size %d of mdev type %s", t.Size, t.Name)
+		}
+		typeDir := filepath.Join(gpu.path, mdevTypesSubdir, "xgv-"+t.Name)
+		if err := os.MkdirAll(filepath.Join(typeDir, "devices"), 0755); err != nil {
+			return nil, fmt.Errorf("unable to create mdev type %s: %v", t.Name, err)
+		}
+		if err := writeFile(filepath.Join(typeDir, "name"), fmt.Sprintf("Type ID: %d; Type Name: %s", t.ID, t.Name)); err != nil {
+			return nil, err
+		}
+		if err := writeFile(filepath.Join(typeDir, "device_api"), "vfio-pci"); err != nil {
+			return nil, err
+		}
+		if err := writeFile(filepath.Join(typeDir, "create"), ""); err != nil {
+			return nil, err
+		}
+		gpu.types[t.Name] = t
+	}
+	if err := s.updateAvailableInstances(gpu); err != nil {
+		return nil, err
+	}
+
+	// Link the GPU to the buses last, so that readers never see a partially added GPU
+	if err := s.symlink(gpu.path, s.path(pciBusDir, g.Address)); err != nil {
+		return nil, err
+	}
+	if len(g.MDEVTypes) > 0 {
+		if err := s.symlink(gpu.path, s.path(mdevParentDir, g.Address)); err != nil {
+			return nil, err
+		}
+	}
+	s.gpus[g.Address] = gpu
+
+	for i, vf := range g.VirtualFunctions {
+		if vf.Device == 0 {
+			vf.Device = g.Device
+		}
+		function, err := s.addGPU(vf)
+		if err != nil {
+			return nil, fmt.Errorf("unable to add virtual function %d of %s: %v", i, g.Address, err)
+		}
+		if err := s.symlink(function.path, filepath.Join(gpu.path, fmt.Sprintf("virtfn%d", i))); err != nil {
+			return nil, err
+		}
+		if err := s.symlink(gpu.path, filepath.Join(function.path, "physfn")); err != nil {
+			return nil, err
+		}
+	}
+	return gpu, nil
+}
+
+// SetBusy marks an mdev as in use, e.g. by a VM, so that removing it fails with EBUSY
+func (s *Sysfs) SetBusy(id string, busy bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	m, exists := s.mdevs[id]
+	if !exists {
+		return fmt.Errorf("mdev %s does not exist", id)
+	}
+	m.busy = busy
+	return nil
+}
+
+// SetReadOnly makes writes to the 'create' and 'remove' attributes fail with
+// EACCES, as they do for an unprivileged user
+func (s *Sysfs) SetReadOnly(readOnly bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.readOnly = readOnly
+}
+
+// Write emulates the kernel for writes to the 'create' attribute of an mdev type
+// and the 'remove' attribute of an mdev, other attributes are written as files.
+// Like the kernel, it fails with an *os.PathError wrapping a syscall.Errno.
+func (s *Sysfs) Write(path string, data string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var errno syscall.Errno
+	switch filepath.Base(path) {
+	case "create":
+		errno = s.create(filepath.Dir(path), strings.TrimSpace(data))
+	case "remove":
+		errno = s.remove(filepath.Base(filepath.Dir(path)), strings.TrimSpace(data))
+	default:
+		return writeFile(path, data)
+	}
+	if errno != 0 {
+		return &os.PathError{Op: "write", Path: path, Err: errno}
+	}
+	return nil
+}
+
+// MDEVs returns the UUIDs of all mdev devices by the address of their parent GPU
+func (s *Sysfs) MDEVs() map[string][]string {
+	s.Lock()
+	defer s.Unlock()
+
+	mdevs := make(map[string][]string)
+	for id, m := range s.mdevs {
+		mdevs[m.gpu.Address] = append(mdevs[m.gpu.Address], id)
+	}
+	return mdevs
+}
+
+func (s *Sysfs) create(typeDir string, id string) syscall.Errno {
+	if s.readOnly {
+		return syscall.EACCES
+	}
+	gpu, mdevType, exists := s.lookupType(typeDir)
+	if !exists {
+		return syscall.ENODEV
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return syscall.EINVAL
+	}
+	if _, exists := s.mdevs[id]; exists {
+		return syscall.EEXIST
+	}
+	if gpu.used+mdevType.Size > gpu.Capacity {
+		return syscall.ENOSPC
+	}
+
+	if err := s.addMDEV(typeDir, filepath.Join(gpu.path, id), id); err != nil {
+		return syscall.EIO
+	}
+
+	s.mdevs[id] = &mdev{gpu: gpu, mdevType: mdevType}
+	gpu.used += mdevType.Size
+	if err := s.updateAvailableInstances(gpu); err != nil {
+		return syscall.EIO
+	}
+	return 0
+}
+
+// addMDEV creates the files of an mdev, linking it to the mdev bus last so that
+// readers of the bus never see a partially created device
+func (s *Sysfs) addMDEV(typeDir string, mdevPath string, id string) error {
+	if err := os.MkdirAll(mdevPath, 0755); err != nil {
+		return fmt.Errorf("unable to create mdev %s: %v", id, err)
+	}
+	if err := writeFile(filepath.Join(mdevPath, "remove"), ""); err != nil {
+		return err
+	}
+	if err := s.symlink(typeDir, filepath.Join(mdevPath, "mdev_type")); err != nil {
+		return err
+	}
+	if err := s.symlink(s.path(mdevDriverDir), filepath.Join(mdevPath, "driver")); err != nil {
+		return err
+	}
+	if err := s.newIommuGroup(mdevPath); err != nil {
+		return err
+	}
+	if err := s.symlink(mdevPath, filepath.Join(typeDir, "devices", id)); err != nil {
+		return err
+	}
+	return s.symlink(mdevPath, s.path(mdevBusDir, id))
+}
+
+func (s *Sysfs) remove(id string, data string) syscall.Errno {
+	if s.readOnly {
+		return syscall.EACCES
+	}
+	if data != "1" {
+		return syscall.EINVAL
+	}
+	m, exists := s.mdevs[id]
+	if !exists {
+		return syscall.ENODEV
+	}
+	if m.busy {
+		return syscall.EBUSY
+	}
+
+	typeDir := filepath.Join(m.gpu.path, mdevTypesSubdir, "xgv-"+m.mdevType.Name)
+	for _, path := range []string{
+		s.path(mdevBusDir, id),
+		filepath.Join(typeDir, "devices", id),
+		filepath.Join(m.gpu.path, id),
+	} {
+		if err := os.RemoveAll(path); err != nil {
+			return syscall.EIO
+		}
+	}
+
+	delete(s.mdevs, id)
+	m.gpu.used -= m.mdevType.Size
+	if err := s.updateAvailableInstances(m.gpu); err != nil {
+		return syscall.EIO
+	}
+	return 0
+}
+
+func (s *Sysfs) lookupType(typeDir string) (*gpu, MDEVType, bool) {
+	gpu, exists := s.gpus[filepath.Base(filepath.Dir(filepath.Dir(typeDir)))]
+	if !exists {
+		return nil, MDEVType{}, false
+	}
+	mdevType, exists := gpu.types[strings.TrimPrefix(filepath.Base(typeDir), "xgv-")]
+	if !exists {
+		return nil, MDEVType{}, false
+	}
+	return gpu, mdevType, true
+}
+
+func (s *Sysfs) updateAvailableInstances(gpu *gpu) error {
+	for _, t := range gpu.types {
+		available := (gpu.Capacity - gpu.used) / t.Size
+		path := filepath.Join(gpu.path, mdevTypesSubdir, "xgv-"+t.Name, "available_instances")
+		if err := writeFile(path, strconv.Itoa(available)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sysfs) newIommuGroup(devicePath string) error {
+	group := s.path(iommuGroupsDir, strconv.Itoa(s.nextIommuGroup))
+	if err := os.MkdirAll(group, 0755); err != nil {
+		return fmt.Errorf("unable to create iommu group: %v", err)
+	}
+	s.nextIommuGroup++
+	return s.symlink(group, filepath.Join(devicePath, "iommu_group"))
+}
+
+func (s *Sysfs) symlink(target string, link string) error {
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return fmt.Errorf("unable to create %s: %v", filepath.Dir(link), err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		return fmt.Errorf("unable to create symlink %s: %v", link, err)
+	}
+	return nil
+}
+
+func (s *Sysfs) path(elem ...string) string {
+	return filepath.Join(append([]string{s.root}, elem...)...)
+}
+
+func writeFile(path string, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("unable to create %s: %v", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+		return fmt.Errorf("unable to write %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package xdxlib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chen-mao/go-xdxlib/pkg/xdxpci"
+)
+
+var mdevTypeNameRegexp = regexp.MustCompile(`Type Name: (\w+)`)
+
+// Mdev allows us to get a list of XDXCT mdev (vGPU) and parent devices
+type Mdev interface {
+	GetAllMediatedDevices() ([]*MediatedDevice, error)
+	GetAllParentDevices() ([]*ParentDevice, error)
+}
+
+// MediatedDevice represents an XDXCT mdev (vGPU) device
+type MediatedDevice struct {
+	Path       string
+	UUID       string
+	MDEVType   string
+	Driver     string
+	IommuGroup int
+	Parent     *ParentDevice
+	write      WriteFunc
+}
+
+// ParentDevice represents an XDXCT PCI device vGPU devices can be created on
+type ParentDevice struct {
+	*xdxpci.XDXCTPCIDevice
+	mdevPaths map[string]string
+	write     WriteFunc
+}
+
+// xdxmdevLib implements 'Mdev' below a configurable sysfs root
+type xdxmdevLib struct {
+	pci            *xdxpciLib
+	mdevParentRoot string
+	mdevDeviceRoot string
+	write          WriteFunc
+}
+
+// GetAllMediatedDevices returns all XDXCT mdev (vGPU) devices on the system
+func (m *xdxmdevLib) GetAllMediatedDevices() ([]*MediatedDevice, error) {
+	deviceDirs, err := os.ReadDir(m.mdevDeviceRoot)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read mdev bus devices: %v", err)
+	}
+	var devices []*MediatedDevice
+	for _, deviceDir := range deviceDirs {
+		device, err := m.newMediatedDevice(deviceDir.Name())
+		if err != nil {
+			// The device may have been removed concurrently, e.g. while another GPU is reconfigured
+			if _, statErr := os.Lstat(filepath.Join(m.mdevDeviceRoot, deviceDir.Name())); os.IsNotExist(statErr) {
+				continue
+			}
+			return nil, fmt.Errorf("error constructing xdxct MDEV device: %v", err)
+		}
+		if device == nil {
+			continue
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// GetAllParentDevices returns all XDXCT parent PCI devices on the system, sorted by PCI address
+func (m *xdxmdevLib) GetAllParentDevices() ([]*ParentDevice, error) {
+	deviceDirs, err := os.ReadDir(m.mdevParentRoot)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read mdev parent devices: %v", err)
+	}
+	var parents []*ParentDevice
+	for _, deviceDir := range deviceDirs {
+		parent, err := m.newParentDevice(deviceDir.Name())
+		if err != nil {
+			return nil, fmt.Errorf("error constructing xdxct parent device: %v", err)
+		}
+		if parent == nil {
+			continue
+		}
+		parents = append(parents, parent)
+	}
+	sort.Slice(parents, func(i, j int) bool {
+		return addressToID(parents[i].Address) < addressToID(parents[j].Address)
+	})
+	return parents, nil
+}
+
+func (m *xdxmdevLib) newMediatedDevice(uuid string) (*MediatedDevice, error) {
+	devicePath := filepath.Join(m.mdevDeviceRoot, uuid)
+	resolved, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving symlink for %s: %v", devicePath, err)
+	}
+
+	parent, err := m.newParentDevice(filepath.Base(filepath.Dir(resolved)))
+	if err != nil {
+		return nil, fmt.Errorf("error getting parent device: %v", err)
+	}
+	if parent == nil {
+		return nil, nil
+	}
+
+	mdevTypeDir, err := filepath.EvalSymlinks(filepath.Join(resolved, "mdev_type"))
+	if err != nil {
+		return nil, fmt.Errorf("error resolving mdev_type: %v", err)
+	}
+	mdevType, err := readMDEVTypeName(mdevTypeDir)
+	if err != nil {
+		return nil, fmt.Errorf("error get mdev type: %v", err)
+	}
+
+	driver, err := filepath.EvalSymlinks(filepath.Join(resolved, "driver"))
+	if err != nil {
+		return nil, fmt.Errorf("error detecting driver: %v", err)
+	}
+
+	iommuGroup, err := readIommuGroup(resolved)
+	if err != nil {
+		return nil, fmt.Errorf("error detecting Iommu Group: %v", err)
+	}
+
+	return &MediatedDevice{
+		Path:       devicePath,
+		UUID:       uuid,
+		MDEVType:   mdevType,
+		Driver:     filepath.Base(driver),
+		IommuGroup: iommuGroup,
+		Parent:     parent,
+		write:      m.write,
+	}, nil
+}
+
+func (m *xdxmdevLib) newParentDevice(address string) (*ParentDevice, error) {
+	device, err := m.pci.GetGPUByPciBusID(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct XDXCT PCI device: %v", err)
+	}
+	if device == nil {
+		// Not a XDXCT device
+		return nil, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(device.Path, "mdev_supported_types", "xgv-XGV_V0_*"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get files in mdev_supported_types directory: %v", err)
+	}
+	mdevPaths := make(map[string]string)
+	for _, path := range paths {
+		mdevType, err := readMDEVTypeName(path)
+		if err != nil {
+			return nil, err
+		}
+		mdevPaths[mdevType] = path
+	}
+	return &ParentDevice{
+		XDXCTPCIDevice: device,
+		mdevPaths:      mdevPaths,
+		write:          m.write,
+	}, nil
+}
+
+// readMDEVTypeName parses the type name out of the 'name' attribute of an mdev type
+func readMDEVTypeName(mdevTypeDir string) (string, error) {
+	name, err := os.ReadFile(filepath.Join(mdevTypeDir, "name"))
+	if err != nil {
+		return "", fmt.Errorf("unable to read mdev_type name %s: %v", mdevTypeDir, err)
+	}
+	matches := mdevTypeNameRegexp.FindStringSubmatch(strings.TrimSpace(string(name)))
+	if len(matches) < 2 {
+		return "", fmt.Errorf("unable to parse mdev_type name %s", strings.TrimSpace(string(name)))
+	}
+	return matches[1], nil
+}
+
+// Delete deletes a mediated device (vGPU)
+func (d *MediatedDevice) Delete() error {
+	err := d.write(filepath.Join(d.Path, "remove"), "1")
+	if err != nil {
+		return fmt.Errorf("unable to delete mdev: %w", err)
+	}
+	return nil
+}
+
+// CreateMDEVDevice creates a mediated device (vGPU) on the parent GPU
+func (pd *ParentDevice) CreateMDEVDevice(mdevType string, uuid string) error {
+	mdevPath, ok := pd.mdevPaths[mdevType]
+	if !ok {
+		return fmt.Errorf("unable to create mdev %s: mdev not supported by parent device %s", mdevType, pd.Address)
+	}
+	err := pd.write(filepath.Join(mdevPath, "create"), uuid)
+	if err != nil {
+		return fmt.Errorf("unable to create mdev: %w", err)
+	}
+	return nil
+}
+
+// IsMDEVTypeSupported checks if the mdevType is supported by the GPU
+func (pd *ParentDevice) IsMDEVTypeSupported(mdevType string) bool {
+	_, found := pd.mdevPaths[mdevType]
+	return found
+}
+
+// GetSupportedMDEVTypes returns the names of all mdev types supported by the GPU
+func (pd *ParentDevice) GetSupportedMDEVTypes() []string {
+	var mdevTypes []string
+	for mdevType := range pd.mdevPaths {
+		mdevTypes = append(mdevTypes, mdevType)
+	}
+	sort.Strings(mdevTypes)
+	return mdevTypes
+}
+
+// GetMDEVTypeName returns the 'name' attribute of the mdevType as reported by sysfs,
+// e.g. "Type ID: 1; Type Name: XGV_V0_1G_1_CORE"
+func (pd *ParentDevice) GetMDEVTypeName(mdevType string) (string, error) {
+	mdevPath, ok := pd.mdevPaths[mdevType]
+	if !ok {
+		return "", fmt.Errorf("mdev %s not supported by parent device %s", mdevType, pd.Address)
+	}
+	name, err := os.ReadFile(filepath.Join(mdevPath, "name"))
+	if err != nil {
+		return "", fmt.Errorf("unable to read mdev_type name %s: %v", mdevPath, err)
+	}
+	return strings.TrimSpace(string(name)), nil
+}
+
+// GetMDEVTypeID returns the name of the directory of the mdevType in mdev_supported_types,
+// which identifies the type to tools like mdevctl, e.g. "xgv-XGV_V0_1G_1_CORE"
+func (pd *ParentDevice) GetMDEVTypeID(mdevType string) (string, error) {
+	mdevPath, ok := pd.mdevPaths[mdevType]
+	if !ok {
+		return "", fmt.Errorf("mdev %s not supported by parent device %s", mdevType, pd.Address)
+	}
+	return filepath.Base(mdevPath), nil
+}
+
+// GetAvailableMDEVInstances returns the number of devices of the mdevType that can still be created
+func (pd *ParentDevice) GetAvailableMDEVInstances(mdevType string) (int, error) {
+	mdevPath, ok := pd.mdevPaths[mdevType]
+	if !ok {
+		return -1, nil
+	}
+	available, err := os.ReadFile(filepath.Join(mdevPath, "available_instances"))
+	if err != nil {
+		return -1, fmt.Errorf("unable to read available instances: %v", err)
+	}
+	availableInstances, err := strconv.Atoi(strings.TrimSpace(string(available)))
+	if err != nil {
+		return -1, fmt.Errorf("unable to convert available instances to an int: %v", err)
+	}
+	return availableInstances, nil
+}
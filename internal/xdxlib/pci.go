@@ -0,0 +1,184 @@
+package xdxlib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chen-mao/go-xdxlib/pkg/xdxpci"
+)
+
+// xdxpciLib implements 'xdxpci.Interface' below a configurable sysfs root. The vendored
+// xdxpci cannot be used for this: its WithPCIDevicesRoot option sets a field it never
+// reads, so it always reads /sys/bus/pci/devices. It also returns SR-IOV virtual
+// functions as GPUs of their own and never reports the NUMA node of a GPU.
+type xdxpciLib struct {
+	pciDevicesRoot string
+}
+
+var _ xdxpci.Interface = (*xdxpciLib)(nil)
+
+// GetGPUByPciBusID returns the XDXCT PCI device at 'address', or nil if it is not an XDXCT device
+func (p *xdxpciLib) GetGPUByPciBusID(address string) (*xdxpci.XDXCTPCIDevice, error) {
+	devicePath := filepath.Join(p.pciDevicesRoot, address)
+
+	vendorID, err := readUint(devicePath, "vendor", 16)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pci device vendor id for %s: %v", address, err)
+	}
+	if uint16(vendorID) != xdxpci.PCIXDXCTVendorID {
+		return nil, nil
+	}
+
+	class, err := readUint(devicePath, "class", 32)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pci device class for %s: %v", address, err)
+	}
+
+	deviceID, err := readUint(devicePath, "device", 16)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read PCI device id for %s: %v", address, err)
+	}
+
+	driver, err := filepath.EvalSymlinks(filepath.Join(devicePath, "driver"))
+	if err == nil {
+		driver = filepath.Base(driver)
+	} else if os.IsNotExist(err) {
+		driver = ""
+	} else {
+		return nil, fmt.Errorf("unable to detect driver for %s: %v", address, err)
+	}
+
+	iommuGroup, err := readIommuGroup(devicePath)
+	if os.IsNotExist(err) {
+		iommuGroup = -1
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to detect iommu_group for %s: %v", address, err)
+	}
+
+	numa, err := os.ReadFile(filepath.Join(devicePath, "numa_node"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read PCI NUMA node for %s: %v", address, err)
+	}
+	numaNode, err := strconv.ParseInt(strings.TrimSpace(string(numa)), 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert NUMA node string to int64: %v", err)
+	}
+
+	return &xdxpci.XDXCTPCIDevice{
+		Path:       devicePath,
+		Address:    address,
+		Vendor:     uint16(vendorID),
+		Class:      uint32(class),
+		Device:     uint16(deviceID),
+		Driver:     driver,
+		IommuGroup: iommuGroup,
+		NumaNode:   int(numaNode),
+		Config: &xdxpci.ConfigSpace{
+			Path: filepath.Join(devicePath, "config"),
+		},
+	}, nil
+}
+
+// GetGPUs returns all XDXCT GPU devices, sorted by PCI address. SR-IOV virtual
+// functions are not returned, they belong to the GPU of their physical function.
+func (p *xdxpciLib) GetGPUs() ([]*xdxpci.XDXCTPCIDevice, error) {
+	deviceDirs, err := os.ReadDir(p.pciDevicesRoot)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read PCI bus devices: %v", err)
+	}
+	var gpus []*xdxpci.XDXCTPCIDevice
+	for _, deviceDir := range deviceDirs {
+		device, err := p.GetGPUByPciBusID(deviceDir.Name())
+		if err != nil {
+			return nil, fmt.Errorf("error constructing xdxct pci device %s: %v", deviceDir.Name(), err)
+		}
+		if device == nil || !device.IsGPU() || isVirtualFunction(device.Path) {
+			continue
+		}
+		gpus = append(gpus, device)
+	}
+	sort.Slice(gpus, func(i, j int) bool {
+		return addressToID(gpus[i].Address) < addressToID(gpus[j].Address)
+	})
+	return gpus, nil
+}
+
+// GetGPUByIndex returns the XDXCT GPU at index 'i' in PCI address order
+func (p *xdxpciLib) GetGPUByIndex(i int) (*xdxpci.XDXCTPCIDevice, error) {
+	gpus, err := p.GetGPUs()
+	if err != nil {
+		return nil, fmt.Errorf("error getting all gpus: %v", err)
+	}
+	if i < 0 || i >= len(gpus) {
+		return nil, fmt.Errorf("invalid index '%d'", i)
+	}
+	return gpus[i], nil
+}
+
+// GetVirtualFunctions returns the PCI addresses of the SR-IOV virtual functions of
+// a device, in the order of their virtual function number
+func GetVirtualFunctions(device *xdxpci.XDXCTPCIDevice) ([]string, error) {
+	links, err := filepath.Glob(filepath.Join(device.Path, "virtfn*"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list virtual functions of %s: %v", device.Address, err)
+	}
+	numbers := make(map[string]int)
+	var addresses []string
+	for _, link := range links {
+		number, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(link), "virtfn"))
+		if err != nil {
+			continue
+		}
+		target, err := os.Readlink(link)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve virtual function %s of %s: %v", filepath.Base(link), device.Address, err)
+		}
+		address := filepath.Base(target)
+		numbers[address] = number
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return numbers[addresses[i]] < numbers[addresses[j]]
+	})
+	return addresses, nil
+}
+
+func isVirtualFunction(devicePath string) bool {
+	_, err := os.Lstat(filepath.Join(devicePath, "physfn"))
+	return err == nil
+}
+
+func readUint(devicePath string, attribute string, bitSize int) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(devicePath, attribute))
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 0, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("unable to convert %s string to uint%d: %v", attribute, bitSize, err)
+	}
+	return value, nil
+}
+
+func readIommuGroup(devicePath string) (int, error) {
+	iommu, err := filepath.EvalSymlinks(filepath.Join(devicePath, "iommu_group"))
+	if err != nil {
+		return -1, err
+	}
+	iommuGroup, err := strconv.ParseInt(strings.TrimSpace(filepath.Base(iommu)), 0, 64)
+	if err != nil {
+		return -1, fmt.Errorf("unable to convert iommu_group string to int64: %v", err)
+	}
+	return int(iommuGroup), nil
+}
+
+func addressToID(address string) uint64 {
+	address = strings.ReplaceAll(address, ":", "")
+	address = strings.ReplaceAll(address, ".", "")
+	id, _ := strconv.ParseUint(address, 16, 64)
+	return id
+}
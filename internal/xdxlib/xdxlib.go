@@ -1,18 +1,86 @@
 package xdxlib
 
 import (
-	"github.com/chen-mao/go-xdxlib/pkg/xdxmdev"
+	"fmt"
+	"os"
+	"path/filepath"
+
 	"github.com/chen-mao/go-xdxlib/pkg/xdxpci"
 )
 
+const (
+	pciDevicesRoot = "/sys/bus/pci/devices"
+	mdevParentRoot = "/sys/class/mdev_bus"
+	mdevDeviceRoot = "/sys/bus/mdev/devices"
+)
+
+// Interface gives access to the XDXCT PCI devices and the mdev (vGPU) devices created on them
 type Interface struct {
 	Xdxpci  xdxpci.Interface
-	Xdxmdev xdxmdev.Interface
+	Xdxmdev Mdev
+}
+
+// WriteFunc writes 'data' to the sysfs attribute at 'path'
+type WriteFunc func(path string, data string) error
+
+type options struct {
+	sysfsRoot string
+	write     WriteFunc
+}
+
+// Option defines a function for passing options to the New() call
+type Option func(*options)
+
+// WithSysfsRoot sets the directory sysfs is mounted at, '/' by default
+func WithSysfsRoot(root string) Option {
+	return func(o *options) {
+		o.sysfsRoot = root
+	}
+}
+
+// WithWriteFunc sets the function used to write to the 'create' and 'remove'
+// sysfs attributes, so that a fake sysfs can emulate the kernel
+func WithWriteFunc(write WriteFunc) Option {
+	return func(o *options) {
+		o.write = write
+	}
 }
 
-func New() Interface {
+func New(opts ...Option) Interface {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.sysfsRoot == "" {
+		o.sysfsRoot = "/"
+	}
+	if o.write == nil {
+		o.write = writeSysfsFile
+	}
+
+	pci := &xdxpciLib{
+		pciDevicesRoot: filepath.Join(o.sysfsRoot, pciDevicesRoot),
+	}
 	return Interface{
-		Xdxpci:  xdxpci.New(),
-		Xdxmdev: xdxmdev.New(),
+		Xdxpci: pci,
+		Xdxmdev: &xdxmdevLib{
+			pci:            pci,
+			mdevParentRoot: filepath.Join(o.sysfsRoot, mdevParentRoot),
+			mdevDeviceRoot: filepath.Join(o.sysfsRoot, mdevDeviceRoot),
+			write:          o.write,
+		},
+	}
+}
+
+func writeSysfsFile(path string, data string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_SYNC, 0200)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", filepath.Base(path), err)
+	}
+	defer file.Close()
+	_, err = file.WriteString(data)
+	if err != nil {
+		return fmt.Errorf("unable to write %s: %w", filepath.Base(path), err)
 	}
+	return nil
 }
@@ -0,0 +1,196 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Action is a change of a vGPU device
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionDelete Action = "delete"
+)
+
+// Result is whether a change succeeded
+type Result string
+
+const (
+	ResultSucceeded Result = "succeeded"
+	ResultFailed    Result = "failed"
+)
+
+const (
+	// ActorCLI and ActorDaemon identify the binary a change was made by
+	ActorCLI    = "cli"
+	ActorDaemon = "daemon"
+
+	// SyslogTarget sends audit records to syslog instead of a file
+	SyslogTarget = "syslog"
+
+	syslogTag = "xgv-vgpu-dm"
+)
+
+// Record is an audit record of a change of a vGPU device
+type Record struct {
+	Time          time.Time `json:"time"`
+	Actor         string    `json:"actor"`
+	Config        string    `json:"config,omitempty"`
+	ParentAddress string    `json:"parent"`
+	UUID          string    `json:"uuid"`
+	MDEVType      string    `json:"type"`
+	Action        Action    `json:"action"`
+	Result        Result    `json:"result"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// Sink stores audit records
+type Sink interface {
+	Write(record Record) error
+	Close() error
+}
+
+// Auditor records the changes of vGPU devices made by an actor. A nil Auditor records nothing.
+type Auditor struct {
+	sink   Sink
+	actor  string
+	config string
+}
+
+// New returns an Auditor writing the records of 'actor' to 'sink'
+func New(sink Sink, actor string) *Auditor {
+	return &Auditor{
+		sink:  sink,
+		actor: actor,
+	}
+}
+
+// Open returns an Auditor writing to 'target': syslog if it is "syslog", otherwise a
+// JSON-lines file appended to. It returns nil if 'target' is empty.
+func Open(target string, actor string) (*Auditor, error) {
+	var sink Sink
+	var err error
+	switch target {
+	case "":
+		return nil, nil
+	case SyslogTarget:
+		sink, err = NewSyslogSink()
+	default:
+		sink, err = NewFileSink(target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return New(sink, actor), nil
+}
+
+// WithConfig returns an Auditor that records the name of the vGPU config the changes are made for
+func (a *Auditor) WithConfig(config string) *Auditor {
+	if a == nil {
+		return nil
+	}
+	return &Auditor{
+		sink:   a.sink,
+		actor:  a.actor,
+		config: config,
+	}
+}
+
+// Record records a change of a vGPU device, 'err' is the error the change failed with, if any
+func (a *Auditor) Record(action Action, parentAddress string, uuid string, mdevType string, err error) error {
+	if a == nil {
+		return nil
+	}
+	record := Record{
+		Time:          time.Now().UTC(),
+		Actor:         a.actor,
+		Config:        a.config,
+		ParentAddress: parentAddress,
+		UUID:          uuid,
+		MDEVType:      mdevType,
+		Action:        action,
+		Result:        ResultSucceeded,
+	}
+	if err != nil {
+		record.Result = ResultFailed
+		record.Error = err.Error()
+	}
+	if err := a.sink.Write(record); err != nil {
+		return fmt.Errorf("unable to write audit record: %v", err)
+	}
+	return nil
+}
+
+// Close closes the sink of the Auditor
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.sink.Close()
+}
+
+// fileSink appends audit records as JSON lines to a file
+type fileSink struct {
+	sync.Mutex
+	file *os.File
+}
+
+// NewFileSink returns a Sink appending audit records as JSON lines to the file at 'path'
+func NewFileSink(path string) (Sink, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create audit log directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %v", err)
+	}
+	return &fileSink{file: file}, nil
+}
+
+func (s *fileSink) Write(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+// syslogSink sends audit records as JSON to syslog
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink returns a Sink sending audit records as JSON to the local syslog daemon
+func NewSyslogSink() (Sink, error) {
+	writer, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_AUTHPRIV, syslogTag)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to syslog: %v", err)
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) Write(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.writer.Notice(string(data))
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,111 @@
+package cdi
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib"
+)
+
+const (
+	Version = "0.5.0"
+	Kind    = "xdxct.com/vgpu"
+
+	// DefaultSpecFile is where CDI-aware runtimes look up the spec of XDXCT vGPUs
+	DefaultSpecFile = "/etc/cdi/xdxct-vgpu.yaml"
+
+	vfioDir       = "/dev/vfio"
+	vfioContainer = "/dev/vfio/vfio"
+)
+
+// Spec is a Container Device Interface spec, see
+// https://github.com/cncf-tags/container-device-interface/blob/main/SPEC.md
+type Spec struct {
+	Version        string         `json:"cdiVersion" yaml:"cdiVersion"`
+	Kind           string         `json:"kind" yaml:"kind"`
+	Devices        []Device       `json:"devices" yaml:"devices"`
+	ContainerEdits ContainerEdits `json:"containerEdits,omitempty" yaml:"containerEdits,omitempty"`
+}
+
+// Device is a device of a CDI spec, requested as '<kind>=<name>'
+type Device struct {
+	Name           string         `json:"name" yaml:"name"`
+	ContainerEdits ContainerEdits `json:"containerEdits" yaml:"containerEdits"`
+}
+
+// ContainerEdits are the changes made to a container the device is injected into
+type ContainerEdits struct {
+	DeviceNodes []DeviceNode `json:"deviceNodes,omitempty" yaml:"deviceNodes,omitempty"`
+}
+
+// DeviceNode is a device node injected into a container
+type DeviceNode struct {
+	Path string `json:"path" yaml:"path"`
+}
+
+// NewSpec returns a spec with a device per vGPU device, named by its UUID, that injects
+// the VFIO group of the vGPU device. The VFIO container device is injected with any of them.
+func NewSpec(devices []*xdxlib.MediatedDevice) *Spec {
+	spec := &Spec{
+		Version: Version,
+		Kind:    Kind,
+		Devices: []Device{},
+		ContainerEdits: ContainerEdits{
+			DeviceNodes: []DeviceNode{{Path: vfioContainer}},
+		},
+	}
+	for _, device := range devices {
+		spec.Devices = append(spec.Devices, Device{
+			Name: device.UUID,
+			ContainerEdits: ContainerEdits{
+				DeviceNodes: []DeviceNode{{Path: filepath.Join(vfioDir, fmt.Sprint(device.IommuGroup))}},
+			},
+		})
+	}
+	return spec
+}
+
+// Write writes the spec as YAML
+func (s *Spec) Write(w io.Writer) error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("marshal error: %v", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// WriteSpecFile atomically writes the spec to 'path'. A spec without devices is
+// invalid, so the file is removed instead.
+func WriteSpecFile(path string, spec *Spec) error {
+	if len(spec.Devices) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove CDI spec file: %v", err)
+		}
+		return nil
+	}
+
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("marshal error: %v", err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create CDI spec directory: %v", err)
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write CDI spec file: %v", err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("unable to write CDI spec file: %v", err)
+	}
+	return nil
+}
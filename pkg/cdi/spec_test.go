@@ -0,0 +1,93 @@
+package cdi
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+var testDevices = []*xdxlib.MediatedDevice{
+	{UUID: "5b8e1e6a-5a1c-4d8b-9d3e-0c6f2a1b3c4d", MDEVType: "XGV_V0_1G_1_CORE", IommuGroup: 12},
+	{UUID: "9f0c2d4e-1b3a-4c5d-8e7f-6a5b4c3d2e1f", MDEVType: "XGV_V0_1G_1_CORE", IommuGroup: 13},
+	{UUID: "0b1c2d3e-4f5a-4b6c-8d7e-9f0a1b2c3d4e", MDEVType: "XGV_V0_2G_1_CORE", IommuGroup: 7},
+}
+
+// checkGolden compares 'actual' with the golden file 'name' in testdata, or updates it with -update
+func checkGolden(t *testing.T, name string, actual []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, actual, 0644); err != nil {
+			t.Fatalf("unexpected error updating %s: %v", path, err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading %s: %v", path, err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expected output of %s:\n%s\ngot:\n%s", path, expected, actual)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	testCases := []struct {
+		description string
+		devices     []*xdxlib.MediatedDevice
+		golden      string
+	}{
+		{
+			description: "vGPU devices",
+			devices:     testDevices,
+			golden:      "spec.golden",
+		},
+		{
+			description: "no vGPU devices",
+			golden:      "spec-empty.golden",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewSpec(tc.devices).Write(&buf); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			checkGolden(t, tc.golden, buf.Bytes())
+		})
+	}
+}
+
+func TestWriteSpecFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cdi", "xdxct-vgpu.yaml")
+
+	// Creates the directory and writes the same spec as Write
+	if err := WriteSpecFile(path, NewSpec(testDevices)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading spec file: %v", err)
+	}
+	checkGolden(t, "spec.golden", data)
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("expected temporary file to be renamed, got %v", err)
+	}
+
+	// A spec without devices removes the file, also if it does not exist
+	for i := 0; i < 2; i++ {
+		if err := WriteSpecFile(path, NewSpec(nil)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected spec file to be removed, got %v", err)
+		}
+	}
+}
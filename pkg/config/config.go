@@ -0,0 +1,178 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	v1 "github.com/chen-mao/xdxct-vgpu-device-manager/api/spec/v1"
+)
+
+// Parse parses the content of a vGPU config file into a 'Spec', resolving includes
+// relative to the working directory and extends between named configs
+func Parse(data []byte) (*v1.Spec, error) {
+	spec, _, err := load(data, ".", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveExtends(spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// ParseFile reads and parses a vGPU config file into a 'Spec', resolving includes
+// relative to the directory of the file and extends between named configs. If 'path'
+// is a directory, all config fragments in it are merged into one 'Spec'.
+func ParseFile(path string) (*v1.Spec, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("read file error: %w", err)
+	}
+	var spec *v1.Spec
+	if info.IsDir() {
+		spec, err = loadDir(path)
+	} else {
+		spec, _, err = loadFile(path, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveExtends(spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// loadDir reads all '*.yaml', '*.yml' and '*.json' config fragments in a directory, in
+// lexical order, and merges their named configs. Hidden files, e.g. the '..data' link
+// of a mounted ConfigMap, are skipped.
+func loadDir(dir string) (*v1.Spec, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read directory error: %w", err)
+	}
+
+	spec := &v1.Spec{
+		VGPUConfigs: make(map[string]v1.VGPUConfigSpecSlice),
+	}
+	definedIn := make(map[string]string)
+	fragments := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		switch filepath.Ext(name) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+
+		fragment, origins, err := loadFile(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		fragments++
+		if fragment.Version != "" {
+			if spec.Version != "" && spec.Version != fragment.Version {
+				return nil, fmt.Errorf("%s: version %s does not match version %s of other fragments", path, fragment.Version, spec.Version)
+			}
+			spec.Version = fragment.Version
+		}
+		for configName, configs := range fragment.VGPUConfigs {
+			if other, exists := definedIn[configName]; exists {
+				if other == origins[configName] {
+					// Both fragments include the file defining it
+					continue
+				}
+				return nil, fmt.Errorf("vgpu-config %s is defined in both %s and %s", configName, other, origins[configName])
+			}
+			definedIn[configName] = origins[configName]
+			spec.VGPUConfigs[configName] = configs
+		}
+	}
+	if fragments == 0 {
+		return nil, fmt.Errorf("no config fragments found in directory %s", dir)
+	}
+	return spec, nil
+}
+
+// origins maps the name of each config to the absolute path of the file defining it
+type origins map[string]string
+
+// loadFile reads a config file and the files it includes. 'including' is the chain of
+// files including it, to detect include cycles.
+func loadFile(path string, including []string) (*v1.Spec, origins, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid path %s: %v", path, err)
+	}
+	for i, p := range including {
+		if p == abs {
+			return nil, nil, fmt.Errorf("include cycle: %s", strings.Join(append(including[i:], abs), " -> "))
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read file error: %w", err)
+	}
+	spec, definedIn, err := load(data, filepath.Dir(abs), append(append([]string{}, including...), abs))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return spec, definedIn, nil
+}
+
+// load parses a config and adds the named configs of the files it includes, which
+// are looked up relative to 'dir'. A file included more than once, e.g. by two files
+// that are both included, is only merged once: a config is only defined more than once
+// if two different files define it.
+func load(data []byte, dir string, including []string) (*v1.Spec, origins, error) {
+	var spec v1.Spec
+	err := yaml.Unmarshal(data, &spec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unmarshal error: %v", err)
+	}
+
+	self := ""
+	if len(including) > 0 {
+		self = including[len(including)-1]
+	}
+	definedIn := make(origins)
+	for name := range spec.VGPUConfigs {
+		definedIn[name] = self
+	}
+
+	for _, include := range spec.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(dir, include)
+		}
+		included, includedIn, err := loadFile(include, including)
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, configs := range included.VGPUConfigs {
+			if other, exists := definedIn[name]; exists {
+				if other == includedIn[name] {
+					continue
+				}
+				return nil, nil, fmt.Errorf("vgpu-config %s is defined more than once, also in %s", name, includedIn[name])
+			}
+			if spec.VGPUConfigs == nil {
+				spec.VGPUConfigs = make(map[string]v1.VGPUConfigSpecSlice)
+			}
+			spec.VGPUConfigs[name] = configs
+			definedIn[name] = includedIn[name]
+		}
+	}
+	spec.Include = nil
+	return &spec, definedIn, nil
+}
@@ -0,0 +1,306 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes the files of 'files', by name, to a temporary directory and returns it
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+const commonConfig = `version: v1
+vgpu-configs:
+  common:
+    - devices: all
+      vgpu-devices:
+        "XGV_V0_1G_1_CORE": 1
+`
+
+func TestParseFileIncludes(t *testing.T) {
+	testCases := []struct {
+		description string
+		files       map[string]string
+		expected    []string
+		expectedErr string
+	}{
+		{
+			description: "diamond include",
+			files: map[string]string{
+				"main.yaml": "version: v1\ninclude: [a.yaml, b.yaml]\n",
+				"a.yaml": `version: v1
+include: common.yaml
+vgpu-configs:
+  a:
+    - devices: all
+      vgpu-devices:
+        "XGV_V0_1G_1_CORE": 2
+`,
+				"b.yaml": `version: v1
+include: common.yaml
+vgpu-configs:
+  b:
+    - devices: all
+      vgpu-devices:
+        "XGV_V0_2G_1_CORE": 1
+`,
+				"common.yaml": commonConfig,
+			},
+			expected: []string{"a", "b", "common"},
+		},
+		{
+			description: "config defined in two files",
+			files: map[string]string{
+				"main.yaml":   "version: v1\ninclude: [common.yaml, other.yaml]\n",
+				"common.yaml": commonConfig,
+				"other.yaml":  commonConfig,
+			},
+			expectedErr: "vgpu-config common is defined more than once",
+		},
+		{
+			description: "included config defined again",
+			files: map[string]string{
+				"main.yaml":   strings.Replace(commonConfig, "version: v1\n", "version: v1\ninclude: common.yaml\n", 1),
+				"common.yaml": commonConfig,
+			},
+			expectedErr: "vgpu-config common is defined more than once",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			dir := writeFiles(t, tc.files)
+			spec, err := ParseFile(filepath.Join(dir, "main.yaml"))
+			if tc.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Fatalf("expected error %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(spec.VGPUConfigs) != len(tc.expected) {
+				t.Fatalf("expected configs %v, got %v", tc.expected, spec.VGPUConfigs)
+			}
+			for _, name := range tc.expected {
+				if _, exists := spec.VGPUConfigs[name]; !exists {
+					t.Errorf("expected config %s, got %v", name, spec.VGPUConfigs)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFileDirectorySharedInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.yaml": "version: v1\ninclude: common.yml.inc\n",
+		"b.yaml": "version: v1\ninclude: common.yml.inc\n",
+	})
+	if err := os.WriteFile(filepath.Join(dir, "common.yml.inc"), []byte(commonConfig), 0644); err != nil {
+		t.Fatalf("unable to write common.yml.inc: %v", err)
+	}
+
+	spec, err := ParseFile(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, exists := spec.VGPUConfigs["common"]; !exists || len(spec.VGPUConfigs) != 1 {
+		t.Errorf("expected config common, got %v", spec.VGPUConfigs)
+	}
+}
+
+// fragment returns a config fragment defining the named config 'name'
+func fragment(name string) string {
+	return strings.Replace(commonConfig, "common:", name+":", 1)
+}
+
+func TestParseFileDirectory(t *testing.T) {
+	testCases := []struct {
+		description string
+		files       map[string]string
+		expected    []string
+		// expectedErr is the expected error, with $DIR standing for the directory
+		expectedErr string
+	}{
+		{
+			description: "fragments merged",
+			files: map[string]string{
+				"a.yaml": fragment("a"),
+				"b.yml":  fragment("b"),
+				"c.json": `{"version": "v1", "vgpu-configs": {"c": [{"devices": "all", "vgpu-devices": {"XGV_V0_1G_1_CORE": 1}}]}}`,
+			},
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			description: "hidden and non-YAML files skipped",
+			files: map[string]string{
+				"a.yaml":     fragment("a"),
+				".b.yaml":    "{",
+				"README.md":  "{",
+				"a.yaml.bak": "{",
+			},
+			expected: []string{"a"},
+		},
+		{
+			description: "extends across fragments",
+			files: map[string]string{
+				"a.yaml": fragment("a"),
+				"b.yaml": "version: v1\nvgpu-configs:\n  b:\n    - extends: a\n",
+			},
+			expected: []string{"a", "b"},
+		},
+		{
+			description: "same config in two fragments",
+			files: map[string]string{
+				"a.yaml": commonConfig,
+				"b.yaml": commonConfig,
+			},
+			expectedErr: "vgpu-config common is defined in both $DIR/a.yaml and $DIR/b.yaml",
+		},
+		{
+			description: "fragments read in lexical order",
+			files: map[string]string{
+				"9-team.yaml":  commonConfig,
+				"10-team.yaml": commonConfig,
+			},
+			expectedErr: "vgpu-config common is defined in both $DIR/10-team.yaml and $DIR/9-team.yaml",
+		},
+		{
+			description: "versions differ",
+			files: map[string]string{
+				"a.yaml": fragment("a"),
+				"b.yaml": strings.Replace(fragment("b"), "version: v1", "version: v2", 1),
+			},
+			expectedErr: "$DIR/b.yaml: version v2 does not match version v1 of other fragments",
+		},
+		{
+			description: "no fragments",
+			files: map[string]string{
+				"README.md": "{",
+			},
+			expectedErr: "no config fragments found in directory $DIR",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			dir := writeFiles(t, tc.files)
+			spec, err := ParseFile(dir)
+			if tc.expectedErr != "" {
+				expectedErr := strings.ReplaceAll(tc.expectedErr, "$DIR", dir)
+				if err == nil || !strings.Contains(err.Error(), expectedErr) {
+					t.Fatalf("expected error %q, got %v", expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if spec.Version != "v1" {
+				t.Errorf("expected version v1, got %s", spec.Version)
+			}
+			if len(spec.VGPUConfigs) != len(tc.expected) {
+				t.Fatalf("expected configs %v, got %v", tc.expected, spec.VGPUConfigs)
+			}
+			for _, name := range tc.expected {
+				if _, exists := spec.VGPUConfigs[name]; !exists {
+					t.Errorf("expected config %s, got %v", name, spec.VGPUConfigs)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFileDirectoryConfigMap(t *testing.T) {
+	// A mounted ConfigMap links its keys to the files of a hidden, timestamped directory
+	dir := t.TempDir()
+	data := filepath.Join(dir, "..2026_10_19_00_00_00.000000000")
+	if err := os.Mkdir(data, 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, content := range map[string]string{"a.yaml": fragment("a"), "b.yaml": fragment("b")} {
+		if err := os.WriteFile(filepath.Join(data, name), []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write %s: %v", name, err)
+		}
+	}
+	links := map[string]string{
+		"..data": filepath.Base(data),
+		"a.yaml": filepath.Join("..data", "a.yaml"),
+		"b.yaml": filepath.Join("..data", "b.yaml"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("unable to link %s: %v", name, err)
+		}
+	}
+
+	spec, err := ParseFile(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(spec.VGPUConfigs) != 2 {
+		t.Errorf("expected configs a and b, got %v", spec.VGPUConfigs)
+	}
+}
+
+func TestParseExtends(t *testing.T) {
+	testCases := []struct {
+		description string
+		entry       string
+		expectedErr string
+	}{
+		{
+			description: "extends",
+			entry:       "    - extends: common\n",
+		},
+		{
+			description: "extends with device-filter",
+			entry:       "    - extends: common\n      device-filter: \"0x00011eed\"\n",
+			expectedErr: "an entry with extends must not set device-filter",
+		},
+		{
+			description: "extends with devices",
+			entry:       "    - extends: common\n      devices: [0]\n",
+			expectedErr: "an entry with extends must not set device-filter, devices",
+		},
+		{
+			description: "unknown config",
+			entry:       "    - extends: unknown\n",
+			expectedErr: "extends unknown vgpu-config unknown",
+		},
+		{
+			description: "cycle",
+			entry:       "    - extends: extending\n",
+			expectedErr: "extends cycle: extending -> extending",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			spec, err := Parse([]byte(commonConfig + "  extending:\n" + tc.entry))
+			if tc.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Fatalf("expected error %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(spec.VGPUConfigs["extending"]) != 1 || spec.VGPUConfigs["extending"][0].Extends != "" {
+				t.Errorf("expected the entry of common, got %v", spec.VGPUConfigs["extending"])
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "github.com/chen-mao/xdxct-vgpu-device-manager/api/spec/v1"
+)
+
+// resolveExtends replaces the 'extends' entries of all named configs by the entries of the
+// named configs they reference
+func resolveExtends(spec *v1.Spec) error {
+	resolved := make(map[string]v1.VGPUConfigSpecSlice)
+
+	var resolve func(name string, path []string) (v1.VGPUConfigSpecSlice, error)
+	resolve = func(name string, path []string) (v1.VGPUConfigSpecSlice, error) {
+		if configs, done := resolved[name]; done {
+			return configs, nil
+		}
+		for i, p := range path {
+			if p == name {
+				return nil, fmt.Errorf("extends cycle: %s", strings.Join(append(path[i:], name), " -> "))
+			}
+		}
+		path = append(append([]string{}, path...), name)
+
+		configs := spec.VGPUConfigs[name]
+		result := v1.VGPUConfigSpecSlice{}
+		for _, vc := range configs {
+			if vc.Extends == "" {
+				result = append(result, vc)
+				continue
+			}
+			if vc.DeviceFilter != nil || vc.Devices != nil || len(vc.VGPUDevices) > 0 || len(vc.VGPUDeviceUUIDs) > 0 {
+				return nil, fmt.Errorf("vgpu-config %s: an entry with extends must not set device-filter, devices, vgpu-devices or vgpu-device-uuids", name)
+			}
+			if _, exists := spec.VGPUConfigs[vc.Extends]; !exists {
+				return nil, fmt.Errorf("vgpu-config %s extends unknown vgpu-config %s", name, vc.Extends)
+			}
+			inherited, err := resolve(vc.Extends, path)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, inherited...)
+		}
+		resolved[name] = result
+		return result, nil
+	}
+
+	for name := range spec.VGPUConfigs {
+		if _, err := resolve(name, nil); err != nil {
+			return err
+		}
+	}
+	spec.VGPUConfigs = resolved
+	return nil
+}
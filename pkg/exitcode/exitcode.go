@@ -0,0 +1,108 @@
+// Package exitcode defines the exit codes of xgv-vgpu-dm, so that scripts and the
+// daemon can tell failures apart without parsing log lines.
+//
+// A failure maps to the code of the most specific error it wraps, e.g. DeviceBusy
+// rather than ApplyFailed if the vGPU devices of a GPU could not be deleted. A command
+// that failed on several GPUs exits with ApplyFailed though, whatever the errors of the
+// GPUs, as no single code describes it. Only Timeout takes precedence, as it stops the
+// command on all GPUs at once.
+package exitcode
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+// Exit codes of xgv-vgpu-dm
+const (
+	// Success means the command succeeded
+	Success = 0
+	// Failure means the command failed for any reason not listed below
+	Failure = 1
+	// ConfigInvalid means the config file could not be parsed or is invalid
+	ConfigInvalid = 2
+	// UnknownConfig means the selected vgpu-config is not present in the config file
+	UnknownConfig = 3
+	// NotApplied means 'assert' found GPUs not matching the selected vgpu-config
+	NotApplied = 4
+	// LayoutInfeasible means the vGPU devices do not fit on the parent devices of a GPU
+	LayoutInfeasible = 5
+	// ApplyFailed means the vgpu-config could not be applied to several GPUs, or to a
+	// single GPU for a reason without a code of its own
+	ApplyFailed = 6
+	// PermissionDenied means writing to sysfs or reading a file was not permitted
+	PermissionDenied = 7
+	// TypeUnsupported means a vGPU type is not supported by a GPU
+	TypeUnsupported = 8
+	// GPUNotFound means a GPU could not be found
+	GPUNotFound = 9
+	// DeviceBusy means a vGPU device could not be created or deleted as it is in use
+	DeviceBusy = 10
+	// Timeout means the command was stopped as it ran longer than '--timeout'
+	Timeout = 11
+)
+
+// Errors wrapped by xgv-vgpu-dm to select an exit code, besides those of pkg/vgpu
+var (
+	ErrConfigInvalid = errors.New("invalid vgpu config")
+	ErrUnknownConfig = errors.New("selected vgpu-config not present")
+	ErrNotApplied    = errors.New("not all GPUs match the specified config")
+	ErrApplyFailed   = errors.New("failed to apply vgpu config")
+)
+
+// GPUErrors is implemented by errors collecting the failures of a command on several GPUs
+type GPUErrors interface {
+	error
+	// NumGPUs returns the number of GPUs that failed
+	NumGPUs() int
+}
+
+// codes maps errors to exit codes. The first match wins, so the more specific
+// errors of pkg/vgpu take precedence over the error of the failed command.
+var codes = []struct {
+	err  error
+	code int
+}{
+	{context.DeadlineExceeded, Timeout},
+	{vgpu.ErrPermissionDenied, PermissionDenied},
+	{os.ErrPermission, PermissionDenied},
+	{vgpu.ErrDeviceBusy, DeviceBusy},
+	{vgpu.ErrGPUNotFound, GPUNotFound},
+	{vgpu.ErrTypeUnsupported, TypeUnsupported},
+	{vgpu.ErrInsufficientCapacity, LayoutInfeasible},
+	{ErrConfigInvalid, ConfigInvalid},
+	{ErrUnknownConfig, UnknownConfig},
+	{ErrNotApplied, NotApplied},
+	{ErrApplyFailed, ApplyFailed},
+}
+
+// FromError returns the exit code for the error of a command
+func FromError(err error) int {
+	if err == nil {
+		return Success
+	}
+	var gpuErrors GPUErrors
+	if errors.As(err, &gpuErrors) && gpuErrors.NumGPUs() > 1 && !errors.Is(err, context.DeadlineExceeded) {
+		return ApplyFailed
+	}
+	for _, c := range codes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return Failure
+}
+
+// Err returns the error an exit code stands for, or nil if it stands for no specific
+// error. It lets callers of xgv-vgpu-dm match its failures with errors.Is.
+func Err(code int) error {
+	for _, c := range codes {
+		if c.code == code {
+			return c.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package exitcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+// testGPUErrors collects the errors of several GPUs, like the GPUErrors of 'apply'
+type testGPUErrors []error
+
+func (e testGPUErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e testGPUErrors) Unwrap() []error {
+	return e
+}
+
+func (e testGPUErrors) NumGPUs() int {
+	return len(e)
+}
+
+// applyFailed wraps the errors of the failed GPUs the way 'apply' does
+func applyFailed(errs ...error) error {
+	return fmt.Errorf("%w: %w", ErrApplyFailed, testGPUErrors(errs))
+}
+
+func TestFromError(t *testing.T) {
+	busy := fmt.Errorf("GPU 0: %w", vgpu.ErrDeviceBusy)
+	denied := fmt.Errorf("GPU 1: %w", vgpu.ErrPermissionDenied)
+	timeout := fmt.Errorf("GPU 2: %w", context.DeadlineExceeded)
+
+	testCases := []struct {
+		description string
+		err         error
+		expected    int
+	}{
+		{
+			description: "no error",
+			err:         nil,
+			expected:    Success,
+		},
+		{
+			description: "unknown error",
+			err:         errors.New("unknown"),
+			expected:    Failure,
+		},
+		{
+			description: "specific error of pkg/vgpu",
+			err:         fmt.Errorf("%w: %w", ErrApplyFailed, busy),
+			expected:    DeviceBusy,
+		},
+		{
+			description: "single failed GPU",
+			err:         applyFailed(busy),
+			expected:    DeviceBusy,
+		},
+		{
+			description: "several failed GPUs",
+			err:         applyFailed(busy, denied),
+			expected:    ApplyFailed,
+		},
+		{
+			description: "several failed GPUs with the same error",
+			err:         applyFailed(busy, fmt.Errorf("GPU 3: %w", vgpu.ErrDeviceBusy)),
+			expected:    ApplyFailed,
+		},
+		{
+			description: "several failed GPUs wrapped again",
+			err:         fmt.Errorf("xgv-vgpu-dm failed: %w", applyFailed(busy, denied)),
+			expected:    ApplyFailed,
+		},
+		{
+			description: "several GPUs timed out",
+			err:         applyFailed(busy, timeout),
+			expected:    Timeout,
+		},
+		{
+			description: "config error",
+			err:         fmt.Errorf("%w: %w", ErrConfigInvalid, errors.New("invalid count")),
+			expected:    ConfigInvalid,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			if code := FromError(tc.err); code != tc.expected {
+				t.Errorf("expected exit code %d, got %d", tc.expected, code)
+			}
+		})
+	}
+}
+
+func TestErr(t *testing.T) {
+	for _, code := range []int{ConfigInvalid, DeviceBusy, ApplyFailed, Timeout} {
+		if c := FromError(Err(code)); c != code {
+			t.Errorf("expected exit code %d for the error of exit code %d, got %d", code, code, c)
+		}
+	}
+	if err := Err(Failure); err != nil {
+		t.Errorf("expected no error for exit code %d, got %v", Failure, err)
+	}
+}
@@ -0,0 +1,166 @@
+package kubevirt
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	Group    = "kubevirt.io"
+	Version  = "v1"
+	Resource = "kubevirts"
+
+	// DefaultResourcePrefix is the prefix of the resource names vGPU types are exposed as
+	DefaultResourcePrefix = "xdxct.com"
+)
+
+// MediatedDevice is an entry of 'permittedHostDevices.mediatedDevices' of the KubeVirt CR
+type MediatedDevice struct {
+	MDEVNameSelector         string `json:"mdevNameSelector" yaml:"mdevNameSelector"`
+	ResourceName             string `json:"resourceName" yaml:"resourceName"`
+	ExternalResourceProvider bool   `json:"externalResourceProvider,omitempty" yaml:"externalResourceProvider,omitempty"`
+}
+
+// PermittedHostDevices holds the mediated devices KubeVirt allows VMs to request
+type PermittedHostDevices struct {
+	MediatedDevices []MediatedDevice `json:"mediatedDevices" yaml:"mediatedDevices"`
+}
+
+// KubeVirt is the part of the KubeVirt CR the vGPU device manager reads and patches
+type KubeVirt struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec struct {
+		Configuration struct {
+			PermittedHostDevices *PermittedHostDevices `json:"permittedHostDevices,omitempty"`
+		} `json:"configuration"`
+	} `json:"spec"`
+}
+
+// KubeVirtList is a list of KubeVirt CRs
+type KubeVirtList struct {
+	Items []KubeVirt `json:"items"`
+}
+
+// ParseKubeVirt parses a KubeVirt CR, or a list of them as printed by 'kubectl get
+// kubevirt', in JSON or YAML. A list must hold exactly one CR, there is one per cluster.
+func ParseKubeVirt(data []byte) (*KubeVirt, error) {
+	var object struct {
+		KubeVirt
+		Kind  string     `json:"kind"`
+		Items []KubeVirt `json:"items"`
+	}
+	if err := yaml.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("unable to decode KubeVirt: %v", err)
+	}
+	if object.Kind != "List" && object.Kind != "KubeVirtList" {
+		return &object.KubeVirt, nil
+	}
+	if len(object.Items) != 1 {
+		return nil, fmt.Errorf("expected a list of one KubeVirt, got %d", len(object.Items))
+	}
+	return &object.Items[0], nil
+}
+
+// GetMediatedDevices returns the mediated devices permitted by the KubeVirt CR
+func (k *KubeVirt) GetMediatedDevices() []MediatedDevice {
+	if k.Spec.Configuration.PermittedHostDevices == nil {
+		return nil
+	}
+	return k.Spec.Configuration.PermittedHostDevices.MediatedDevices
+}
+
+// ResourceName returns the name of the resource an mdev type is exposed as
+func ResourceName(prefix string, mdevType string) string {
+	return prefix + "/" + mdevType
+}
+
+// ResourceMDEVType returns the mdev type a resource name with the prefix is exposed for.
+// It fails for resource names without the prefix, which are not owned by the vGPU device manager.
+func ResourceMDEVType(prefix string, resourceName string) (string, bool) {
+	mdevType, found := strings.CutPrefix(resourceName, prefix+"/")
+	return mdevType, found && mdevType != ""
+}
+
+// NewMediatedDevices returns the entries permitting the mdev types, sorted by mdev type.
+// 'names' maps every mdev type to its 'name' attribute in sysfs, which KubeVirt matches
+// against 'mdevNameSelector'. The resources are provided by the XDXCT KubeVirt device
+// plugin, so the entries set 'externalResourceProvider'.
+func NewMediatedDevices(mdevTypes []string, names map[string]string, prefix string) ([]MediatedDevice, error) {
+	sorted := append([]string{}, mdevTypes...)
+	sort.Strings(sorted)
+
+	var devices []MediatedDevice
+	for i, mdevType := range sorted {
+		if i > 0 && sorted[i-1] == mdevType {
+			continue
+		}
+		name, exists := names[mdevType]
+		if !exists {
+			return nil, fmt.Errorf("mdev type %s is not supported by any GPU", mdevType)
+		}
+		devices = append(devices, MediatedDevice{
+			MDEVNameSelector:         name,
+			ResourceName:             ResourceName(prefix, mdevType),
+			ExternalResourceProvider: true,
+		})
+	}
+	return devices, nil
+}
+
+// MergeMediatedDevices replaces the entries owned by the vGPU device manager, those with
+// a resource name with the prefix, by the devices, which removes the owned entries of
+// mdev types no longer permitted. Other entries are never changed or removed, since they
+// may have been added by hand, and devices selecting the same mdev name are skipped.
+func MergeMediatedDevices(existing []MediatedDevice, devices []MediatedDevice, prefix string) ([]MediatedDevice, bool) {
+	merged := []MediatedDevice{}
+	selected := make(map[string]bool)
+	for _, device := range existing {
+		if _, owned := ResourceMDEVType(prefix, device.ResourceName); owned {
+			continue
+		}
+		selected[device.MDEVNameSelector] = true
+		merged = append(merged, device)
+	}
+
+	for _, device := range devices {
+		if selected[device.MDEVNameSelector] {
+			continue
+		}
+		selected[device.MDEVNameSelector] = true
+		merged = append(merged, device)
+	}
+	return merged, !slices.Equal(merged, existing)
+}
+
+// NewMergePatch returns a JSON merge patch setting the permitted mediated devices of
+// the KubeVirt CR. A non-empty 'resourceVersion' makes the patch fail on conflicts.
+func NewMergePatch(devices []MediatedDevice, resourceVersion string) ([]byte, error) {
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"configuration": map[string]interface{}{
+				"permittedHostDevices": map[string]interface{}{
+					"mediatedDevices": devices,
+				},
+			},
+		},
+	}
+	if resourceVersion != "" {
+		patch["metadata"] = map[string]interface{}{
+			"resourceVersion": resourceVersion,
+		}
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode patch: %v", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,96 @@
+package kubevirt
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	type1G = "XGV_V0_1G_1_CORE"
+	type2G = "XGV_V0_2G_1_CORE"
+)
+
+var (
+	device1G = MediatedDevice{MDEVNameSelector: "XGV 1G", ResourceName: "xdxct.com/" + type1G, ExternalResourceProvider: true}
+	device2G = MediatedDevice{MDEVNameSelector: "XGV 2G", ResourceName: "xdxct.com/" + type2G, ExternalResourceProvider: true}
+	otherGPU = MediatedDevice{MDEVNameSelector: "GRID T4-1Q", ResourceName: "nvidia.com/GRID_T4-1Q"}
+)
+
+func TestNewMediatedDevices(t *testing.T) {
+	names := map[string]string{type1G: "XGV 1G", type2G: "XGV 2G"}
+
+	devices, err := NewMediatedDevices([]string{type2G, type1G, type2G}, names, DefaultResourcePrefix)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []MediatedDevice{device1G, device2G}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Errorf("expected %v, got %v", expected, devices)
+	}
+
+	if _, err := NewMediatedDevices([]string{"XGV_V0_8G_1_CORE"}, names, DefaultResourcePrefix); err == nil {
+		t.Errorf("expected error for unsupported mdev type, got nil")
+	}
+}
+
+func TestMergeMediatedDevices(t *testing.T) {
+	testCases := []struct {
+		description string
+		existing    []MediatedDevice
+		devices     []MediatedDevice
+		expected    []MediatedDevice
+		changed     bool
+	}{
+		{
+			description: "adds the devices",
+			existing:    []MediatedDevice{otherGPU},
+			devices:     []MediatedDevice{device1G},
+			expected:    []MediatedDevice{otherGPU, device1G},
+			changed:     true,
+		},
+		{
+			description: "unchanged",
+			existing:    []MediatedDevice{otherGPU, device1G},
+			devices:     []MediatedDevice{device1G},
+			expected:    []MediatedDevice{otherGPU, device1G},
+		},
+		{
+			description: "removes stale entries with the prefix",
+			existing:    []MediatedDevice{device1G, otherGPU, device2G},
+			devices:     []MediatedDevice{device2G},
+			expected:    []MediatedDevice{otherGPU, device2G},
+			changed:     true,
+		},
+		{
+			description: "sets externalResourceProvider on entries with the prefix",
+			existing:    []MediatedDevice{{MDEVNameSelector: "XGV 1G", ResourceName: "xdxct.com/" + type1G}},
+			devices:     []MediatedDevice{device1G},
+			expected:    []MediatedDevice{device1G},
+			changed:     true,
+		},
+		{
+			description: "keeps entries without the prefix selecting the same mdev name",
+			existing:    []MediatedDevice{{MDEVNameSelector: "XGV 1G", ResourceName: "example.com/xgv-1g"}},
+			devices:     []MediatedDevice{device1G},
+			expected:    []MediatedDevice{{MDEVNameSelector: "XGV 1G", ResourceName: "example.com/xgv-1g"}},
+		},
+		{
+			description: "no devices",
+			existing:    []MediatedDevice{device1G},
+			expected:    []MediatedDevice{},
+			changed:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			merged, changed := MergeMediatedDevices(tc.existing, tc.devices, DefaultResourcePrefix)
+			if !reflect.DeepEqual(merged, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, merged)
+			}
+			if changed != tc.changed {
+				t.Errorf("expected changed %v, got %v", tc.changed, changed)
+			}
+		})
+	}
+}
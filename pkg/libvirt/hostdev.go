@@ -0,0 +1,115 @@
+package libvirt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+var hostdevTemplate = template.Must(template.New("hostdev").Parse(`<!-- {{ .Type }} on {{ .ParentAddress }} -->
+<hostdev mode='subsystem' type='mdev' model='vfio-pci'>
+  <source>
+    <address uuid='{{ .UUID }}'/>
+  </source>
+</hostdev>
+`))
+
+// Assignments maps the name of a VM (libvirt domain) to the UUIDs of its vGPU devices
+type Assignments map[string][]string
+
+// ReadAssignments reads the assignments of vGPU devices to VMs from a YAML file
+func ReadAssignments(path string) (Assignments, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read error: %v", err)
+	}
+	var assignments Assignments
+	if err := yaml.Unmarshal(data, &assignments); err != nil {
+		return nil, fmt.Errorf("unmarshal error: %v", err)
+	}
+	return assignments, nil
+}
+
+// group returns the devices assigned to every VM, sorted by VM name, and the unassigned devices
+func (a Assignments) group(devices []types.VGPUDevice) ([]string, map[string][]types.VGPUDevice, []types.VGPUDevice, error) {
+	byUUID := make(map[string]types.VGPUDevice)
+	for _, device := range devices {
+		byUUID[strings.ToLower(device.UUID)] = device
+	}
+
+	var vms []string
+	assigned := make(map[string]string)
+	groups := make(map[string][]types.VGPUDevice)
+	for vm, uuids := range a {
+		if strings.Contains(vm, "--") {
+			return nil, nil, nil, fmt.Errorf("invalid VM name %q: must not contain '--'", vm)
+		}
+		vms = append(vms, vm)
+		for _, uuid := range uuids {
+			uuid = strings.ToLower(uuid)
+			device, exists := byUUID[uuid]
+			if !exists {
+				return nil, nil, nil, fmt.Errorf("vGPU device %s assigned to %s does not exist", uuid, vm)
+			}
+			if other, exists := assigned[uuid]; exists {
+				return nil, nil, nil, fmt.Errorf("vGPU device %s is assigned to both %s and %s", uuid, other, vm)
+			}
+			assigned[uuid] = vm
+			groups[vm] = append(groups[vm], device)
+		}
+	}
+	sort.Strings(vms)
+
+	var unassigned []types.VGPUDevice
+	for _, device := range devices {
+		if _, exists := assigned[strings.ToLower(device.UUID)]; !exists {
+			unassigned = append(unassigned, device)
+		}
+	}
+	return vms, groups, unassigned, nil
+}
+
+// WriteHostdevs writes a libvirt <hostdev> element per vGPU device, to be attached to a
+// domain with 'virsh attach-device' or added to its <devices>. With assignments, the
+// elements are grouped by VM, followed by the devices not assigned to any VM.
+func WriteHostdevs(w io.Writer, devices []types.VGPUDevice, assignments Assignments) error {
+	if len(assignments) == 0 {
+		return writeHostdevs(w, devices)
+	}
+
+	vms, groups, unassigned, err := assignments.group(devices)
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if _, err := fmt.Fprintf(w, "<!-- VM: %s -->\n", vm); err != nil {
+			return err
+		}
+		if err := writeHostdevs(w, groups[vm]); err != nil {
+			return err
+		}
+	}
+	if len(unassigned) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintln(w, "<!-- unassigned -->"); err != nil {
+		return err
+	}
+	return writeHostdevs(w, unassigned)
+}
+
+func writeHostdevs(w io.Writer, devices []types.VGPUDevice) error {
+	for _, device := range devices {
+		if err := hostdevTemplate.Execute(w, device); err != nil {
+			return fmt.Errorf("unable to write hostdev of %s: %v", device.UUID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package libvirt
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+var testDevices = []types.VGPUDevice{
+	{UUID: "5b8e1e6a-5a1c-4d8b-9d3e-0c6f2a1b3c4d", Type: "XGV_V0_1G_1_CORE", ParentAddress: "0000:01:00.1"},
+	{UUID: "9f0c2d4e-1b3a-4c5d-8e7f-6a5b4c3d2e1f", Type: "XGV_V0_1G_1_CORE", ParentAddress: "0000:01:00.2"},
+	{UUID: "0b1c2d3e-4f5a-4b6c-8d7e-9f0a1b2c3d4e", Type: "XGV_V0_2G_1_CORE", ParentAddress: "0000:02:00.1"},
+}
+
+// checkGolden compares 'actual' with the golden file 'name' in testdata, or updates it with -update
+func checkGolden(t *testing.T, name string, actual []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, actual, 0644); err != nil {
+			t.Fatalf("unexpected error updating %s: %v", path, err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading %s: %v", path, err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expected output of %s:\n%s\ngot:\n%s", path, expected, actual)
+	}
+}
+
+func TestWriteHostdevs(t *testing.T) {
+	testCases := []struct {
+		description string
+		assignments Assignments
+		golden      string
+	}{
+		{
+			description: "no assignments",
+			golden:      "hostdevs.golden",
+		},
+		{
+			description: "assignments",
+			assignments: Assignments{
+				"vm-b": {"0B1C2D3E-4F5A-4B6C-8D7E-9F0A1B2C3D4E"},
+				"vm-a": {"9f0c2d4e-1b3a-4c5d-8e7f-6a5b4c3d2e1f"},
+			},
+			golden: "hostdevs-assigned.golden",
+		},
+		{
+			description: "all devices assigned",
+			assignments: Assignments{
+				"vm-a": {"5b8e1e6a-5a1c-4d8b-9d3e-0c6f2a1b3c4d", "9f0c2d4e-1b3a-4c5d-8e7f-6a5b4c3d2e1f", "0b1c2d3e-4f5a-4b6c-8d7e-9f0a1b2c3d4e"},
+			},
+			golden: "hostdevs-all-assigned.golden",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteHostdevs(&buf, testDevices, tc.assignments); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			checkGolden(t, tc.golden, buf.Bytes())
+		})
+	}
+}
+
+func TestWriteHostdevsInvalidAssignments(t *testing.T) {
+	testCases := []struct {
+		description string
+		assignments Assignments
+	}{
+		{
+			description: "unknown vGPU device",
+			assignments: Assignments{"vm-a": {"7c6b5a49-3827-4165-9a0b-1c2d3e4f5a6b"}},
+		},
+		{
+			description: "vGPU device assigned twice",
+			assignments: Assignments{
+				"vm-a": {"5b8e1e6a-5a1c-4d8b-9d3e-0c6f2a1b3c4d"},
+				"vm-b": {"5b8e1e6a-5a1c-4d8b-9d3e-0c6f2a1b3c4d"},
+			},
+		},
+		{
+			description: "VM name breaking the XML comment",
+			assignments: Assignments{"vm--a": {"5b8e1e6a-5a1c-4d8b-9d3e-0c6f2a1b3c4d"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteHostdevs(&buf, testDevices, tc.assignments); err == nil {
+				t.Errorf("expected error, got output:\n%s", buf.String())
+			}
+		})
+	}
+}
+
+func TestReadAssignments(t *testing.T) {
+	assignments, err := ReadAssignments(filepath.Join("testdata", "assignments.yaml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := Assignments{
+		"vm-a": {"5b8e1e6a-5a1c-4d8b-9d3e-0c6f2a1b3c4d", "9f0c2d4e-1b3a-4c5d-8e7f-6a5b4c3d2e1f"},
+		"vm-b": {"0b1c2d3e-4f5a-4b6c-8d7e-9f0a1b2c3d4e"},
+	}
+	if len(assignments) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, assignments)
+	}
+	for vm, uuids := range expected {
+		if len(assignments[vm]) != len(uuids) {
+			t.Errorf("expected %v, got %v", expected, assignments)
+			continue
+		}
+		for i := range uuids {
+			if assignments[vm][i] != uuids[i] {
+				t.Errorf("expected %v, got %v", expected, assignments)
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package mdevctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultDir is where mdevctl stores the definitions of persistent mdevs
+	DefaultDir = "/etc/mdevctl.d"
+
+	// StartAuto makes mdevctl create the mdev when its parent device appears, e.g. on boot
+	StartAuto = "auto"
+)
+
+// Definition is the definition of a persistent mdev by mdevctl, stored as JSON in
+// '<dir>/<parent address>/<uuid>'
+type Definition struct {
+	MDEVType string        `json:"mdev_type"`
+	Start    string        `json:"start"`
+	Attrs    []interface{} `json:"attrs"`
+}
+
+// Device is an mdev defined by mdevctl
+type Device struct {
+	UUID          string
+	ParentAddress string
+	Definition
+}
+
+// ReadDefinitions reads the definitions of all mdevs in 'dir', ordered by parent address and UUID.
+// Files not named by a UUID are skipped.
+func ReadDefinitions(dir string) ([]Device, error) {
+	parentDirs, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read mdevctl directory: %v", err)
+	}
+	var devices []Device
+	for _, parentDir := range parentDirs {
+		if !parentDir.IsDir() {
+			continue
+		}
+		parentDevices, err := readParentDefinitions(dir, parentDir.Name())
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, parentDevices...)
+	}
+	return devices, nil
+}
+
+// readParentDefinitions reads the definitions of the mdevs of a parent device
+func readParentDefinitions(dir string, address string) ([]Device, error) {
+	files, err := os.ReadDir(filepath.Join(dir, address))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read mdevctl definitions of %s: %v", address, err)
+	}
+	var devices []Device
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if _, err := uuid.Parse(file.Name()); err != nil {
+			continue
+		}
+		path := filepath.Join(dir, address, file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read error: %v", err)
+		}
+		device := Device{
+			UUID:          file.Name(),
+			ParentAddress: address,
+		}
+		if err := json.Unmarshal(data, &device.Definition); err != nil {
+			return nil, fmt.Errorf("unable to decode mdevctl definition %s: %v", path, err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// WriteDefinitions writes the definitions of the devices to 'dir'. Definitions of other
+// mdevs of the parent devices in 'parents' are removed, so that mdevctl recreates exactly
+// these devices.
+func WriteDefinitions(dir string, devices []Device, parents []string) error {
+	defined := make(map[string]bool)
+	for _, device := range devices {
+		defined[filepath.Join(device.ParentAddress, device.UUID)] = true
+	}
+
+	sort.Strings(parents)
+	for _, parent := range parents {
+		existing, err := readParentDefinitions(dir, parent)
+		if err != nil {
+			return err
+		}
+		for _, device := range existing {
+			if defined[filepath.Join(device.ParentAddress, device.UUID)] {
+				continue
+			}
+			err := os.Remove(filepath.Join(dir, device.ParentAddress, device.UUID))
+			if err != nil {
+				return fmt.Errorf("unable to remove mdevctl definition of %s: %v", device.UUID, err)
+			}
+		}
+	}
+
+	for _, device := range devices {
+		definition := device.Definition
+		if definition.Attrs == nil {
+			definition.Attrs = []interface{}{}
+		}
+		data, err := json.MarshalIndent(definition, "", "  ")
+		if err != nil {
+			return fmt.Errorf("unable to encode mdevctl definition of %s: %v", device.UUID, err)
+		}
+		err = os.MkdirAll(filepath.Join(dir, device.ParentAddress), 0755)
+		if err != nil {
+			return fmt.Errorf("unable to create mdevctl directory: %v", err)
+		}
+		err = os.WriteFile(filepath.Join(dir, device.ParentAddress, device.UUID), append(data, '\n'), 0644)
+		if err != nil {
+			return fmt.Errorf("unable to write mdevctl definition of %s: %v", device.UUID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package mdevctl
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+const (
+	uuid0 = "0b1c2d3e-4f5a-4b6c-8d7e-9f0a1b2c3d4e"
+	uuid1 = "5b8e1e6a-5a1c-4d8b-9d3e-0c6f2a1b3c4d"
+	uuid2 = "9f0c2d4e-1b3a-4c5d-8e7f-6a5b4c3d2e1f"
+
+	parent0 = "0000:01:00.1"
+	parent1 = "0000:02:00.1"
+)
+
+// testDevices are ordered by parent address and UUID, as read by ReadDefinitions
+var testDevices = []Device{
+	{
+		UUID:          uuid1,
+		ParentAddress: parent0,
+		Definition:    Definition{MDEVType: "XGV_V0_1G_1_CORE", Start: StartAuto, Attrs: []interface{}{}},
+	},
+	{
+		UUID:          uuid2,
+		ParentAddress: parent0,
+		Definition:    Definition{MDEVType: "XGV_V0_1G_1_CORE", Start: StartAuto, Attrs: []interface{}{}},
+	},
+	{
+		UUID:          uuid0,
+		ParentAddress: parent1,
+		Definition: Definition{
+			MDEVType: "XGV_V0_2G_1_CORE",
+			Start:    "manual",
+			Attrs:    []interface{}{map[string]interface{}{"sriov_numvfs": "2"}},
+		},
+	},
+}
+
+// checkGolden compares 'actual' with the golden file 'name' in testdata, or updates it with -update
+func checkGolden(t *testing.T, name string, actual []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, actual, 0644); err != nil {
+			t.Fatalf("unexpected error updating %s: %v", path, err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading %s: %v", path, err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expected output of %s:\n%s\ngot:\n%s", path, expected, actual)
+	}
+}
+
+// writeFile writes a file below 'dir', creating its directory
+func writeFile(t *testing.T, dir string, name string, data string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWriteDefinitions(t *testing.T) {
+	dir := t.TempDir()
+	if err := WriteDefinitions(dir, testDevices, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	golden := map[string]string{
+		filepath.Join(parent0, uuid1): "definition.golden",
+		filepath.Join(parent1, uuid0): "definition-attrs.golden",
+	}
+	for file, name := range golden {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %v", file, err)
+		}
+		checkGolden(t, name, data)
+	}
+}
+
+func TestDefinitionsRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	// Definitions without attrs are written with an empty list, as mdevctl does
+	devices := append([]Device{}, testDevices...)
+	devices[0].Attrs = nil
+	if err := WriteDefinitions(dir, devices, []string{parent0, parent1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	read, err := ReadDefinitions(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(read, testDevices) {
+		t.Errorf("expected %v, got %v", testDevices, read)
+	}
+
+	// Writing what was read changes nothing
+	if err := WriteDefinitions(dir, read, []string{parent0, parent1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reread, err := ReadDefinitions(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(reread, read) {
+		t.Errorf("expected %v, got %v", read, reread)
+	}
+}
+
+func TestReadDefinitions(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, filepath.Join(parent0, uuid2), `{"mdev_type": "XGV_V0_1G_1_CORE", "start": "auto", "attrs": []}`)
+	writeFile(t, dir, filepath.Join(parent0, uuid1), `{"mdev_type": "XGV_V0_1G_1_CORE", "start": "auto", "attrs": []}`)
+	writeFile(t, dir, filepath.Join(parent1, uuid0), `{"mdev_type": "XGV_V0_2G_1_CORE", "start": "manual", "attrs": [{"sriov_numvfs": "2"}]}`)
+	// Files not named by a UUID and files outside of parent directories are skipped
+	writeFile(t, dir, filepath.Join(parent0, "README"), "not a definition")
+	writeFile(t, dir, filepath.Join(parent0, uuid0+".bak"), "not a definition")
+	writeFile(t, dir, uuid0, "not a definition")
+
+	devices, err := ReadDefinitions(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(devices, testDevices) {
+		t.Errorf("expected %v, got %v", testDevices, devices)
+	}
+
+	writeFile(t, dir, filepath.Join(parent1, uuid1), "{")
+	if _, err := ReadDefinitions(dir); err == nil {
+		t.Errorf("expected error for invalid definition, got nil")
+	}
+
+	if _, err := ReadDefinitions(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected error for missing directory, got nil")
+	}
+}
+
+func TestWriteDefinitionsRemovesStale(t *testing.T) {
+	const stale = "7c6b5a49-3827-4165-9a0b-1c2d3e4f5a6b"
+	dir := t.TempDir()
+	writeFile(t, dir, filepath.Join(parent0, stale), `{"mdev_type": "XGV_V0_1G_1_CORE", "start": "auto", "attrs": []}`)
+	writeFile(t, dir, filepath.Join(parent1, stale), `{"mdev_type": "XGV_V0_2G_1_CORE", "start": "auto", "attrs": []}`)
+
+	// Only the definitions of the given parents are replaced
+	if err := WriteDefinitions(dir, testDevices[:2], []string{parent0}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	devices, err := ReadDefinitions(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var files []string
+	for _, device := range devices {
+		files = append(files, filepath.Join(device.ParentAddress, device.UUID))
+	}
+	expected := []string{
+		filepath.Join(parent0, uuid1),
+		filepath.Join(parent0, uuid2),
+		filepath.Join(parent1, stale),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected definitions %v, got %v", expected, files)
+	}
+}
@@ -1,7 +1,26 @@
 package types
 
+import (
+	"fmt"
+	"strconv"
+)
+
 type DeviceID uint32
 
 func NewDeviceID(device, vendor uint16) DeviceID {
 	return DeviceID(uint32(device)<<16 | uint32(vendor))
 }
+
+// NewDeviceIDFromString parses a device ID written as its device ID followed by its
+// vendor ID, e.g. "0x00011eed" for device 0x0001 of vendor 0x1eed
+func NewDeviceIDFromString(str string) (DeviceID, error) {
+	id, err := strconv.ParseUint(str, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse device ID %q: %v", str, err)
+	}
+	return DeviceID(id), nil
+}
+
+func (d DeviceID) String() string {
+	return fmt.Sprintf("0x%08x", uint32(d))
+}
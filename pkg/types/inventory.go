@@ -0,0 +1,82 @@
+package types
+
+import "strings"
+
+// VGPUDevice describes a single mdev (vGPU) device created on a parent GPU
+type VGPUDevice struct {
+	UUID          string `json:"uuid" yaml:"uuid"`
+	Type          string `json:"type" yaml:"type"`
+	ParentAddress string `json:"parent" yaml:"parent"`
+}
+
+// MDEVTypeInventory describes an mdev type supported by a GPU
+type MDEVTypeInventory struct {
+	Name               string `json:"name" yaml:"name"`
+	AvailableInstances int    `json:"availableInstances" yaml:"availableInstances"`
+}
+
+// GPUInventory describes a GPU, the mdev types it supports and the vGPU devices created on it
+type GPUInventory struct {
+	Index       int                 `json:"index" yaml:"index"`
+	Address     string              `json:"address" yaml:"address"`
+	Vendor      string              `json:"vendor" yaml:"vendor"`
+	Device      string              `json:"device" yaml:"device"`
+	MDEVTypes   []MDEVTypeInventory `json:"mdevTypes" yaml:"mdevTypes"`
+	VGPUDevices []VGPUDevice        `json:"vgpuDevices" yaml:"vgpuDevices"`
+}
+
+// DeviceID returns the device ID of the GPU, made of its device and vendor IDs
+func (g *GPUInventory) DeviceID() (DeviceID, error) {
+	return NewDeviceIDFromString(g.Device + strings.TrimPrefix(g.Vendor, "0x"))
+}
+
+// IsMDEVTypeSupported checks if the GPU supports the 'mdevType'
+func (g *GPUInventory) IsMDEVTypeSupported(mdevType string) bool {
+	for _, t := range g.MDEVTypes {
+		if t.Name == mdevType {
+			return true
+		}
+	}
+	return false
+}
+
+// GetMaxInstances returns the number of instances of 'mdevType' that fit on the GPU
+// without any other vGPU devices. It is only known if the GPU has no vGPU devices of
+// other types, 'known' is false otherwise.
+func (g *GPUInventory) GetMaxInstances(mdevType string) (max int, known bool) {
+	for _, device := range g.VGPUDevices {
+		if device.Type != mdevType {
+			return 0, false
+		}
+		max++
+	}
+	for _, t := range g.MDEVTypes {
+		if t.Name == mdevType {
+			max += t.AvailableInstances
+		}
+	}
+	return max, true
+}
+
+// SupportsVGPUConfig checks if the 'VGPUConfig' can be created on the GPU.
+// The number of instances is only checked when no vGPU devices exist on the
+// GPU, since the available instances shrink as devices are created.
+func (g *GPUInventory) SupportsVGPUConfig(config VGPUConfig) bool {
+	for mdevType, count := range config {
+		if count <= 0 {
+			continue
+		}
+		if !g.IsMDEVTypeSupported(mdevType) {
+			return false
+		}
+	}
+	if len(g.VGPUDevices) > 0 {
+		return true
+	}
+	for _, t := range g.MDEVTypes {
+		if config[t.Name] > t.AvailableInstances {
+			return false
+		}
+	}
+	return true
+}
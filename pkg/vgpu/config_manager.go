@@ -1,44 +1,157 @@
 package vgpu
 
 import (
+	"context"
 	"fmt"
 
-	"github.com/chen-mao/go-xdxlib/pkg/xdxmdev"
+	"github.com/chen-mao/go-xdxlib/pkg/xdxpci"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/logging"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/tracing"
 	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/audit"
 	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
-	"github.com/google/uuid"
 )
 
 type Manager interface {
 	GetVGPUConfig(gpu int) (types.VGPUConfig, error)
 	SetVGPUConfig(gpu int, config types.VGPUConfig) error
 	ClearVGPUConfig(gpu int) error
+	GetVGPUDevices(gpu int) ([]types.VGPUDevice, error)
+	SetVGPUDevices(gpu int, devices []types.VGPUDevice) error
+
+	// The Context variants return an error wrapping ctx.Err() once 'ctx' is done. As
+	// sysfs writes cannot be interrupted, this is checked before every creation and
+	// deletion of a vGPU device, which may leave a GPU with only part of its devices.
+	GetVGPUConfigContext(ctx context.Context, gpu int) (types.VGPUConfig, error)
+	SetVGPUConfigContext(ctx context.Context, gpu int, config types.VGPUConfig) error
+	ClearVGPUConfigContext(ctx context.Context, gpu int) error
+	GetVGPUDevicesContext(ctx context.Context, gpu int) ([]types.VGPUDevice, error)
+	SetVGPUDevicesContext(ctx context.Context, gpu int, devices []types.VGPUDevice) error
 }
 
 type xdxlibVGPUConfigManager struct {
-	xdxlib xdxlib.Interface
+	xdxlib        xdxlib.Interface
+	uuidGenerator UUIDGenerator
+	placement     PlacementStrategy
+	auditor       *audit.Auditor
+}
+
+// Option defines a function for passing options to the NewXdxlibVGPUConfigManager() call
+type Option func(*xdxlibVGPUConfigManager)
+
+// WithUUIDGenerator sets the generator of the UUIDs of created vGPU devices, random by default
+func WithUUIDGenerator(generator UUIDGenerator) Option {
+	return func(cm *xdxlibVGPUConfigManager) {
+		cm.uuidGenerator = generator
+	}
+}
+
+// WithXdxlib sets the xdxlib used to access the GPUs, e.g. one backed by a fake sysfs
+func WithXdxlib(lib xdxlib.Interface) Option {
+	return func(cm *xdxlibVGPUConfigManager) {
+		cm.xdxlib = lib
+	}
+}
+
+// WithPlacementStrategy sets how vGPU devices are distributed over the parent devices
+// of a GPU, e.g. its SR-IOV virtual functions, packing them by default
+func WithPlacementStrategy(strategy PlacementStrategy) Option {
+	return func(cm *xdxlibVGPUConfigManager) {
+		cm.placement = strategy
+	}
+}
+
+// WithAuditor sets the auditor recording every creation and deletion of a vGPU device
+func WithAuditor(auditor *audit.Auditor) Option {
+	return func(cm *xdxlibVGPUConfigManager) {
+		cm.auditor = auditor
+	}
+}
+
+func NewXdxlibVGPUConfigManager(opts ...Option) Manager {
+	return newXdxlibVGPUConfigManager(opts...)
+}
+
+func newXdxlibVGPUConfigManager(opts ...Option) *xdxlibVGPUConfigManager {
+	cm := &xdxlibVGPUConfigManager{}
+	for _, opt := range opts {
+		opt(cm)
+	}
+	if cm.xdxlib.Xdxpci == nil || cm.xdxlib.Xdxmdev == nil {
+		cm.xdxlib = xdxlib.New()
+	}
+	if cm.uuidGenerator == nil {
+		cm.uuidGenerator = NewRandomUUIDGenerator()
+	}
+	if cm.placement == "" {
+		cm.placement = PlacementPack
+	}
+	return cm
+}
+
+// startSpan starts the span of a call of a Manager method on a GPU at a particular index
+func startSpan(ctx context.Context, method string, gpu int) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "vgpu.Manager/"+method, attribute.Int("gpu", gpu))
+}
+
+// getGPU returns the GPU at a particular index, or an error wrapping ErrGPUNotFound
+func getGPU(lib xdxlib.Interface, gpu int) (*xdxpci.XDXCTPCIDevice, error) {
+	gpus, err := lib.Xdxpci.GetGPUs()
+	if err != nil {
+		return nil, fmt.Errorf("error getting all gpus: %w", err)
+	}
+	if gpu < 0 || gpu >= len(gpus) {
+		return nil, &Error{GPU: gpu, Err: ErrGPUNotFound}
+	}
+	return gpus[gpu], nil
 }
 
-func NewXdxlibVGPUConfigManager() Manager {
-	return &xdxlibVGPUConfigManager{
-		xdxlib.New(),
+// getParentAddresses returns the GPU at a particular index and the addresses of its parent devices
+func (cm *xdxlibVGPUConfigManager) getParentAddresses(gpu int) (*xdxpci.XDXCTPCIDevice, map[string]bool, []string, error) {
+	device, err := getGPU(cm.xdxlib, gpu)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	addresses, err := getParentAddresses(device)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	isParent := make(map[string]bool)
+	for _, address := range addresses {
+		isParent[address] = true
+	}
+	return device, isParent, addresses, nil
 }
 
 // GetVGPUConfig gets the 'VGPUConfig' currently applied to a GPU at a particular index
 func (cm *xdxlibVGPUConfigManager) GetVGPUConfig(gpu int) (types.VGPUConfig, error) {
-	parentGPUDevice, err := cm.xdxlib.Xdxpci.GetGPUByIndex(gpu)
+	return cm.GetVGPUConfigContext(context.Background(), gpu)
+}
+
+// GetVGPUConfigContext is GetVGPUConfig with a context
+func (cm *xdxlibVGPUConfigManager) GetVGPUConfigContext(ctx context.Context, gpu int) (_ types.VGPUConfig, err error) {
+	_, span := startSpan(ctx, "GetVGPUConfig", gpu)
+	defer func() { tracing.End(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	_, isParent, _, err := cm.getParentAddresses(gpu)
 	if err != nil {
-		return nil, fmt.Errorf("error getting device at index '%d': '%v'", gpu, err)
+		return nil, err
 	}
 
 	vGPUDevices, err := cm.xdxlib.Xdxmdev.GetAllMediatedDevices()
 	if err != nil {
-		return nil, fmt.Errorf("error getting all vgpu devices: '%v'", err)
+		return nil, fmt.Errorf("error getting all vgpu devices: %w", err)
 	}
 	vGpuConfigs := types.VGPUConfig{}
 	for _, vGPUDevice := range vGPUDevices {
-		if parentGPUDevice.Address == vGPUDevice.Parent.Address {
+		if isParent[vGPUDevice.Parent.Address] {
 			vGpuConfigs[vGPUDevice.MDEVType]++
 		}
 	}
@@ -47,94 +160,355 @@ func (cm *xdxlibVGPUConfigManager) GetVGPUConfig(gpu int) (types.VGPUConfig, err
 
 // SetVGPUConfig applies the selected `VGPUConfig` to a GPU at a particular index if it is not already applied
 func (cm *xdxlibVGPUConfigManager) SetVGPUConfig(gpu int, config types.VGPUConfig) error {
-	parentGPUDevice, err := cm.xdxlib.Xdxpci.GetGPUByIndex(gpu)
+	return cm.SetVGPUConfigContext(context.Background(), gpu, config)
+}
+
+// SetVGPUConfigContext is SetVGPUConfig with a context. The previous devices are
+// restored even if 'ctx' is done, so that an interrupted call does not leave the GPU
+// with only part of its devices.
+func (cm *xdxlibVGPUConfigManager) SetVGPUConfigContext(ctx context.Context, gpu int, config types.VGPUConfig) (err error) {
+	ctx, span := startSpan(ctx, "SetVGPUConfig", gpu)
+	defer func() { tracing.End(span, err) }()
+
+	parentGPUDevice, _, addresses, err := cm.getParentAddresses(gpu)
 	if err != nil {
-		return fmt.Errorf("error getting device ay index '%d','%v'", gpu, err)
+		return err
 	}
 	allDevicesInfo, err := cm.xdxlib.Xdxmdev.GetAllParentDevices()
 	if err != nil {
-		return fmt.Errorf("error getting all parent devices: %v", err)
+		return fmt.Errorf("error getting all parent devices: %w", err)
 	}
 
-	var currentDevices []*xdxmdev.ParentDevice
-	for _, p := range allDevicesInfo {
-		if p.Device == parentGPUDevice.Device {
-			currentDevices = append(currentDevices, p)
+	var currentDevices []*xdxlib.ParentDevice
+	for _, address := range addresses {
+		for _, p := range allDevicesInfo {
+			if p.Address == address {
+				currentDevices = append(currentDevices, p)
+			}
 		}
 	}
 
 	if len(currentDevices) == 0 {
-		return fmt.Errorf(" no parent devices found for GPU at index: %d", gpu)
+		// The GPU is not registered with the mdev bus, so it supports no vGPU type
+		return &Error{GPU: gpu, Address: parentGPUDevice.Address, Err: ErrTypeUnsupported}
 	}
 	for key := range config {
-		if !currentDevices[0].IsMDEVTypeSupported(key) {
-			return fmt.Errorf("vGPU type %s is not support on GPU (indev=%d, address=%s)", key, gpu, parentGPUDevice.Address)
+		supported := false
+		for _, p := range currentDevices {
+			supported = supported || p.IsMDEVTypeSupported(key)
+		}
+		if !supported {
+			return &Error{GPU: gpu, Address: parentGPUDevice.Address, MDEVType: key, Err: ErrTypeUnsupported}
 		}
 	}
 
-	err = cm.ClearVGPUConfig(gpu)
+	// Keep the current devices, so that they can be restored if the layout cannot be created
+	previous, err := cm.GetVGPUDevicesContext(ctx, gpu)
 	if err != nil {
-		return fmt.Errorf("error clearing VGPUConfig: %v", err)
+		return fmt.Errorf("error getting current vGPU devices: %w", err)
 	}
-	for key, value := range config {
-		remainingToCreate := value
-		for _, currentDevice := range currentDevices {
-			if remainingToCreate == 0 {
-				break
-			}
-			supported := currentDevice.IsMDEVTypeSupported(key)
-			if !supported {
-				return fmt.Errorf("error get available vGPU instances: %v", err)
-			}
 
-			available, err := currentDevice.GetAvailableMDEVInstances(key)
-			if err != nil {
-				return fmt.Errorf("unable to get available gpu instances: %v", err)
-			}
-			if available <= 0 {
-				continue
-			}
-			numToCreate := min(remainingToCreate, available)
-			for i := 0; i < remainingToCreate; i++ {
-				err = currentDevice.CreateMDEVDevice(key, uuid.New().String())
+	// Nothing is deleted unless the devices of 'config' fit once the current ones are gone
+	err = cm.checkFeasibility(gpu, parentGPUDevice.Address, currentDevices, config, previous)
+	if err != nil {
+		return err
+	}
+
+	err = cm.ClearVGPUConfigContext(ctx, gpu)
+	if err != nil {
+		return cm.restoreVGPUDevices(ctx, gpu, parentGPUDevice.Address, previous, fmt.Errorf("error clearing VGPUConfig: %w", err))
+	}
+
+	err = cm.createVGPUDevices(ctx, gpu, parentGPUDevice.Address, currentDevices, config)
+	if err != nil {
+		return cm.restoreVGPUDevices(ctx, gpu, parentGPUDevice.Address, previous, err)
+	}
+	return nil
+}
+
+// checkFeasibility checks that all vGPU devices of 'config' fit on the parent devices at the
+// same time, once the vGPU devices 'existing' on them are deleted. It fails if that cannot be
+// told from the available instances of the parent devices, as checking it by deleting the
+// existing devices would leave the GPU without them if they do not.
+func (cm *xdxlibVGPUConfigManager) checkFeasibility(gpu int, address string, parents []*xdxlib.ParentDevice, config types.VGPUConfig, existing []types.VGPUDevice) error {
+	models, bound, err := getReleasedCapacityModels(parents, config, existing)
+	if err != nil {
+		return err
+	}
+	if bound == capacityUnknown {
+		return &Error{
+			GPU:     gpu,
+			Address: address,
+			Err:     ErrInsufficientCapacity,
+			Cause:   fmt.Errorf("unable to tell if %v fits once the %d existing vGPU devices are deleted, as they have different types or use all capacity of a parent device: delete them first", config, len(existing)),
+		}
+	}
+	unplaced := planVGPUConfig(config, models, cm.placement)
+	if len(unplaced) > 0 && bound == capacityLowerBound {
+		return &Error{
+			GPU:     gpu,
+			Address: address,
+			Err:     ErrInsufficientCapacity,
+			Cause:   fmt.Errorf("%v might not fit once the %d existing vGPU devices are deleted: delete them first", unplaced, len(existing)),
+		}
+	}
+	if len(unplaced) > 0 {
+		return &LayoutInfeasibleError{
+			GPU:      gpu,
+			Address:  address,
+			Unplaced: unplaced,
+		}
+	}
+	return nil
+}
+
+// restoreVGPUDevices recreates the devices a GPU had before a failed SetVGPUConfig and
+// returns 'cause'. It ignores the cancellation of 'ctx', which may be why the call failed.
+func (cm *xdxlibVGPUConfigManager) restoreVGPUDevices(ctx context.Context, gpu int, address string, previous []types.VGPUDevice, cause error) error {
+	logger := logging.ForGPU(gpu, address)
+	logger.Warnf("Rolling back to the previous %d vGPU devices: %v", len(previous), cause)
+	err := cm.SetVGPUDevicesContext(context.WithoutCancel(ctx), gpu, previous)
+	if err != nil {
+		logger.Errorf("Unable to roll back to the previous vGPU devices: %v", err)
+		return fmt.Errorf("%w (restoring previous vGPU devices failed: %v)", cause, err)
+	}
+	logger.Infof("Rolled back to the previous vGPU devices")
+	return cause
+}
+
+// createVGPUDevices creates the vGPU devices of 'config' on the parent devices, types
+// using the largest share of a parent first. The available instances are read again
+// before every creation, as creating a device reduces those of all types on its parent.
+func (cm *xdxlibVGPUConfigManager) createVGPUDevices(ctx context.Context, gpu int, address string, currentDevices []*xdxlib.ParentDevice, config types.VGPUConfig) (err error) {
+	_, span := tracing.Start(ctx, "vgpu.createVGPUDevices", attribute.String("address", address))
+	defer func() { tracing.End(span, err) }()
+
+	models, err := getCapacityModels(currentDevices, config)
+	if err != nil {
+		return err
+	}
+	for _, key := range orderMDEVTypes(config, models) {
+		for ordinal := 0; ordinal < config[key]; ordinal++ {
+			available := make([]float64, len(currentDevices))
+			for i, currentDevice := range currentDevices {
+				if !currentDevice.IsMDEVTypeSupported(key) {
+					continue
+				}
+				instances, err := currentDevice.GetAvailableMDEVInstances(key)
 				if err != nil {
-					return fmt.Errorf("unable to create %s vGPU device on parent device %s: %v", key, currentDevice.Address, err)
+					return fmt.Errorf("unable to get available instances of %s on parent device %s: %w", key, currentDevice.Address, err)
 				}
+				available[i] = float64(instances)
 			}
-			remainingToCreate -= numToCreate
-		}
 
-		if remainingToCreate > 0 {
-			return fmt.Errorf("failed to create mdev vgpu deivce %s", key)
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("interrupted before creating %s vGPU device %d of %d: %w", key, ordinal+1, config[key], err)
+			}
+			i := selectParent(cm.placement, available)
+			if i == -1 {
+				return &Error{
+					GPU:      gpu,
+					Address:  address,
+					MDEVType: key,
+					Err:      ErrInsufficientCapacity,
+					Cause:    fmt.Errorf("failed to create vGPU device %d of %d: no instances available on any parent device", ordinal+1, config[key]),
+				}
+			}
+			uuid := cm.uuidGenerator.UUID(address, key, ordinal)
+			err = cm.createMDEVDevice(gpu, currentDevices[i], key, uuid)
+			if err != nil {
+				return newDeviceError(gpu, address, key, uuid, fmt.Errorf("unable to create %s vGPU device on parent device %s: %w", key, currentDevices[i].Address, err))
+			}
 		}
 	}
 	return nil
 }
 
+// ClearVGPUConfig deletes all vGPU devices of a GPU at a particular index
 func (cm *xdxlibVGPUConfigManager) ClearVGPUConfig(gpu int) error {
-	pciDeviceInfo, err := cm.xdxlib.Xdxpci.GetGPUByIndex(gpu)
+	return cm.ClearVGPUConfigContext(context.Background(), gpu)
+}
+
+// ClearVGPUConfigContext is ClearVGPUConfig with a context
+func (cm *xdxlibVGPUConfigManager) ClearVGPUConfigContext(ctx context.Context, gpu int) (err error) {
+	_, span := startSpan(ctx, "ClearVGPUConfig", gpu)
+	defer func() { tracing.End(span, err) }()
+
+	_, err = cm.deleteVGPUDevices(ctx, gpu, nil)
+	return err
+}
+
+// deleteVGPUDevices deletes the vGPU devices of a GPU at a particular index except
+// those in 'keep', and returns the devices it kept
+func (cm *xdxlibVGPUConfigManager) deleteVGPUDevices(ctx context.Context, gpu int, keep map[types.VGPUDevice]bool) (map[types.VGPUDevice]bool, error) {
+	device, isParent, _, err := cm.getParentAddresses(gpu)
 	if err != nil {
-		return fmt.Errorf("error getting device ay index '%d','%v'", gpu, err)
+		return nil, err
 	}
 	vGPUDevInfos, err := cm.xdxlib.Xdxmdev.GetAllMediatedDevices()
 	if err != nil {
-		return fmt.Errorf("error getting all vGPU devices: %v", err)
+		return nil, fmt.Errorf("error getting all vGPU devices: %w", err)
 	}
 
+	kept := make(map[types.VGPUDevice]bool)
 	for _, vgpuDevInfo := range vGPUDevInfos {
-		if pciDeviceInfo.Address == vgpuDevInfo.Parent.Address {
-			err := vgpuDevInfo.Delete()
-			if err != nil {
-				return fmt.Errorf("error deleting %s vgpu with id %s: %v", vgpuDevInfo.MDEVType, vgpuDevInfo.UUID, err)
+		if !isParent[vgpuDevInfo.Parent.Address] {
+			continue
+		}
+		key := types.VGPUDevice{
+			UUID:          vgpuDevInfo.UUID,
+			Type:          vgpuDevInfo.MDEVType,
+			ParentAddress: vgpuDevInfo.Parent.Address,
+		}
+		if keep[key] {
+			kept[key] = true
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("interrupted before deleting %s vgpu with id %s: %w", vgpuDevInfo.MDEVType, vgpuDevInfo.UUID, err)
+		}
+		err := cm.deleteMDEVDevice(gpu, vgpuDevInfo)
+		if err != nil {
+			return nil, newDeviceError(gpu, device.Address, vgpuDevInfo.MDEVType, vgpuDevInfo.UUID, fmt.Errorf("error deleting %s vgpu with id %s: %w", vgpuDevInfo.MDEVType, vgpuDevInfo.UUID, err))
+		}
+	}
+	return kept, nil
+}
+
+// GetVGPUDevices gets the vGPU devices, including their UUIDs, currently created on a GPU at a particular index
+func (cm *xdxlibVGPUConfigManager) GetVGPUDevices(gpu int) ([]types.VGPUDevice, error) {
+	return cm.GetVGPUDevicesContext(context.Background(), gpu)
+}
+
+// GetVGPUDevicesContext is GetVGPUDevices with a context
+func (cm *xdxlibVGPUConfigManager) GetVGPUDevicesContext(ctx context.Context, gpu int) (_ []types.VGPUDevice, err error) {
+	_, span := startSpan(ctx, "GetVGPUDevices", gpu)
+	defer func() { tracing.End(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	_, isParent, _, err := cm.getParentAddresses(gpu)
+	if err != nil {
+		return nil, err
+	}
+
+	vGPUDevices, err := cm.xdxlib.Xdxmdev.GetAllMediatedDevices()
+	if err != nil {
+		return nil, fmt.Errorf("error getting all vgpu devices: %w", err)
+	}
+	devices := []types.VGPUDevice{}
+	for _, vGPUDevice := range vGPUDevices {
+		if isParent[vGPUDevice.Parent.Address] {
+			devices = append(devices, types.VGPUDevice{
+				UUID:          vGPUDevice.UUID,
+				Type:          vGPUDevice.MDEVType,
+				ParentAddress: vGPUDevice.Parent.Address,
+			})
+		}
+	}
+	return devices, nil
+}
+
+// SetVGPUDevices replaces the vGPU devices of a GPU at a particular index with
+// exactly the given devices, reusing their UUIDs and parent devices. Devices that
+// already exist are kept, so that a GPU can be restored even if some of its
+// devices cannot be deleted.
+func (cm *xdxlibVGPUConfigManager) SetVGPUDevices(gpu int, devices []types.VGPUDevice) error {
+	return cm.SetVGPUDevicesContext(context.Background(), gpu, devices)
+}
+
+// SetVGPUDevicesContext is SetVGPUDevices with a context
+func (cm *xdxlibVGPUConfigManager) SetVGPUDevicesContext(ctx context.Context, gpu int, devices []types.VGPUDevice) (err error) {
+	ctx, span := startSpan(ctx, "SetVGPUDevices", gpu)
+	defer func() { tracing.End(span, err) }()
+
+	parentGPUDevice, err := getGPU(cm.xdxlib, gpu)
+	if err != nil {
+		return err
+	}
+	allDevicesInfo, err := cm.xdxlib.Xdxmdev.GetAllParentDevices()
+	if err != nil {
+		return fmt.Errorf("error getting all parent devices: %w", err)
+	}
+
+	parents := make([]*xdxlib.ParentDevice, len(devices))
+	keep := make(map[types.VGPUDevice]bool)
+	for i, device := range devices {
+		address := device.ParentAddress
+		if address == "" {
+			address = parentGPUDevice.Address
+		}
+		keep[types.VGPUDevice{UUID: device.UUID, Type: device.Type, ParentAddress: address}] = true
+		for _, p := range allDevicesInfo {
+			if p.Address == address {
+				parents[i] = p
+				break
 			}
 		}
+		if parents[i] == nil {
+			return fmt.Errorf("no parent device found at address %s for vGPU device %s", address, device.UUID)
+		}
+		if !parents[i].IsMDEVTypeSupported(device.Type) {
+			return &Error{
+				GPU:      gpu,
+				Address:  parentGPUDevice.Address,
+				MDEVType: device.Type,
+				UUID:     device.UUID,
+				Err:      ErrTypeUnsupported,
+				Cause:    fmt.Errorf("not supported on parent device %s", address),
+			}
+		}
+	}
+
+	kept, err := cm.deleteVGPUDevices(ctx, gpu, keep)
+	if err != nil {
+		return fmt.Errorf("error clearing VGPUConfig: %w", err)
+	}
+	for i, device := range devices {
+		if kept[types.VGPUDevice{UUID: device.UUID, Type: device.Type, ParentAddress: parents[i].Address}] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted before creating %s vGPU device %s: %w", device.Type, device.UUID, err)
+		}
+		err = cm.createMDEVDevice(gpu, parents[i], device.Type, device.UUID)
+		if err != nil {
+			return newDeviceError(gpu, parentGPUDevice.Address, device.Type, device.UUID, fmt.Errorf("unable to create %s vGPU device %s on parent device %s: %w", device.Type, device.UUID, parents[i].Address, err))
+		}
 	}
 	return nil
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// createMDEVDevice creates a vGPU device on a parent device of a GPU, then logs and
+// audits the creation. A failure to audit is logged without failing the creation, so
+// that the error returned always reflects the state of sysfs.
+func (cm *xdxlibVGPUConfigManager) createMDEVDevice(gpu int, parent *xdxlib.ParentDevice, mdevType string, uuid string) error {
+	logger := logging.ForVGPUDevice(uuid, mdevType, parent.Address).WithField(logging.GPUField, gpu)
+	err := parent.CreateMDEVDevice(mdevType, uuid)
+	if err != nil {
+		logger.Warnf("Unable to create vGPU device: %v", err)
+	} else {
+		logger.Infof("Created vGPU device")
+	}
+	if auditErr := cm.auditor.Record(audit.ActionCreate, parent.Address, uuid, mdevType, err); auditErr != nil {
+		logger.Warnf("Unable to audit the creation of the vGPU device: %v", auditErr)
+	}
+	return err
+}
+
+// deleteMDEVDevice deletes a vGPU device of a GPU, then logs and audits the deletion
+func (cm *xdxlibVGPUConfigManager) deleteMDEVDevice(gpu int, device *xdxlib.MediatedDevice) error {
+	logger := logging.ForVGPUDevice(device.UUID, device.MDEVType, device.Parent.Address).WithField(logging.GPUField, gpu)
+	err := device.Delete()
+	if err != nil {
+		logger.Warnf("Unable to delete vGPU device: %v", err)
+	} else {
+		logger.Infof("Deleted vGPU device")
+	}
+	if auditErr := cm.auditor.Record(audit.ActionDelete, device.Parent.Address, device.UUID, device.MDEVType, err); auditErr != nil {
+		logger.Warnf("Unable to audit the deletion of the vGPU device: %v", auditErr)
 	}
-	return b
+	return err
 }
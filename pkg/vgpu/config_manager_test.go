@@ -0,0 +1,576 @@
+package vgpu
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/logging"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib/fakesysfs"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/audit"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+const (
+	type1G = fakesysfs.TestType1G
+	type2G = fakesysfs.TestType2G
+)
+
+// newTestSysfs creates a fake sysfs with the given GPUs in a temporary directory
+func newTestSysfs(t *testing.T, gpus ...fakesysfs.GPU) *fakesysfs.Sysfs {
+	t.Helper()
+	fs, err := fakesysfs.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("unable to create fake sysfs: %v", err)
+	}
+	for _, gpu := range gpus {
+		if err := fs.AddGPU(gpu); err != nil {
+			t.Fatalf("unable to add GPU %s: %v", gpu.Address, err)
+		}
+	}
+	return fs
+}
+
+// failingWrite returns a write function failing with 'errno' on the 'n'-th write to
+// a 'create' attribute, counting from 1, and passing all other writes to 'fs'
+func failingWrite(fs *fakesysfs.Sysfs, n int, errno syscall.Errno) xdxlib.WriteFunc {
+	var mutex sync.Mutex
+	creates := 0
+	return func(path string, data string) error {
+		mutex.Lock()
+		if filepath.Base(path) == "create" {
+			creates++
+			if creates == n {
+				mutex.Unlock()
+				return &os.PathError{Op: "write", Path: path, Err: errno}
+			}
+		}
+		mutex.Unlock()
+		return fs.Write(path, data)
+	}
+}
+
+func uuids(devices []types.VGPUDevice) []string {
+	var ids []string
+	for _, device := range devices {
+		ids = append(ids, device.UUID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestSetGetClearVGPUConfig(t *testing.T) {
+	fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"), fakesysfs.NewTestGPU("0000:02:00.0"))
+	cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()))
+
+	config := types.VGPUConfig{type1G: 2, type2G: 1}
+	if err := cm.SetVGPUConfig(1, config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	current, err := cm.GetVGPUConfig(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !current.Equals(config) {
+		t.Errorf("expected config %v, got %v", config, current)
+	}
+	current, err = cm.GetVGPUConfig(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(current) != 0 {
+		t.Errorf("expected no vGPU devices on GPU 0, got %v", current)
+	}
+	if mdevs := fs.MDEVs(); len(mdevs["0000:02:00.0"]) != 3 || len(mdevs["0000:01:00.0"]) != 0 {
+		t.Errorf("expected 3 mdevs on GPU 1 only, got %v", mdevs)
+	}
+
+	if err := cm.ClearVGPUConfig(1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	current, err = cm.GetVGPUConfig(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(current) != 0 {
+		t.Errorf("expected no vGPU devices after clear, got %v", current)
+	}
+	if mdevs := fs.MDEVs(); len(mdevs) != 0 {
+		t.Errorf("expected no mdevs after clear, got %v", mdevs)
+	}
+}
+
+func TestSetVGPUConfigReplacesDevices(t *testing.T) {
+	testCases := []struct {
+		description string
+		existing    types.VGPUConfig
+		config      types.VGPUConfig
+		expected    error
+		infeasible  bool
+	}{
+		{
+			description: "same type",
+			existing:    types.VGPUConfig{type1G: 4},
+			config:      types.VGPUConfig{type1G: 2},
+		},
+		{
+			description: "other type on a partially used GPU",
+			existing:    types.VGPUConfig{type1G: 2},
+			config:      types.VGPUConfig{type2G: 2},
+		},
+		{
+			// The capacity of the other type is unknown while all of it is used
+			description: "other type on a fully used GPU",
+			existing:    types.VGPUConfig{type1G: 4},
+			config:      types.VGPUConfig{type2G: 2},
+			expected:    ErrInsufficientCapacity,
+		},
+		{
+			description: "more devices than fit once the existing ones are deleted",
+			existing:    types.VGPUConfig{type1G: 2},
+			config:      types.VGPUConfig{type1G: 5},
+			expected:    ErrInsufficientCapacity,
+			infeasible:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+			cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()))
+
+			if err := cm.SetVGPUConfig(0, tc.existing); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			err := cm.SetVGPUConfig(0, tc.config)
+			if !errors.Is(err, tc.expected) {
+				t.Fatalf("expected error %v, got %v", tc.expected, err)
+			}
+			var infeasible *LayoutInfeasibleError
+			if errors.As(err, &infeasible) != tc.infeasible {
+				t.Errorf("expected LayoutInfeasibleError %v, got %v", tc.infeasible, err)
+			}
+
+			// A config that cannot be applied does not delete any device
+			expected := tc.config
+			if tc.expected != nil {
+				expected = tc.existing
+			}
+			current, err := cm.GetVGPUConfig(0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !current.Equals(expected) {
+				t.Errorf("expected config %v, got %v", expected, current)
+			}
+		})
+	}
+
+	// Once the devices are deleted, the capacity of the other type is known
+	fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+	cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()))
+	if err := cm.SetVGPUConfig(0, types.VGPUConfig{type1G: 4}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cm.ClearVGPUConfig(0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cm.SetVGPUConfig(0, types.VGPUConfig{type2G: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSetVGPUDevices(t *testing.T) {
+	fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+	cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()))
+
+	if err := cm.SetVGPUConfig(0, types.VGPUConfig{type1G: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	devices := []types.VGPUDevice{
+		{UUID: "8c3f6d3e-52c2-4a8a-9d52-2f4f1b2c9a01", Type: type2G, ParentAddress: "0000:01:00.0"},
+		{UUID: "8c3f6d3e-52c2-4a8a-9d52-2f4f1b2c9a02", Type: type1G},
+	}
+	if err := cm.SetVGPUDevices(0, devices); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	current, err := cm.GetVGPUDevices(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(uuids(current), uuids(devices)) {
+		t.Errorf("expected devices %v, got %v", devices, current)
+	}
+}
+
+func TestSetVGPUConfigErrors(t *testing.T) {
+	testCases := []struct {
+		description string
+		gpu         int
+		config      types.VGPUConfig
+		expected    error
+	}{
+		{
+			description: "GPU index out of range",
+			gpu:         1,
+			config:      types.VGPUConfig{type1G: 1},
+			expected:    ErrGPUNotFound,
+		},
+		{
+			description: "negative GPU index",
+			gpu:         -1,
+			config:      types.VGPUConfig{type1G: 1},
+			expected:    ErrGPUNotFound,
+		},
+		{
+			description: "unsupported type",
+			gpu:         0,
+			config:      types.VGPUConfig{"XGV_V0_8G_1_CORE": 1},
+			expected:    ErrTypeUnsupported,
+		},
+		{
+			description: "too many devices",
+			gpu:         0,
+			config:      types.VGPUConfig{type1G: 1, type2G: 2},
+			expected:    ErrInsufficientCapacity,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+			cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()))
+
+			err := cm.SetVGPUConfig(tc.gpu, tc.config)
+			if !errors.Is(err, tc.expected) {
+				t.Fatalf("expected error %v, got %v", tc.expected, err)
+			}
+			if mdevs := fs.MDEVs(); len(mdevs) != 0 {
+				t.Errorf("expected no mdevs to be created, got %v", mdevs)
+			}
+		})
+	}
+}
+
+func TestGPUWithoutParentDevices(t *testing.T) {
+	gpu := fakesysfs.NewTestGPU("0000:01:00.0")
+	gpu.MDEVTypes = nil
+	fs := newTestSysfs(t, gpu)
+	cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()))
+
+	err := cm.SetVGPUConfig(0, types.VGPUConfig{type1G: 1})
+	if !errors.Is(err, ErrTypeUnsupported) {
+		t.Fatalf("expected ErrTypeUnsupported, got %v", err)
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+	snapshot, err := TakeSnapshot(WithXdxlib(fs.Interface()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := snapshot.GetVGPUDevices(1); !errors.Is(err, ErrGPUNotFound) {
+		t.Errorf("expected ErrGPUNotFound, got %v", err)
+	}
+	if _, err := snapshot.GetParentAddresses(-1); !errors.Is(err, ErrGPUNotFound) {
+		t.Errorf("expected ErrGPUNotFound, got %v", err)
+	}
+}
+
+func TestDeviceErrors(t *testing.T) {
+	t.Run("device busy", func(t *testing.T) {
+		fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+		cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()))
+		if err := cm.SetVGPUConfig(0, types.VGPUConfig{type1G: 1}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		devices, err := cm.GetVGPUDevices(0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := fs.SetBusy(devices[0].UUID, true); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		err = cm.ClearVGPUConfig(0)
+		if !errors.Is(err, ErrDeviceBusy) || !errors.Is(err, syscall.EBUSY) {
+			t.Fatalf("expected ErrDeviceBusy wrapping EBUSY, got %v", err)
+		}
+		var vgpuErr *Error
+		if !errors.As(err, &vgpuErr) || vgpuErr.UUID != devices[0].UUID {
+			t.Errorf("expected error naming vGPU device %s, got %v", devices[0].UUID, err)
+		}
+	})
+
+	t.Run("permission denied", func(t *testing.T) {
+		fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+		cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()))
+		fs.SetReadOnly(true)
+
+		err := cm.SetVGPUConfig(0, types.VGPUConfig{type1G: 1})
+		if !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("expected ErrPermissionDenied, got %v", err)
+		}
+	})
+}
+
+func TestSetVGPUConfigRollback(t *testing.T) {
+	previousConfig := types.VGPUConfig{type1G: 2}
+
+	testCases := []struct {
+		description string
+		config      types.VGPUConfig
+		// failCreate fails the n-th creation, counting those of the previous devices, 0 for none
+		failCreate int
+		expected   error
+	}{
+		{
+			description: "layout infeasible after clearing",
+			config:      types.VGPUConfig{type2G: 3},
+			expected:    ErrInsufficientCapacity,
+		},
+		{
+			description: "creation fails",
+			config:      types.VGPUConfig{type2G: 2},
+			failCreate:  4,
+			expected:    ErrDeviceBusy,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+			write := fs.Write
+			if tc.failCreate > 0 {
+				write = failingWrite(fs, tc.failCreate, syscall.EBUSY)
+			}
+			lib := xdxlib.New(xdxlib.WithSysfsRoot(fs.Root()), xdxlib.WithWriteFunc(write))
+			cm := NewXdxlibVGPUConfigManager(WithXdxlib(lib))
+
+			if err := cm.SetVGPUConfig(0, previousConfig); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			previous, err := cm.GetVGPUDevices(0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err = cm.SetVGPUConfig(0, tc.config)
+			if !errors.Is(err, tc.expected) {
+				t.Fatalf("expected error %v, got %v", tc.expected, err)
+			}
+
+			current, err := cm.GetVGPUDevices(0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(uuids(current), uuids(previous)) {
+				t.Errorf("expected previous devices %v to be restored, got %v", previous, current)
+			}
+		})
+	}
+}
+
+// recordingHook records the log lines of the standard logger
+type recordingHook struct {
+	sync.Mutex
+	entries []*log.Entry
+}
+
+func (h *recordingHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *recordingHook) Fire(entry *log.Entry) error {
+	h.Lock()
+	defer h.Unlock()
+	h.entries = append(h.entries, entry)
+	return nil
+}
+
+// withPrefix returns the recorded log lines whose message starts with 'prefix'
+func (h *recordingHook) withPrefix(prefix string) []*log.Entry {
+	h.Lock()
+	defer h.Unlock()
+	var entries []*log.Entry
+	for _, entry := range h.entries {
+		if strings.HasPrefix(entry.Message, prefix) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestSetVGPUConfigLogsDeviceChanges(t *testing.T) {
+	hook := &recordingHook{}
+	previousHooks := log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+	log.AddHook(hook)
+	t.Cleanup(func() {
+		log.StandardLogger().ReplaceHooks(previousHooks)
+	})
+
+	fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+	lib := xdxlib.New(xdxlib.WithSysfsRoot(fs.Root()), xdxlib.WithWriteFunc(failingWrite(fs, 4, syscall.EBUSY)))
+	cm := NewXdxlibVGPUConfigManager(WithXdxlib(lib))
+
+	if err := cm.SetVGPUConfig(0, types.VGPUConfig{type1G: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Deletes both 1G devices, creates a 2G device, fails to create the second one,
+	// then rolls back by deleting the 2G device and creating the 1G devices again
+	if err := cm.SetVGPUConfig(0, types.VGPUConfig{type2G: 2}); !errors.Is(err, ErrDeviceBusy) {
+		t.Fatalf("expected ErrDeviceBusy, got %v", err)
+	}
+
+	testCases := []struct {
+		prefix string
+		count  int
+		fields []string
+	}{
+		{"Created vGPU device", 5, []string{logging.GPUField, logging.AddressField, logging.MDEVTypeField, logging.UUIDField}},
+		{"Unable to create vGPU device", 1, []string{logging.GPUField, logging.AddressField, logging.MDEVTypeField, logging.UUIDField}},
+		{"Deleted vGPU device", 3, []string{logging.GPUField, logging.AddressField, logging.MDEVTypeField, logging.UUIDField}},
+		{"Rolling back", 1, []string{logging.GPUField, logging.AddressField}},
+		{"Rolled back", 1, []string{logging.GPUField, logging.AddressField}},
+	}
+	for _, tc := range testCases {
+		entries := hook.withPrefix(tc.prefix)
+		if len(entries) != tc.count {
+			t.Errorf("expected %d log lines %q, got %d", tc.count, tc.prefix, len(entries))
+		}
+		for _, entry := range entries {
+			for _, field := range tc.fields {
+				if _, exists := entry.Data[field]; !exists {
+					t.Errorf("expected log line %q to have field %s, got %v", entry.Message, field, entry.Data)
+				}
+			}
+		}
+	}
+}
+
+func TestSetVGPUConfigContextRollback(t *testing.T) {
+	fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel right after the first device of the new config was created
+	creates := 0
+	write := func(path string, data string) error {
+		err := fs.Write(path, data)
+		if filepath.Base(path) == "create" {
+			creates++
+			if creates == 2 {
+				cancel()
+			}
+		}
+		return err
+	}
+	lib := xdxlib.New(xdxlib.WithSysfsRoot(fs.Root()), xdxlib.WithWriteFunc(write))
+	cm := NewXdxlibVGPUConfigManager(WithXdxlib(lib))
+
+	if err := cm.SetVGPUConfig(0, types.VGPUConfig{type2G: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	previous, err := cm.GetVGPUDevices(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = cm.SetVGPUConfigContext(ctx, 0, types.VGPUConfig{type1G: 3})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	current, err := cm.GetVGPUDevices(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(uuids(current), uuids(previous)) {
+		t.Errorf("expected previous devices %v to be restored, got %v", previous, current)
+	}
+}
+
+func TestGetVGPUDevicesToleratesRemovedDevices(t *testing.T) {
+	fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"), fakesysfs.NewTestGPU("0000:02:00.0"))
+	cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()))
+	if err := cm.SetVGPUConfig(0, types.VGPUConfig{type1G: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Reconfigure GPU 1 while the mdev bus is walked for GPU 0, so that devices
+	// disappear between listing and reading them
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	stop := func() error {
+		close(done)
+		return <-errs
+	}
+	go func() {
+		defer close(errs)
+		configs := []types.VGPUConfig{{type1G: 4}, {type1G: 2}}
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := cm.SetVGPUConfig(1, configs[i%len(configs)]); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		devices, err := cm.GetVGPUDevices(0)
+		if err != nil {
+			stop()
+			t.Fatalf("unexpected error in iteration %d: %v", i, err)
+		}
+		if len(devices) != 2 {
+			stop()
+			t.Fatalf("expected 2 vGPU devices on GPU 0 in iteration %d, got %v", i, devices)
+		}
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("unexpected error reconfiguring GPU 1: %v", err)
+	}
+}
+
+// failingSink is an audit sink that cannot store any record
+type failingSink struct{}
+
+func (failingSink) Write(audit.Record) error { return syscall.ENOSPC }
+func (failingSink) Close() error             { return nil }
+
+func TestAuditFailureDoesNotFailChanges(t *testing.T) {
+	fs := newTestSysfs(t, fakesysfs.NewTestGPU("0000:01:00.0"))
+	auditor := audit.New(failingSink{}, audit.ActorCLI)
+	cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()), WithAuditor(auditor))
+
+	if err := cm.SetVGPUConfig(0, types.VGPUConfig{type1G: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mdevs := fs.MDEVs(); len(mdevs["0000:01:00.0"]) != 2 {
+		t.Fatalf("expected 2 mdevs, got %v", mdevs)
+	}
+	if err := cm.ClearVGPUConfig(0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mdevs := fs.MDEVs(); len(mdevs) != 0 {
+		t.Errorf("expected no mdevs after clear, got %v", mdevs)
+	}
+}
@@ -0,0 +1,89 @@
+package vgpu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Errors returned by a 'Manager', wrapped in an '*Error' naming the GPU and vGPU device
+// they occurred on. Callers match them with errors.Is.
+var (
+	// ErrGPUNotFound means there is no GPU at the given index
+	ErrGPUNotFound = errors.New("GPU not found")
+	// ErrTypeUnsupported means the vGPU type is not supported by any parent device of the GPU
+	ErrTypeUnsupported = errors.New("vGPU type not supported")
+	// ErrInsufficientCapacity means the vGPU devices do not fit on the parent devices of the GPU
+	ErrInsufficientCapacity = errors.New("insufficient capacity")
+	// ErrDeviceBusy means a vGPU device could not be created or deleted as it is in use
+	ErrDeviceBusy = errors.New("device busy")
+	// ErrPermissionDenied means writing to sysfs was not permitted
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// Error is an error of a vGPU operation on a GPU. It wraps one of the errors above,
+// as well as the underlying error, if any.
+type Error struct {
+	GPU      int
+	Address  string
+	MDEVType string
+	UUID     string
+	// Err is one of the errors above
+	Err error
+	// Cause is the underlying error, e.g. from writing to sysfs
+	Cause error
+}
+
+func (e *Error) Error() string {
+	fields := []string{fmt.Sprintf("index=%d", e.GPU)}
+	if e.Address != "" {
+		fields = append(fields, "address="+e.Address)
+	}
+	if e.MDEVType != "" {
+		fields = append(fields, "type="+e.MDEVType)
+	}
+	if e.UUID != "" {
+		fields = append(fields, "uuid="+e.UUID)
+	}
+	message := fmt.Sprintf("%v (%s)", e.Err, strings.Join(fields, ", "))
+	if e.Cause != nil {
+		message += ": " + e.Cause.Error()
+	}
+	return message
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Cause == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Err, e.Cause}
+}
+
+// Is makes a 'LayoutInfeasibleError' match ErrInsufficientCapacity
+func (e *LayoutInfeasibleError) Is(target error) bool {
+	return target == ErrInsufficientCapacity
+}
+
+// newDeviceError returns the error of creating or deleting a vGPU device. It wraps
+// ErrDeviceBusy or ErrPermissionDenied if sysfs refused the write for these reasons.
+func newDeviceError(gpu int, address string, mdevType string, uuid string, cause error) error {
+	var err error
+	switch {
+	case errors.Is(cause, syscall.EBUSY):
+		err = ErrDeviceBusy
+	case errors.Is(cause, os.ErrPermission):
+		err = ErrPermissionDenied
+	default:
+		return cause
+	}
+	return &Error{
+		GPU:      gpu,
+		Address:  address,
+		MDEVType: mdevType,
+		UUID:     uuid,
+		Err:      err,
+		Cause:    cause,
+	}
+}
@@ -0,0 +1,152 @@
+package vgpu
+
+import (
+	"fmt"
+
+	"github.com/chen-mao/go-xdxlib/pkg/xdxpci"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+// GetInventory returns the supported mdev types, their available instances and
+// the vGPU devices currently created for every GPU on the node. The available
+// instances are summed up over the parent devices of a GPU.
+func GetInventory(opts ...Option) ([]types.GPUInventory, error) {
+	lib := newXdxlibVGPUConfigManager(opts...).xdxlib
+
+	gpus, err := lib.Xdxpci.GetGPUs()
+	if err != nil {
+		return nil, fmt.Errorf("error enumerating GPUs: %w", err)
+	}
+	parents, err := lib.Xdxmdev.GetAllParentDevices()
+	if err != nil {
+		return nil, fmt.Errorf("error getting all parent devices: %w", err)
+	}
+	vGPUDevices, err := lib.Xdxmdev.GetAllMediatedDevices()
+	if err != nil {
+		return nil, fmt.Errorf("error getting all vgpu devices: %w", err)
+	}
+
+	var inventory []types.GPUInventory
+	for i, gpu := range gpus {
+		gpuInventory, err := getGPUInventory(i, gpu, parents, vGPUDevices)
+		if err != nil {
+			return nil, err
+		}
+		inventory = append(inventory, *gpuInventory)
+	}
+	return inventory, nil
+}
+
+// GetMDEVTypeNames returns the 'name' attribute in sysfs of every mdev type supported
+// by a parent device on the node, by mdev type
+func GetMDEVTypeNames(opts ...Option) (map[string]string, error) {
+	return getMDEVTypeAttributes(opts, "name", (*xdxlib.ParentDevice).GetMDEVTypeName)
+}
+
+// GetMDEVTypeIDs returns the sysfs ID of every mdev type supported by a parent device
+// on the node, by mdev type
+func GetMDEVTypeIDs(opts ...Option) (map[string]string, error) {
+	return getMDEVTypeAttributes(opts, "ID", (*xdxlib.ParentDevice).GetMDEVTypeID)
+}
+
+// getMDEVTypeAttributes returns an attribute of every mdev type supported by a parent
+// device on the node, read from the first parent device supporting the type
+func getMDEVTypeAttributes(opts []Option, attribute string, get func(*xdxlib.ParentDevice, string) (string, error)) (map[string]string, error) {
+	lib := newXdxlibVGPUConfigManager(opts...).xdxlib
+
+	parents, err := lib.Xdxmdev.GetAllParentDevices()
+	if err != nil {
+		return nil, fmt.Errorf("error getting all parent devices: %w", err)
+	}
+	attributes := make(map[string]string)
+	for _, parent := range parents {
+		for _, mdevType := range parent.GetSupportedMDEVTypes() {
+			if _, exists := attributes[mdevType]; exists {
+				continue
+			}
+			value, err := get(parent, mdevType)
+			if err != nil {
+				return nil, fmt.Errorf("error getting %s of %s: %w", attribute, mdevType, err)
+			}
+			attributes[mdevType] = value
+		}
+	}
+	return attributes, nil
+}
+
+// GetGPUInventory returns the inventory of the GPU at a particular index
+func GetGPUInventory(index int, opts ...Option) (*types.GPUInventory, error) {
+	lib := newXdxlibVGPUConfigManager(opts...).xdxlib
+
+	gpu, err := getGPU(lib, index)
+	if err != nil {
+		return nil, err
+	}
+	parents, err := lib.Xdxmdev.GetAllParentDevices()
+	if err != nil {
+		return nil, fmt.Errorf("error getting all parent devices: %w", err)
+	}
+	vGPUDevices, err := lib.Xdxmdev.GetAllMediatedDevices()
+	if err != nil {
+		return nil, fmt.Errorf("error getting all vgpu devices: %w", err)
+	}
+	return getGPUInventory(index, gpu, parents, vGPUDevices)
+}
+
+// getGPUInventory collects the inventory of a GPU from its parent devices and vGPU devices
+func getGPUInventory(i int, gpu *xdxpci.XDXCTPCIDevice, parents []*xdxlib.ParentDevice, vGPUDevices []*xdxlib.MediatedDevice) (*types.GPUInventory, error) {
+	gpuInventory := types.GPUInventory{
+		Index:       i,
+		Address:     gpu.Address,
+		Vendor:      fmt.Sprintf("0x%04x", gpu.Vendor),
+		Device:      fmt.Sprintf("0x%04x", gpu.Device),
+		MDEVTypes:   []types.MDEVTypeInventory{},
+		VGPUDevices: []types.VGPUDevice{},
+	}
+
+	addresses, err := getParentAddresses(gpu)
+	if err != nil {
+		return nil, err
+	}
+	isParent := make(map[string]bool)
+	for _, address := range addresses {
+		isParent[address] = true
+	}
+
+	typeIndex := make(map[string]int)
+	for _, parent := range parents {
+		if !isParent[parent.Address] {
+			continue
+		}
+		for _, mdevType := range parent.GetSupportedMDEVTypes() {
+			available, err := parent.GetAvailableMDEVInstances(mdevType)
+			if err != nil {
+				return nil, fmt.Errorf("error getting available instances of %s on GPU %d: %w", mdevType, i, err)
+			}
+			if j, exists := typeIndex[mdevType]; exists {
+				gpuInventory.MDEVTypes[j].AvailableInstances += available
+				continue
+			}
+			typeIndex[mdevType] = len(gpuInventory.MDEVTypes)
+			gpuInventory.MDEVTypes = append(gpuInventory.MDEVTypes, types.MDEVTypeInventory{
+				Name:               mdevType,
+				AvailableInstances: available,
+			})
+		}
+	}
+
+	for _, vGPUDevice := range vGPUDevices {
+		if !isParent[vGPUDevice.Parent.Address] {
+			continue
+		}
+		gpuInventory.VGPUDevices = append(gpuInventory.VGPUDevices, types.VGPUDevice{
+			UUID:          vGPUDevice.UUID,
+			Type:          vGPUDevice.MDEVType,
+			ParentAddress: vGPUDevice.Parent.Address,
+		})
+	}
+
+	return &gpuInventory, nil
+}
@@ -0,0 +1,296 @@
+// Package mock provides an in-memory implementation of vgpu.Manager that
+// records every call, for tests of code built on top of the vgpu package.
+package mock
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+// Methods of vgpu.Manager, as recorded in 'Call.Method'
+const (
+	GetVGPUConfig   = "GetVGPUConfig"
+	SetVGPUConfig   = "SetVGPUConfig"
+	ClearVGPUConfig = "ClearVGPUConfig"
+	GetVGPUDevices  = "GetVGPUDevices"
+	SetVGPUDevices  = "SetVGPUDevices"
+)
+
+// capacityEpsilon absorbs rounding errors when summing capacity shares
+const capacityEpsilon = 1e-9
+
+// GPU is a GPU modelled by the mock manager
+type GPU struct {
+	Address string
+	// MDEVTypes maps each supported mdev type to the number of its instances that fit
+	// on the GPU without any other vGPU device. All types share the capacity of the
+	// GPU, so one instance of a type uses '1/instances' of it.
+	MDEVTypes map[string]int
+}
+
+// Call is a call made to the mock manager
+type Call struct {
+	Method  string
+	GPU     int
+	Config  types.VGPUConfig
+	Devices []types.VGPUDevice
+}
+
+// Manager is an in-memory vgpu.Manager. The hooks are called with the arguments
+// of the corresponding method before it changes any state, a non nil error is
+// returned by the method as is.
+type Manager struct {
+	sync.Mutex
+
+	GetVGPUConfigHook   func(gpu int) error
+	SetVGPUConfigHook   func(gpu int, config types.VGPUConfig) error
+	ClearVGPUConfigHook func(gpu int) error
+	GetVGPUDevicesHook  func(gpu int) error
+	SetVGPUDevicesHook  func(gpu int, devices []types.VGPUDevice) error
+
+	UUIDGenerator vgpu.UUIDGenerator
+
+	gpus    []GPU
+	devices [][]types.VGPUDevice
+	calls   []Call
+}
+
+var _ vgpu.Manager = (*Manager)(nil)
+
+// New returns a mock manager modelling 'gpus', without any vGPU devices
+func New(gpus ...GPU) *Manager {
+	return &Manager{
+		UUIDGenerator: vgpu.NewRandomUUIDGenerator(),
+		gpus:          gpus,
+		devices:       make([][]types.VGPUDevice, len(gpus)),
+	}
+}
+
+// Calls returns all calls made to the manager, in order
+func (m *Manager) Calls() []Call {
+	m.Lock()
+	defer m.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// ResetCalls forgets all recorded calls
+func (m *Manager) ResetCalls() {
+	m.Lock()
+	defer m.Unlock()
+	m.calls = nil
+}
+
+// GetVGPUConfig returns the number of vGPU devices of each type on a GPU
+func (m *Manager) GetVGPUConfig(gpu int) (types.VGPUConfig, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.record(Call{Method: GetVGPUConfig, GPU: gpu})
+
+	if err := m.checkGPU(gpu); err != nil {
+		return nil, err
+	}
+	if m.GetVGPUConfigHook != nil {
+		if err := m.GetVGPUConfigHook(gpu); err != nil {
+			return nil, err
+		}
+	}
+
+	config := types.VGPUConfig{}
+	for _, device := range m.devices[gpu] {
+		config[device.Type]++
+	}
+	return config, nil
+}
+
+// SetVGPUConfig replaces the vGPU devices of a GPU with the ones described by 'config'
+func (m *Manager) SetVGPUConfig(gpu int, config types.VGPUConfig) error {
+	m.Lock()
+	defer m.Unlock()
+	m.record(Call{Method: SetVGPUConfig, GPU: gpu, Config: copyConfig(config)})
+
+	if err := m.checkGPU(gpu); err != nil {
+		return err
+	}
+	if m.SetVGPUConfigHook != nil {
+		if err := m.SetVGPUConfigHook(gpu, config); err != nil {
+			return err
+		}
+	}
+
+	if err := m.checkCapacity(gpu, config); err != nil {
+		return err
+	}
+	address := m.gpus[gpu].Address
+	var devices []types.VGPUDevice
+	for mdevType, count := range config {
+		for i := 0; i < count; i++ {
+			devices = append(devices, types.VGPUDevice{
+				UUID:          m.UUIDGenerator.UUID(address, mdevType, i),
+				Type:          mdevType,
+				ParentAddress: address,
+			})
+		}
+	}
+	m.devices[gpu] = devices
+	return nil
+}
+
+// ClearVGPUConfig removes all vGPU devices of a GPU
+func (m *Manager) ClearVGPUConfig(gpu int) error {
+	m.Lock()
+	defer m.Unlock()
+	m.record(Call{Method: ClearVGPUConfig, GPU: gpu})
+
+	if err := m.checkGPU(gpu); err != nil {
+		return err
+	}
+	if m.ClearVGPUConfigHook != nil {
+		if err := m.ClearVGPUConfigHook(gpu); err != nil {
+			return err
+		}
+	}
+
+	m.devices[gpu] = nil
+	return nil
+}
+
+// GetVGPUDevices returns the vGPU devices of a GPU
+func (m *Manager) GetVGPUDevices(gpu int) ([]types.VGPUDevice, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.record(Call{Method: GetVGPUDevices, GPU: gpu})
+
+	if err := m.checkGPU(gpu); err != nil {
+		return nil, err
+	}
+	if m.GetVGPUDevicesHook != nil {
+		if err := m.GetVGPUDevicesHook(gpu); err != nil {
+			return nil, err
+		}
+	}
+
+	return append([]types.VGPUDevice{}, m.devices[gpu]...), nil
+}
+
+// SetVGPUDevices replaces the vGPU devices of a GPU with exactly 'devices'
+func (m *Manager) SetVGPUDevices(gpu int, devices []types.VGPUDevice) error {
+	m.Lock()
+	defer m.Unlock()
+	m.record(Call{Method: SetVGPUDevices, GPU: gpu, Devices: append([]types.VGPUDevice(nil), devices...)})
+
+	if err := m.checkGPU(gpu); err != nil {
+		return err
+	}
+	if m.SetVGPUDevicesHook != nil {
+		if err := m.SetVGPUDevicesHook(gpu, devices); err != nil {
+			return err
+		}
+	}
+
+	config := types.VGPUConfig{}
+	for _, device := range devices {
+		config[device.Type]++
+	}
+	if err := m.checkCapacity(gpu, config); err != nil {
+		return err
+	}
+	m.devices[gpu] = append([]types.VGPUDevice(nil), devices...)
+	return nil
+}
+
+// GetVGPUConfigContext is GetVGPUConfig, failing without being recorded if 'ctx' is done
+func (m *Manager) GetVGPUConfigContext(ctx context.Context, gpu int) (types.VGPUConfig, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.GetVGPUConfig(gpu)
+}
+
+// SetVGPUConfigContext is SetVGPUConfig, failing without being recorded if 'ctx' is done
+func (m *Manager) SetVGPUConfigContext(ctx context.Context, gpu int, config types.VGPUConfig) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.SetVGPUConfig(gpu, config)
+}
+
+// ClearVGPUConfigContext is ClearVGPUConfig, failing without being recorded if 'ctx' is done
+func (m *Manager) ClearVGPUConfigContext(ctx context.Context, gpu int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.ClearVGPUConfig(gpu)
+}
+
+// GetVGPUDevicesContext is GetVGPUDevices, failing without being recorded if 'ctx' is done
+func (m *Manager) GetVGPUDevicesContext(ctx context.Context, gpu int) ([]types.VGPUDevice, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.GetVGPUDevices(gpu)
+}
+
+// SetVGPUDevicesContext is SetVGPUDevices, failing without being recorded if 'ctx' is done
+func (m *Manager) SetVGPUDevicesContext(ctx context.Context, gpu int, devices []types.VGPUDevice) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.SetVGPUDevices(gpu, devices)
+}
+
+func (m *Manager) record(call Call) {
+	m.calls = append(m.calls, call)
+}
+
+func (m *Manager) checkGPU(gpu int) error {
+	if gpu < 0 || gpu >= len(m.gpus) {
+		return &vgpu.Error{GPU: gpu, Err: vgpu.ErrGPUNotFound}
+	}
+	return nil
+}
+
+// checkCapacity checks that the devices of 'config' fit on a GPU together, each
+// instance of a type using a '1/instances' share of its capacity
+func (m *Manager) checkCapacity(gpu int, config types.VGPUConfig) error {
+	var mdevTypes []string
+	for mdevType := range config {
+		mdevTypes = append(mdevTypes, mdevType)
+	}
+	sort.Strings(mdevTypes)
+
+	used := 0.0
+	for _, mdevType := range mdevTypes {
+		instances, supported := m.gpus[gpu].MDEVTypes[mdevType]
+		if !supported || instances <= 0 {
+			return &vgpu.Error{GPU: gpu, Address: m.gpus[gpu].Address, MDEVType: mdevType, Err: vgpu.ErrTypeUnsupported}
+		}
+		count := config[mdevType]
+		used += float64(count) / float64(instances)
+		if used > 1+capacityEpsilon {
+			return &vgpu.Error{
+				GPU:      gpu,
+				Address:  m.gpus[gpu].Address,
+				MDEVType: mdevType,
+				Err:      vgpu.ErrInsufficientCapacity,
+				Cause:    fmt.Errorf("unable to create %d vGPU devices: %v would use %.0f%% of the GPU", count, config, used*100),
+			}
+		}
+	}
+	return nil
+}
+
+func copyConfig(config types.VGPUConfig) types.VGPUConfig {
+	if config == nil {
+		return nil
+	}
+	c := make(types.VGPUConfig, len(config))
+	for k, v := range config {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,64 @@
+package mock
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/vgpu"
+)
+
+const (
+	type1G = "XGV_V0_1G_1_CORE"
+	type2G = "XGV_V0_2G_1_CORE"
+)
+
+func TestSetVGPUConfig(t *testing.T) {
+	testCases := []struct {
+		description string
+		gpu         int
+		config      types.VGPUConfig
+		expected    error
+	}{
+		{
+			description: "types sharing the GPU",
+			config:      types.VGPUConfig{type1G: 2, type2G: 1},
+		},
+		{
+			description: "types exceeding the GPU together",
+			config:      types.VGPUConfig{type1G: 3, type2G: 1},
+			expected:    vgpu.ErrInsufficientCapacity,
+		},
+		{
+			description: "unsupported type",
+			config:      types.VGPUConfig{"XGV_V0_8G_1_CORE": 1},
+			expected:    vgpu.ErrTypeUnsupported,
+		},
+		{
+			description: "GPU index out of range",
+			gpu:         1,
+			config:      types.VGPUConfig{type1G: 1},
+			expected:    vgpu.ErrGPUNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			m := New(GPU{
+				Address:   "0000:01:00.0",
+				MDEVTypes: map[string]int{type1G: 4, type2G: 2},
+			})
+
+			err := m.SetVGPUConfig(tc.gpu, tc.config)
+			if tc.expected == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.expected) {
+				t.Fatalf("expected error %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
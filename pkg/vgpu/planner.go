@@ -0,0 +1,252 @@
+package vgpu
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+// capacityEpsilon absorbs rounding errors when summing capacity shares
+const capacityEpsilon = 1e-9
+
+// PlacementStrategy decides on which parent device of a GPU each vGPU device is created
+type PlacementStrategy string
+
+const (
+	// PlacementPack fills the parent devices one after the other, in PCI address order
+	PlacementPack PlacementStrategy = "pack"
+	// PlacementSpread creates each vGPU device on the parent device with the most free capacity
+	PlacementSpread PlacementStrategy = "spread"
+)
+
+// ParsePlacementStrategy returns the placement strategy with the given name
+func ParsePlacementStrategy(name string) (PlacementStrategy, error) {
+	switch strategy := PlacementStrategy(name); strategy {
+	case PlacementPack, PlacementSpread:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown placement strategy '%s', expected '%s' or '%s'", name, PlacementPack, PlacementSpread)
+}
+
+// LayoutInfeasibleError is returned when the vGPU devices of a 'VGPUConfig' do not
+// all fit on the parent devices of a GPU at the same time
+type LayoutInfeasibleError struct {
+	GPU      int
+	Address  string
+	Unplaced types.VGPUConfig
+}
+
+func (e *LayoutInfeasibleError) Error() string {
+	return fmt.Sprintf("layout infeasible on GPU (index=%d, address=%s): %v would not fit", e.GPU, e.Address, e.Unplaced)
+}
+
+// capacityModel maps each mdev type to the number of its instances that fit in the
+// free capacity of a parent device. All mdev types of a parent share its capacity,
+// so one instance of a type uses '1/instances' of it.
+type capacityModel map[string]int
+
+// getCapacityModel reads the available instances of each mdev type of a parent device
+func getCapacityModel(parent *xdxlib.ParentDevice, mdevTypes []string) (capacityModel, error) {
+	model := make(capacityModel)
+	for _, mdevType := range mdevTypes {
+		available, err := parent.GetAvailableMDEVInstances(mdevType)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get available instances of %s on parent device %s: %w", mdevType, parent.Address, err)
+		}
+		model[mdevType] = available
+	}
+	return model, nil
+}
+
+// getCapacityModels reads the capacity model of every parent device
+func getCapacityModels(parents []*xdxlib.ParentDevice, config types.VGPUConfig) ([]capacityModel, error) {
+	var mdevTypes []string
+	for mdevType := range config {
+		mdevTypes = append(mdevTypes, mdevType)
+	}
+	models := make([]capacityModel, len(parents))
+	for i, parent := range parents {
+		model, err := getCapacityModel(parent, mdevTypes)
+		if err != nil {
+			return nil, err
+		}
+		models[i] = model
+	}
+	return models, nil
+}
+
+// capacityBound tells how well capacity models describe the parent devices of a GPU
+type capacityBound int
+
+const (
+	// capacityExact means the models hold the exact instances that fit on the parents
+	capacityExact capacityBound = iota
+	// capacityLowerBound means more instances than the models hold may fit on the parents
+	capacityLowerBound
+	// capacityUnknown means the instances that fit on the parents cannot be told
+	capacityUnknown
+)
+
+// getReleasedCapacityModel returns the capacity model of a parent device once the vGPU
+// devices 'existing' on it are deleted. All mdev types share the capacity of a parent, so
+// it can only be told if the existing devices all have the same type: the instances of that
+// type are the available ones plus the existing ones, and tell the share of the capacity
+// still free. As available instances are rounded down, only a lower bound of the instances
+// of other types follows from that share, and nothing if no capacity is free.
+func getReleasedCapacityModel(parent *xdxlib.ParentDevice, mdevTypes []string, existing types.VGPUConfig) (capacityModel, capacityBound, error) {
+	var existingTypes []string
+	for mdevType, count := range existing {
+		if count > 0 {
+			existingTypes = append(existingTypes, mdevType)
+		}
+	}
+	if len(existingTypes) > 1 {
+		return nil, capacityUnknown, nil
+	}
+
+	model, err := getCapacityModel(parent, append(mdevTypes, existingTypes...))
+	if err != nil {
+		return nil, capacityUnknown, err
+	}
+	if len(existingTypes) == 0 {
+		return model, capacityExact, nil
+	}
+
+	// The capacity still free is 'free / used' of the whole capacity of the parent
+	existingType := existingTypes[0]
+	free := model[existingType]
+	used := free + existing[existingType]
+	bound := capacityExact
+	for _, mdevType := range mdevTypes {
+		switch {
+		case mdevType == existingType:
+			model[mdevType] = used
+		case model[mdevType] < 0:
+			// Not supported by the parent
+		case free == 0:
+			return nil, capacityUnknown, nil
+		default:
+			available := model[mdevType]
+			model[mdevType] = (available*used + free - 1) / free
+			// Instances fitting in the whole capacity round down to 'available' as well
+			if (model[mdevType]+1)*free < (available+1)*used {
+				bound = capacityLowerBound
+			}
+		}
+	}
+	return model, bound, nil
+}
+
+// getReleasedCapacityModels returns the capacity model of every parent device once the vGPU
+// devices 'existing' on them are deleted, and how well the models describe the parents
+func getReleasedCapacityModels(parents []*xdxlib.ParentDevice, config types.VGPUConfig, existing []types.VGPUDevice) ([]capacityModel, capacityBound, error) {
+	var mdevTypes []string
+	for mdevType := range config {
+		mdevTypes = append(mdevTypes, mdevType)
+	}
+	existingByParent := make(map[string]types.VGPUConfig)
+	for _, device := range existing {
+		if existingByParent[device.ParentAddress] == nil {
+			existingByParent[device.ParentAddress] = types.VGPUConfig{}
+		}
+		existingByParent[device.ParentAddress][device.Type]++
+	}
+
+	bound := capacityExact
+	models := make([]capacityModel, len(parents))
+	for i, parent := range parents {
+		model, parentBound, err := getReleasedCapacityModel(parent, mdevTypes, existingByParent[parent.Address])
+		if err != nil {
+			return nil, capacityUnknown, err
+		}
+		if parentBound == capacityUnknown {
+			return nil, capacityUnknown, nil
+		}
+		if parentBound > bound {
+			bound = parentBound
+		}
+		models[i] = model
+	}
+	return models, bound, nil
+}
+
+// orderMDEVTypes returns the mdev types of 'config' in creation order: types using the
+// largest share of a parent first, so that small types fill the remaining capacity
+func orderMDEVTypes(config types.VGPUConfig, models []capacityModel) []string {
+	maxInstances := func(mdevType string) int {
+		instances := 0
+		for _, model := range models {
+			if model[mdevType] > instances {
+				instances = model[mdevType]
+			}
+		}
+		return instances
+	}
+
+	var mdevTypes []string
+	for mdevType, count := range config {
+		if count > 0 {
+			mdevTypes = append(mdevTypes, mdevType)
+		}
+	}
+	sort.Slice(mdevTypes, func(i, j int) bool {
+		mi, mj := maxInstances(mdevTypes[i]), maxInstances(mdevTypes[j])
+		if mi != mj {
+			return mi < mj
+		}
+		return mdevTypes[i] < mdevTypes[j]
+	})
+	return mdevTypes
+}
+
+// selectParent returns the index of the parent device to place the next instance of
+// an mdev type on, given the number of instances of it still available on each
+// parent, or -1 if none is available
+func selectParent(strategy PlacementStrategy, available []float64) int {
+	selected := -1
+	for i, instances := range available {
+		if instances+capacityEpsilon < 1 {
+			continue
+		}
+		if selected == -1 {
+			selected = i
+			if strategy != PlacementSpread {
+				break
+			}
+		} else if instances > available[selected]+capacityEpsilon {
+			selected = i
+		}
+	}
+	return selected
+}
+
+// planVGPUConfig places the vGPU devices of 'config' on parent devices described by
+// 'models', in creation order and following 'strategy', and returns the devices that
+// would not fit
+func planVGPUConfig(config types.VGPUConfig, models []capacityModel, strategy PlacementStrategy) types.VGPUConfig {
+	free := make([]float64, len(models))
+	for i := range free {
+		free[i] = 1
+	}
+
+	unplaced := types.VGPUConfig{}
+	for _, mdevType := range orderMDEVTypes(config, models) {
+		for n := 0; n < config[mdevType]; n++ {
+			available := make([]float64, len(models))
+			for i, model := range models {
+				if model[mdevType] > 0 {
+					available[i] = free[i] * float64(model[mdevType])
+				}
+			}
+			i := selectParent(strategy, available)
+			if i == -1 {
+				unplaced[mdevType]++
+				continue
+			}
+			free[i] -= 1 / float64(models[i][mdevType])
+		}
+	}
+	return unplaced
+}
@@ -0,0 +1,142 @@
+package vgpu
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib/fakesysfs"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+// newTestSRIOVGPU returns a fake GPU with two virtual functions, each of them with
+// room for four 1G or two 2G vGPU devices
+func newTestSRIOVGPU(bus string) fakesysfs.GPU {
+	gpu := fakesysfs.NewTestGPU("0000:" + bus + ":00.0")
+	gpu.VirtualFunctions = []fakesysfs.GPU{
+		fakesysfs.NewTestGPU("0000:" + bus + ":00.1"),
+		fakesysfs.NewTestGPU("0000:" + bus + ":00.2"),
+	}
+	return gpu
+}
+
+func TestPlacement(t *testing.T) {
+	testCases := []struct {
+		description string
+		placement   PlacementStrategy
+		config      types.VGPUConfig
+		expected    map[string]int
+	}{
+		{
+			description: "pack fills the physical function first",
+			placement:   PlacementPack,
+			config:      types.VGPUConfig{type1G: 4},
+			expected:    map[string]int{"0000:01:00.0": 4},
+		},
+		{
+			description: "pack continues on the virtual functions",
+			placement:   PlacementPack,
+			config:      types.VGPUConfig{type2G: 5},
+			expected:    map[string]int{"0000:01:00.0": 2, "0000:01:00.1": 2, "0000:01:00.2": 1},
+		},
+		{
+			description: "spread distributes over the virtual functions",
+			placement:   PlacementSpread,
+			config:      types.VGPUConfig{type1G: 4},
+			expected:    map[string]int{"0000:01:00.0": 2, "0000:01:00.1": 1, "0000:01:00.2": 1},
+		},
+		{
+			description: "spread with mixed types",
+			placement:   PlacementSpread,
+			config:      types.VGPUConfig{type2G: 3, type1G: 2},
+			expected:    map[string]int{"0000:01:00.0": 2, "0000:01:00.1": 2, "0000:01:00.2": 1},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs := newTestSysfs(t, newTestSRIOVGPU("01"))
+			cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()), WithPlacementStrategy(tc.placement))
+
+			if err := cm.SetVGPUConfig(0, tc.config); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			current, err := cm.GetVGPUConfig(0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !current.Equals(tc.config) {
+				t.Errorf("expected config %v, got %v", tc.config, current)
+			}
+
+			placed := make(map[string]int)
+			for address, ids := range fs.MDEVs() {
+				placed[address] = len(ids)
+			}
+			if len(placed) != len(tc.expected) {
+				t.Fatalf("expected devices on %v, got %v", tc.expected, placed)
+			}
+			for address, count := range tc.expected {
+				if placed[address] != count {
+					t.Errorf("expected devices on %v, got %v", tc.expected, placed)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestPlacementInfeasible(t *testing.T) {
+	for _, placement := range []PlacementStrategy{PlacementPack, PlacementSpread} {
+		t.Run(string(placement), func(t *testing.T) {
+			fs := newTestSysfs(t, newTestSRIOVGPU("01"))
+			cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()), WithPlacementStrategy(placement))
+
+			err := cm.SetVGPUConfig(0, types.VGPUConfig{type2G: 5, type1G: 3})
+			var infeasible *LayoutInfeasibleError
+			if !errors.As(err, &infeasible) {
+				t.Fatalf("expected a LayoutInfeasibleError, got %v", err)
+			}
+			if !infeasible.Unplaced.Equals(types.VGPUConfig{type1G: 1}) {
+				t.Errorf("expected one 1G device not to fit, got %v", infeasible.Unplaced)
+			}
+			if mdevs := fs.MDEVs(); len(mdevs) != 0 {
+				t.Errorf("expected no mdevs to be created, got %v", mdevs)
+			}
+		})
+	}
+}
+
+// TestGPUIndexesExcludeVirtualFunctions checks that GPUs are indexed by their physical
+// functions only, so that a GPU keeps its index whether SR-IOV is enabled or not
+func TestGPUIndexesExcludeVirtualFunctions(t *testing.T) {
+	fs := newTestSysfs(t, newTestSRIOVGPU("01"), fakesysfs.NewTestGPU("0000:02:00.0"))
+
+	snapshot, err := TakeSnapshot(WithXdxlib(fs.Interface()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var addresses []string
+	for _, gpu := range snapshot.GPUs {
+		addresses = append(addresses, gpu.Address)
+	}
+	if !slices.Equal(addresses, []string{"0000:01:00.0", "0000:02:00.0"}) {
+		t.Fatalf("expected GPUs 0000:01:00.0 and 0000:02:00.0, got %v", addresses)
+	}
+
+	parents, err := snapshot.GetParentAddresses(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(parents, []string{"0000:01:00.0", "0000:01:00.1", "0000:01:00.2"}) {
+		t.Errorf("expected the virtual functions to be parent devices of GPU 0, got %v", parents)
+	}
+
+	cm := NewXdxlibVGPUConfigManager(WithXdxlib(fs.Interface()))
+	if err := cm.SetVGPUConfig(1, types.VGPUConfig{type1G: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mdevs := fs.MDEVs(); len(mdevs["0000:02:00.0"]) != 1 {
+		t.Errorf("expected GPU 1 to be 0000:02:00.0, got mdevs %v", mdevs)
+	}
+}
@@ -0,0 +1,102 @@
+package vgpu
+
+import (
+	"fmt"
+
+	"github.com/chen-mao/go-xdxlib/pkg/xdxpci"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/internal/xdxlib"
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+// Snapshot holds the GPUs of the node, their parent devices, the vGPU devices created
+// on them and their inventory, read once so that all GPUs can be checked without
+// rescanning sysfs
+type Snapshot struct {
+	GPUs      []*xdxpci.XDXCTPCIDevice
+	parents   [][]string
+	inventory []types.GPUInventory
+}
+
+// TakeSnapshot enumerates the GPUs and scans the mdev bus once
+func TakeSnapshot(opts ...Option) (*Snapshot, error) {
+	lib := newXdxlibVGPUConfigManager(opts...).xdxlib
+
+	gpus, err := lib.Xdxpci.GetGPUs()
+	if err != nil {
+		return nil, fmt.Errorf("error enumerating GPUs: %w", err)
+	}
+	parentDevices, err := lib.Xdxmdev.GetAllParentDevices()
+	if err != nil {
+		return nil, fmt.Errorf("error getting all parent devices: %w", err)
+	}
+	vGPUDevices, err := lib.Xdxmdev.GetAllMediatedDevices()
+	if err != nil {
+		return nil, fmt.Errorf("error getting all vgpu devices: %w", err)
+	}
+
+	s := &Snapshot{
+		GPUs:      gpus,
+		parents:   make([][]string, len(gpus)),
+		inventory: make([]types.GPUInventory, len(gpus)),
+	}
+	for i, gpu := range gpus {
+		s.parents[i], err = getParentAddresses(gpu)
+		if err != nil {
+			return nil, err
+		}
+		inventory, err := getGPUInventory(i, gpu, parentDevices, vGPUDevices)
+		if err != nil {
+			return nil, err
+		}
+		s.inventory[i] = *inventory
+	}
+	return s, nil
+}
+
+// GetVGPUConfig gets the 'VGPUConfig' applied to a GPU at a particular index when the snapshot was taken
+func (s *Snapshot) GetVGPUConfig(gpu int) (types.VGPUConfig, error) {
+	devices, err := s.GetVGPUDevices(gpu)
+	if err != nil {
+		return nil, err
+	}
+	config := types.VGPUConfig{}
+	for _, device := range devices {
+		config[device.Type]++
+	}
+	return config, nil
+}
+
+// GetVGPUDevices gets the vGPU devices of a GPU at a particular index when the snapshot was taken
+func (s *Snapshot) GetVGPUDevices(gpu int) ([]types.VGPUDevice, error) {
+	if gpu < 0 || gpu >= len(s.GPUs) {
+		return nil, &Error{GPU: gpu, Err: ErrGPUNotFound}
+	}
+	return s.inventory[gpu].VGPUDevices, nil
+}
+
+// GetGPUInventory gets the inventory of a GPU at a particular index when the snapshot was taken
+func (s *Snapshot) GetGPUInventory(gpu int) (*types.GPUInventory, error) {
+	if gpu < 0 || gpu >= len(s.GPUs) {
+		return nil, &Error{GPU: gpu, Err: ErrGPUNotFound}
+	}
+	return &s.inventory[gpu], nil
+}
+
+// GetParentAddresses gets the addresses of the parent devices of a GPU at a particular index
+func (s *Snapshot) GetParentAddresses(gpu int) ([]string, error) {
+	if gpu < 0 || gpu >= len(s.GPUs) {
+		return nil, &Error{GPU: gpu, Err: ErrGPUNotFound}
+	}
+	return s.parents[gpu], nil
+}
+
+// getParentAddresses returns the addresses of the devices the vGPU devices of a GPU
+// can be created on: the GPU itself and its SR-IOV virtual functions
+func getParentAddresses(gpu *xdxpci.XDXCTPCIDevice) ([]string, error) {
+	functions, err := xdxlib.GetVirtualFunctions(gpu)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{gpu.Address}, functions...), nil
+}
@@ -0,0 +1,104 @@
+package vgpu
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+// uuidNamespace is the namespace of the UUIDv5 generated for vGPU devices
+var uuidNamespace = uuid.NewSHA1(uuid.NameSpaceDNS, []byte("vgpu.xdxct.com"))
+
+// UUIDGenerator returns the UUID of the 'ordinal'-th vGPU device of 'mdevType'
+// created on the GPU at PCI address 'address'
+type UUIDGenerator interface {
+	UUID(address string, mdevType string, ordinal int) string
+	// Stable reports whether UUID returns the same UUID on every call for the
+	// 'ordinal'-th vGPU device of 'mdevType'
+	Stable(mdevType string, ordinal int) bool
+}
+
+type randomUUIDGenerator struct{}
+
+// NewRandomUUIDGenerator returns a generator creating a new random UUID for every vGPU device
+func NewRandomUUIDGenerator() UUIDGenerator {
+	return &randomUUIDGenerator{}
+}
+
+func (g *randomUUIDGenerator) UUID(address string, mdevType string, ordinal int) string {
+	return uuid.New().String()
+}
+
+func (g *randomUUIDGenerator) Stable(mdevType string, ordinal int) bool {
+	return false
+}
+
+type deterministicUUIDGenerator struct {
+	nodeName string
+}
+
+// NewDeterministicUUIDGenerator returns a generator deriving a UUIDv5 from the node name,
+// the PCI address of the GPU, the mdev type and the ordinal, so that re-applying a config
+// recreates the vGPU devices with the same UUIDs
+func NewDeterministicUUIDGenerator(nodeName string) UUIDGenerator {
+	return &deterministicUUIDGenerator{
+		nodeName: nodeName,
+	}
+}
+
+func (g *deterministicUUIDGenerator) UUID(address string, mdevType string, ordinal int) string {
+	name := fmt.Sprintf("%s/%s/%s/%d", g.nodeName, address, mdevType, ordinal)
+	return uuid.NewSHA1(uuidNamespace, []byte(name)).String()
+}
+
+func (g *deterministicUUIDGenerator) Stable(mdevType string, ordinal int) bool {
+	return true
+}
+
+type pinnedUUIDGenerator struct {
+	pinned   map[string][]string
+	fallback UUIDGenerator
+}
+
+// NewPinnedUUIDGenerator returns a generator using the UUIDs pinned for each mdev type
+// in order, and 'fallback' once they are exhausted
+func NewPinnedUUIDGenerator(pinned map[string][]string, fallback UUIDGenerator) UUIDGenerator {
+	return &pinnedUUIDGenerator{
+		pinned:   pinned,
+		fallback: fallback,
+	}
+}
+
+func (g *pinnedUUIDGenerator) UUID(address string, mdevType string, ordinal int) string {
+	if ordinal < len(g.pinned[mdevType]) {
+		return g.pinned[mdevType][ordinal]
+	}
+	return g.fallback.UUID(address, mdevType, ordinal)
+}
+
+func (g *pinnedUUIDGenerator) Stable(mdevType string, ordinal int) bool {
+	return ordinal < len(g.pinned[mdevType]) || g.fallback.Stable(mdevType, ordinal)
+}
+
+// MatchesUUIDs checks if 'devices' contain every vGPU device 'generator' would
+// create for 'config' on the GPU at PCI address 'address'. Only the vGPU devices
+// 'generator' has a stable UUID for are checked, any UUID matches the others.
+func MatchesUUIDs(devices []types.VGPUDevice, config types.VGPUConfig, address string, generator UUIDGenerator) bool {
+	deviceTypes := make(map[string]string)
+	for _, device := range devices {
+		deviceTypes[device.UUID] = device.Type
+	}
+	for mdevType, count := range config {
+		for i := 0; i < count; i++ {
+			if !generator.Stable(mdevType, i) {
+				continue
+			}
+			if deviceTypes[generator.UUID(address, mdevType, i)] != mdevType {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+package vgpu
+
+import (
+	"testing"
+
+	"github.com/chen-mao/xdxct-vgpu-device-manager/pkg/types"
+)
+
+const (
+	pinnedUUID0 = "5b8e1e6a-5a1c-4d8b-9d3e-0c6f2a1b3c4d"
+	pinnedUUID1 = "9f0c2d4e-1b3a-4c5d-8e7f-6a5b4c3d2e1f"
+)
+
+// createDevices returns the vGPU devices 'generator' creates for 'config' on the GPU at 'address'
+func createDevices(generator UUIDGenerator, config types.VGPUConfig, address string) []types.VGPUDevice {
+	var devices []types.VGPUDevice
+	for mdevType, count := range config {
+		for i := 0; i < count; i++ {
+			devices = append(devices, types.VGPUDevice{
+				UUID: generator.UUID(address, mdevType, i),
+				Type: mdevType,
+			})
+		}
+	}
+	return devices
+}
+
+func TestUUIDGenerators(t *testing.T) {
+	const address = "0000:01:00.0"
+	config := types.VGPUConfig{type1G: 2, type2G: 1}
+
+	testCases := []struct {
+		description string
+		generator   UUIDGenerator
+		stable      map[int]bool
+		expected    map[int]string
+	}{
+		{
+			description: "random",
+			generator:   NewRandomUUIDGenerator(),
+			stable:      map[int]bool{0: false, 1: false},
+		},
+		{
+			description: "deterministic",
+			generator:   NewDeterministicUUIDGenerator("node-a"),
+			stable:      map[int]bool{0: true, 1: true},
+		},
+		{
+			description: "pinned",
+			generator: NewPinnedUUIDGenerator(
+				map[string][]string{type1G: {pinnedUUID0, pinnedUUID1}},
+				NewRandomUUIDGenerator(),
+			),
+			stable:   map[int]bool{0: true, 1: true},
+			expected: map[int]string{0: pinnedUUID0, 1: pinnedUUID1},
+		},
+		{
+			description: "partially pinned with random fallback",
+			generator: NewPinnedUUIDGenerator(
+				map[string][]string{type1G: {pinnedUUID0}},
+				NewRandomUUIDGenerator(),
+			),
+			stable:   map[int]bool{0: true, 1: false},
+			expected: map[int]string{0: pinnedUUID0},
+		},
+		{
+			description: "partially pinned with deterministic fallback",
+			generator: NewPinnedUUIDGenerator(
+				map[string][]string{type1G: {pinnedUUID0}},
+				NewDeterministicUUIDGenerator("node-a"),
+			),
+			stable:   map[int]bool{0: true, 1: true},
+			expected: map[int]string{0: pinnedUUID0},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			for ordinal, stable := range tc.stable {
+				if s := tc.generator.Stable(type1G, ordinal); s != stable {
+					t.Errorf("expected stable %v for ordinal %d, got %v", stable, ordinal, s)
+				}
+				first := tc.generator.UUID(address, type1G, ordinal)
+				second := tc.generator.UUID(address, type1G, ordinal)
+				if stable && first != second {
+					t.Errorf("expected the same UUID for ordinal %d, got %s and %s", ordinal, first, second)
+				}
+				if !stable && first == second {
+					t.Errorf("expected a new UUID for ordinal %d, got %s twice", ordinal, first)
+				}
+				if expected, pinned := tc.expected[ordinal]; pinned && first != expected {
+					t.Errorf("expected pinned UUID %s for ordinal %d, got %s", expected, ordinal, first)
+				}
+			}
+
+			// Devices created by the generator match, whatever the UUIDs of the unstable ones
+			devices := createDevices(tc.generator, config, address)
+			if !MatchesUUIDs(devices, config, address, tc.generator) {
+				t.Errorf("expected devices %v to match", devices)
+			}
+		})
+	}
+}
+
+func TestDeterministicUUIDGeneratorInputs(t *testing.T) {
+	generator := NewDeterministicUUIDGenerator("node-a")
+	uuid := generator.UUID("0000:01:00.0", type1G, 0)
+
+	others := map[string]string{
+		"node":    NewDeterministicUUIDGenerator("node-b").UUID("0000:01:00.0", type1G, 0),
+		"address": generator.UUID("0000:02:00.0", type1G, 0),
+		"type":    generator.UUID("0000:01:00.0", type2G, 0),
+		"ordinal": generator.UUID("0000:01:00.0", type1G, 1),
+	}
+	for input, other := range others {
+		if other == uuid {
+			t.Errorf("expected a different UUID for a different %s, got %s", input, uuid)
+		}
+	}
+}
+
+func TestMatchesUUIDs(t *testing.T) {
+	const address = "0000:01:00.0"
+	config := types.VGPUConfig{type1G: 2}
+	partial := NewPinnedUUIDGenerator(map[string][]string{type1G: {pinnedUUID0}}, NewRandomUUIDGenerator())
+
+	testCases := []struct {
+		description string
+		generator   UUIDGenerator
+		devices     []types.VGPUDevice
+		expected    bool
+	}{
+		{
+			description: "random UUIDs always match",
+			generator:   NewRandomUUIDGenerator(),
+			devices:     []types.VGPUDevice{{UUID: pinnedUUID0, Type: type1G}, {UUID: pinnedUUID1, Type: type1G}},
+			expected:    true,
+		},
+		{
+			description: "deterministic UUIDs must all exist",
+			generator:   NewDeterministicUUIDGenerator("node-a"),
+			devices:     []types.VGPUDevice{{UUID: pinnedUUID0, Type: type1G}, {UUID: pinnedUUID1, Type: type1G}},
+			expected:    false,
+		},
+		{
+			description: "partially pinned UUIDs match any UUID for the unpinned devices",
+			generator:   partial,
+			devices:     []types.VGPUDevice{{UUID: pinnedUUID0, Type: type1G}, {UUID: pinnedUUID1, Type: type1G}},
+			expected:    true,
+		},
+		{
+			description: "partially pinned UUIDs must exist",
+			generator:   partial,
+			devices:     []types.VGPUDevice{{UUID: pinnedUUID1, Type: type1G}, {UUID: "0b1c2d3e-4f5a-4b6c-8d7e-9f0a1b2c3d4e", Type: type1G}},
+			expected:    false,
+		},
+		{
+			description: "pinned UUIDs must have the pinned type",
+			generator:   partial,
+			devices:     []types.VGPUDevice{{UUID: pinnedUUID0, Type: type2G}, {UUID: pinnedUUID1, Type: type1G}},
+			expected:    false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			if matches := MatchesUUIDs(tc.devices, config, address, tc.generator); matches != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, matches)
+			}
+		})
+	}
+}
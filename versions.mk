@@ -1,3 +1,3 @@
 VERSION := 1.0.0
 
-GOLANG_VERSION := 1.19.5
\ No newline at end of file
+GOLANG_VERSION := 1.21.13
\ No newline at end of file